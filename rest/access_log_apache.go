@@ -5,27 +5,28 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
-// TODO Future improvements:
-// * support %{strftime}t ?
-// * support %{<header>}o to print headers
-
 // AccessLogFormat defines the format of the access log record.
 // This implementation is a subset of Apache mod_log_config.
-// (See http://httpd.apache.org/docs/2.0/mod/mod_log_config.html)
+// (See http://httpd.apache.org/docs/2.4/mod/mod_log_config.html)
 //
+//   %% the percent sign
 //   %b content length in bytes, - if 0
 //   %B content length in bytes
 //   %D response elapsed time in microseconds
 //   %h remote address
 //   %H server protocol
+//   %I bytes received, estimated from the request line, the headers and the Content-Length
 //   %l identd logname, not supported, -
+//   %L request id, as set by the RequestIdMiddleware, - if missing
 //   %m http method
+//   %O bytes sent, estimated from the status line, the headers and the content length
 //   %P process id
 //   %q query string
 //   %r first line of the request
@@ -34,10 +35,19 @@ import (
 //   %t time of the request
 //   %T response elapsed time in seconds, 3 decimals
 //   %u remote user, - if missing
-//   %{User-Agent}i user agent, - if missing
-//   %{Referer}i referer, - is missing
+//   %U URL path, without the query string
+//   %v host of the request, without the port
+//   %{Name}i request header, - if missing, eg: %{User-Agent}i
+//   %{Name}o response header, - if missing, eg: %{Content-Type}o
+//   %{Name}C request cookie, - if missing
+//   %{KEY}e request.Env value, - if missing, eg: %{TRACE_ID}e, as set by the TracingMiddleware
+//   %{format}t time of the request, in a strftime format, eg: %{%Y-%m-%d %H:%M:%S}t, or one of
+//              sec, msec, usec, msec_frac, usec_frac. The format can be prefixed with end: to use
+//              the time of the end of the response, instead of begin:, the default.
+//   %{UNIT}T response elapsed time in the unit, one of ms, us, s
 //
-// Some predefined formats are provided as contants.
+// The < and > modifiers of Apache, as in %>s, are accepted and ignored. Some predefined formats are
+// provided as contants.
 type AccessLogFormat string
 
 const (
@@ -53,7 +63,7 @@ const (
 
 // AccessLogApacheMiddleware produces the access log following a format inspired by Apache
 // mod_log_config. It depends on TimerMiddleware and RecorderMiddleware that should be in the wrapped
-// middlewares. It also uses request.Env["REMOTE_USER"].(string) set by the auth middlewares.
+// middlewares. It also uses request.RemoteUser() set by the auth middlewares.
 type AccessLogApacheMiddleware struct {
 
 	// Logger points to the logger object used by this middleware, it defaults to
@@ -61,10 +71,10 @@ type AccessLogApacheMiddleware struct {
 	Logger *log.Logger
 
 	// Format defines the format of the access log record. See AccessLogFormat for the details.
-	// It defaults to DefaultLogFormat.
+	// It defaults to DefaultLogFormat. An invalid format is a fatal error, see AccessLogFormat.Validate.
 	Format AccessLogFormat
 
-	textTemplate *template.Template
+	parts []accessLogPart
 }
 
 // MiddlewareFunc makes AccessLogApacheMiddleware implement the Middleware interface.
@@ -80,7 +90,11 @@ func (mw *AccessLogApacheMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 		mw.Format = DefaultLogFormat
 	}
 
-	mw.convertFormat()
+	var err error
+	mw.parts, err = mw.Format.parse()
+	if err != nil {
+		log.Fatalf("AccessLogApacheMiddleware: %s", err)
+	}
 
 	return func(w ResponseWriter, r *Request) {
 
@@ -89,79 +103,345 @@ func (mw *AccessLogApacheMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 
 		util := &accessLogUtil{w, r}
 
-		mw.Logger.Print(mw.executeTextTemplate(util))
-	}
-}
-
-var apacheAdapter = strings.NewReplacer(
-	"%b", "{{.BytesWritten | dashIf0}}",
-	"%B", "{{.BytesWritten}}",
-	"%D", "{{.ResponseTime | microseconds}}",
-	"%h", "{{.ApacheRemoteAddr}}",
-	"%H", "{{.R.Proto}}",
-	"%l", "-",
-	"%m", "{{.R.Method}}",
-	"%P", "{{.Pid}}",
-	"%q", "{{.ApacheQueryString}}",
-	"%r", "{{.R.Method}} {{.R.URL.RequestURI}} {{.R.Proto}}",
-	"%s", "{{.StatusCode}}",
-	"%S", "\033[{{.StatusCode | statusCodeColor}}m{{.StatusCode}}",
-	"%t", "{{if .StartTime}}{{.StartTime.Format \"02/Jan/2006:15:04:05 -0700\"}}{{end}}",
-	"%T", "{{if .ResponseTime}}{{.ResponseTime.Seconds | printf \"%.3f\"}}{{end}}",
-	"%u", "{{.RemoteUser | dashIfEmptyStr}}",
-	"%{User-Agent}i", "{{.R.UserAgent | dashIfEmptyStr}}",
-	"%{Referer}i", "{{.R.Referer | dashIfEmptyStr}}",
-)
+		buffer := &bytes.Buffer{}
+		for _, part := range mw.parts {
+			part(buffer, util)
+		}
+		mw.Logger.Print(buffer.String())
+	}
+}
+
+// Validate returns an error if the format contains an unknown or malformed directive.
+func (format AccessLogFormat) Validate() error {
+	_, err := format.parse()
+	return err
+}
+
+// accessLogPart writes a piece of the access log record.
+type accessLogPart func(buffer *bytes.Buffer, util *accessLogUtil)
 
-// Convert the Apache access log format into a text/template
-func (mw *AccessLogApacheMiddleware) convertFormat() {
+// parse compiles the format into the list of parts of the access log record.
+func (format AccessLogFormat) parse() ([]accessLogPart, error) {
 
-	tmplText := apacheAdapter.Replace(string(mw.Format))
+	parts := []accessLogPart{}
+	text := string(format)
+	literal := ""
 
-	funcMap := template.FuncMap{
-		"dashIfEmptyStr": func(value string) string {
-			if value == "" {
-				return "-"
+	for i := 0; i < len(text); i++ {
+		if text[i] != '%' {
+			literal += text[i : i+1]
+			continue
+		}
+
+		start := i
+		i++
+
+		// the Apache modifiers, as in %>s, don't apply
+		for i < len(text) && (text[i] == '<' || text[i] == '>') {
+			i++
+		}
+
+		param := ""
+		hasParam := false
+		if i < len(text) && text[i] == '{' {
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated directive at position %d", start)
 			}
-			return value
-		},
-		"dashIf0": func(value int64) string {
-			if value == 0 {
-				return "-"
+			param = text[i+1 : i+end]
+			hasParam = true
+			i += end + 1
+		}
+		if i >= len(text) {
+			return nil, fmt.Errorf("incomplete directive at position %d", start)
+		}
+
+		directive := text[i]
+		if directive == '%' && !hasParam {
+			literal += "%"
+			continue
+		}
+
+		var part accessLogPart
+		var err error
+		if hasParam {
+			part, err = makeAccessLogParamPart(directive, param)
+		} else {
+			part = accessLogParts[directive]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s at position %d", err, start)
+		}
+		if part == nil {
+			return nil, fmt.Errorf("unknown directive %s at position %d", text[start:i+1], start)
+		}
+
+		if literal != "" {
+			parts = append(parts, makeAccessLogLiteralPart(literal))
+			literal = ""
+		}
+		parts = append(parts, part)
+	}
+
+	if literal != "" {
+		parts = append(parts, makeAccessLogLiteralPart(literal))
+	}
+	return parts, nil
+}
+
+func makeAccessLogLiteralPart(literal string) accessLogPart {
+	return func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(literal)
+	}
+}
+
+// The directives without parameter.
+var accessLogParts = map[byte]accessLogPart{
+	'b': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		if bytesWritten := util.BytesWritten(); bytesWritten != 0 {
+			buffer.WriteString(strconv.FormatInt(bytesWritten, 10))
+		} else {
+			buffer.WriteString("-")
+		}
+	},
+	'B': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(strconv.FormatInt(util.BytesWritten(), 10))
+	},
+	'D': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		if responseTime := util.ResponseTime(); responseTime != nil {
+			buffer.WriteString(strconv.FormatInt(responseTime.Nanoseconds()/1000, 10))
+		}
+	},
+	'h': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(util.ApacheRemoteAddr())
+	},
+	'H': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(util.R.Proto)
+	},
+	'I': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(strconv.FormatInt(util.BytesReceived(), 10))
+	},
+	'l': makeAccessLogLiteralPart("-"),
+	'L': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(dashIfEmpty(util.RequestId()))
+	},
+	'm': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(util.R.Method)
+	},
+	'O': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(strconv.FormatInt(util.BytesSent(), 10))
+	},
+	'P': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(strconv.Itoa(util.Pid()))
+	},
+	'q': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(util.ApacheQueryString())
+	},
+	'r': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(util.R.Method + " " + util.R.URL.RequestURI() + " " + util.R.Proto)
+	},
+	's': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(strconv.Itoa(util.StatusCode()))
+	},
+	'S': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		statusCode := util.StatusCode()
+		color := "0;32"
+		if statusCode >= 400 && statusCode < 500 {
+			color = "1;33"
+		} else if statusCode >= 500 {
+			color = "0;31"
+		}
+		buffer.WriteString("\033[" + color + "m" + strconv.Itoa(statusCode))
+	},
+	't': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		if startTime := util.StartTime(); startTime != nil {
+			buffer.WriteString(startTime.Format("02/Jan/2006:15:04:05 -0700"))
+		}
+	},
+	'T': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		if responseTime := util.ResponseTime(); responseTime != nil {
+			buffer.WriteString(fmt.Sprintf("%.3f", responseTime.Seconds()))
+		}
+	},
+	'u': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(dashIfEmpty(util.RemoteUser()))
+	},
+	'U': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(util.R.URL.Path)
+	},
+	'v': func(buffer *bytes.Buffer, util *accessLogUtil) {
+		buffer.WriteString(util.Host())
+	},
+}
+
+// makeAccessLogParamPart returns the part of a directive with a parameter, as in %{Name}i.
+func makeAccessLogParamPart(directive byte, param string) (accessLogPart, error) {
+	switch directive {
+	case 'i':
+		return func(buffer *bytes.Buffer, util *accessLogUtil) {
+			buffer.WriteString(dashIfEmpty(util.R.Header.Get(param)))
+		}, nil
+	case 'o':
+		return func(buffer *bytes.Buffer, util *accessLogUtil) {
+			buffer.WriteString(dashIfEmpty(util.W.Header().Get(param)))
+		}, nil
+	case 'C':
+		return func(buffer *bytes.Buffer, util *accessLogUtil) {
+			value := ""
+			if cookie, err := util.R.Cookie(param); err == nil {
+				value = cookie.Value
 			}
-			return fmt.Sprintf("%d", value)
-		},
-		"microseconds": func(dur *time.Duration) string {
-			if dur != nil {
-				return fmt.Sprintf("%d", dur.Nanoseconds()/1000)
+			buffer.WriteString(dashIfEmpty(value))
+		}, nil
+	case 'e':
+		return func(buffer *bytes.Buffer, util *accessLogUtil) {
+			buffer.WriteString(dashIfEmpty(util.EnvValue(param)))
+		}, nil
+	case 'T':
+		unit, ok := map[string]time.Duration{
+			"s":  time.Second,
+			"ms": time.Millisecond,
+			"us": time.Microsecond,
+		}[param]
+		if !ok {
+			return nil, fmt.Errorf("unknown time unit %q", param)
+		}
+		return func(buffer *bytes.Buffer, util *accessLogUtil) {
+			if responseTime := util.ResponseTime(); responseTime != nil {
+				buffer.WriteString(strconv.FormatInt(int64(*responseTime/unit), 10))
 			}
-			return ""
-		},
-		"statusCodeColor": func(statusCode int) string {
-			if statusCode >= 400 && statusCode < 500 {
-				return "1;33"
-			} else if statusCode >= 500 {
-				return "0;31"
+		}, nil
+	case 't':
+		return makeAccessLogTimePart(param)
+	}
+	return nil, nil
+}
+
+// makeAccessLogTimePart returns the part of the %{format}t directive.
+func makeAccessLogTimePart(param string) (accessLogPart, error) {
+
+	end := false
+	if strings.HasPrefix(param, "end:") {
+		end = true
+		param = strings.TrimPrefix(param, "end:")
+	} else {
+		param = strings.TrimPrefix(param, "begin:")
+	}
+
+	var format func(t time.Time) string
+	switch param {
+	case "sec":
+		format = func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+	case "msec":
+		format = func(t time.Time) string { return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) }
+	case "usec":
+		format = func(t time.Time) string { return strconv.FormatInt(t.UnixNano()/int64(time.Microsecond), 10) }
+	case "msec_frac":
+		format = func(t time.Time) string { return fmt.Sprintf("%03d", t.Nanosecond()/int(time.Millisecond)) }
+	case "usec_frac":
+		format = func(t time.Time) string { return fmt.Sprintf("%06d", t.Nanosecond()/int(time.Microsecond)) }
+	default:
+		strftime, err := parseStrftime(param)
+		if err != nil {
+			return nil, err
+		}
+		format = strftime
+	}
+
+	return func(buffer *bytes.Buffer, util *accessLogUtil) {
+		startTime := util.StartTime()
+		if startTime == nil {
+			return
+		}
+		t := *startTime
+		if end {
+			if responseTime := util.ResponseTime(); responseTime != nil {
+				t = t.Add(*responseTime)
 			}
-			return "0;32"
-		},
+		}
+		buffer.WriteString(format(t))
+	}, nil
+}
+
+// The strftime conversions, as Go time layouts.
+var strftimeLayouts = map[byte]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'd': "02",
+	'D': "01/02/06",
+	'e': "_2",
+	'F': "2006-01-02",
+	'h': "Jan",
+	'H': "15",
+	'I': "03",
+	'j': "002",
+	'm': "01",
+	'M': "04",
+	'p': "PM",
+	'R': "15:04",
+	'S': "05",
+	'T': "15:04:05",
+	'y': "06",
+	'Y': "2006",
+	'z': "-0700",
+	'Z': "MST",
+}
+
+// parseStrftime converts a strftime format into a function formatting the time. The literal text
+// is kept apart from the Go layouts, so that it is never interpreted as a layout.
+func parseStrftime(format string) (func(t time.Time) string, error) {
+
+	type strftimePart struct {
+		literal string
+		layout  string
 	}
+	parts := []strftimePart{}
 
-	var err error
-	mw.textTemplate, err = template.New("accessLog").Funcs(funcMap).Parse(tmplText)
-	if err != nil {
-		panic(err)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			parts = append(parts, strftimePart{literal: format[i : i+1]})
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return nil, fmt.Errorf("incomplete time format %q", format)
+		}
+		switch format[i] {
+		case '%':
+			parts = append(parts, strftimePart{literal: "%"})
+		case 'n':
+			parts = append(parts, strftimePart{literal: "\n"})
+		case 't':
+			parts = append(parts, strftimePart{literal: "\t"})
+		default:
+			layout, ok := strftimeLayouts[format[i]]
+			if !ok {
+				return nil, fmt.Errorf("unknown time format %%%c", format[i])
+			}
+			parts = append(parts, strftimePart{layout: layout})
+		}
 	}
+
+	return func(t time.Time) string {
+		result := ""
+		for _, part := range parts {
+			if part.layout != "" {
+				result += t.Format(part.layout)
+			} else {
+				result += part.literal
+			}
+		}
+		return result
+	}, nil
 }
 
-// Execute the text template with the data derived from the request, and return a string.
-func (mw *AccessLogApacheMiddleware) executeTextTemplate(util *accessLogUtil) string {
-	buf := bytes.NewBufferString("")
-	err := mw.textTemplate.Execute(buf, util)
-	if err != nil {
-		panic(err)
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
 	}
-	return buf.String()
+	return value
 }
 
 // accessLogUtil provides a collection of utility functions that devrive data from the Request object.
@@ -173,12 +453,75 @@ type accessLogUtil struct {
 
 // As stored by the auth middlewares.
 func (u *accessLogUtil) RemoteUser() string {
-	if u.R.Env["REMOTE_USER"] != nil {
-		return u.R.Env["REMOTE_USER"].(string)
+	remoteUser, _ := u.R.RemoteUser()
+	return remoteUser
+}
+
+// As set by the request id middleware.
+func (u *accessLogUtil) RequestId() string {
+	requestId, _ := u.R.RequestId()
+	return requestId
+}
+
+// As set by the tracing middleware.
+func (u *accessLogUtil) TraceId() string {
+	traceId, _ := u.R.TraceId()
+	return traceId
+}
+
+// The request.Env value, using the typed accessors for the values they set.
+func (u *accessLogUtil) EnvValue(key string) string {
+	switch key {
+	case "TRACE_ID":
+		return u.TraceId()
+	case "REQUEST_ID":
+		return u.RequestId()
+	case "REMOTE_USER":
+		return u.RemoteUser()
+	}
+	if value, ok := u.R.Env[key]; ok && value != nil {
+		return fmt.Sprint(value)
 	}
 	return ""
 }
 
+// Host of the request, without the port.
+func (u *accessLogUtil) Host() string {
+	if host, _, err := net.SplitHostPort(u.R.Host); err == nil {
+		return host
+	}
+	return u.R.Host
+}
+
+// Size of the request line, headers and body, as announced by the Content-Length.
+func (u *accessLogUtil) BytesReceived() int64 {
+	size := int64(len(u.R.Method) + len(u.R.URL.RequestURI()) + len(u.R.Proto) + 4)
+	size += headerSize(u.R.Header)
+	if u.R.ContentLength > 0 {
+		size += u.R.ContentLength
+	}
+	return size
+}
+
+// Size of the status line, headers and body, as recorded by the recorder middleware.
+func (u *accessLogUtil) BytesSent() int64 {
+	statusCode := u.StatusCode()
+	size := int64(len(u.R.Proto) + len(strconv.Itoa(statusCode)) + len(http.StatusText(statusCode)) + 4)
+	size += headerSize(u.W.Header())
+	return size + u.BytesWritten()
+}
+
+// Size of the headers, as written on the wire, including the final empty line.
+func headerSize(header http.Header) int64 {
+	size := int64(2)
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value) + 4)
+		}
+	}
+	return size
+}
+
 // If qs exists then return it with a leadin "?", apache log style.
 func (u *accessLogUtil) ApacheQueryString() string {
 	if u.R.URL.RawQuery != "" {
@@ -189,8 +532,8 @@ func (u *accessLogUtil) ApacheQueryString() string {
 
 // When the request entered the timer middleware.
 func (u *accessLogUtil) StartTime() *time.Time {
-	if u.R.Env["START_TIME"] != nil {
-		return u.R.Env["START_TIME"].(*time.Time)
+	if startTime, ok := u.R.StartTime(); ok {
+		return &startTime
 	}
 	return nil
 }
@@ -208,16 +551,14 @@ func (u *accessLogUtil) ApacheRemoteAddr() string {
 
 // As recorded by the recorder middleware.
 func (u *accessLogUtil) StatusCode() int {
-	if u.R.Env["STATUS_CODE"] != nil {
-		return u.R.Env["STATUS_CODE"].(int)
-	}
-	return 0
+	statusCode, _ := u.R.StatusCode()
+	return statusCode
 }
 
 // As mesured by the timer middleware.
 func (u *accessLogUtil) ResponseTime() *time.Duration {
-	if u.R.Env["ELAPSED_TIME"] != nil {
-		return u.R.Env["ELAPSED_TIME"].(*time.Duration)
+	if elapsedTime, ok := u.R.ElapsedTime(); ok {
+		return &elapsedTime
 	}
 	return nil
 }
@@ -229,8 +570,6 @@ func (u *accessLogUtil) Pid() int {
 
 // As recorded by the recorder middleware.
 func (u *accessLogUtil) BytesWritten() int64 {
-	if u.R.Env["BYTES_WRITTEN"] != nil {
-		return u.R.Env["BYTES_WRITTEN"].(int64)
-	}
-	return 0
+	bytesWritten, _ := u.R.BytesWritten()
+	return bytesWritten
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/ant0ine/go-json-rest/rest/test"
 	"log"
+	"net/http"
 	"regexp"
 	"testing"
 )
@@ -15,9 +16,8 @@ func TestAccessLogApacheMiddleware(t *testing.T) {
 	// the middlewares stack
 	buffer := bytes.NewBufferString("")
 	api.Use(&AccessLogApacheMiddleware{
-		Logger:       log.New(buffer, "", 0),
-		Format:       CommonLogFormat,
-		textTemplate: nil,
+		Logger: log.New(buffer, "", 0),
+		Format: CommonLogFormat,
 	})
 	api.Use(&TimerMiddleware{})
 	api.Use(&RecorderMiddleware{})
@@ -51,9 +51,8 @@ func TestAccessLogApacheMiddlewareMissingData(t *testing.T) {
 	// the uncomplete middlewares stack
 	buffer := bytes.NewBufferString("")
 	api.Use(&AccessLogApacheMiddleware{
-		Logger:       log.New(buffer, "", 0),
-		Format:       CommonLogFormat,
-		textTemplate: nil,
+		Logger: log.New(buffer, "", 0),
+		Format: CommonLogFormat,
 	})
 
 	// a simple app
@@ -76,3 +75,62 @@ func TestAccessLogApacheMiddlewareMissingData(t *testing.T) {
 		t.Errorf("Got: %s", buffer.String())
 	}
 }
+
+func TestAccessLogApacheDirectives(t *testing.T) {
+
+	api := NewApi()
+
+	buffer := bytes.NewBufferString("")
+	api.Use(&AccessLogApacheMiddleware{
+		Logger: log.New(buffer, "", 0),
+		Format: "%{X-Custom}i %{X-Missing}i %{Content-Type}o %{session}C %{APP_KEY}e %v %U %>s %% é " +
+			"%{%Y-%m-%d}t %{sec}t %{ms}T %I %O",
+	})
+	api.Use(&TimerMiddleware{})
+	api.Use(&RecorderMiddleware{})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		r.Env["APP_KEY"] = 42
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("GET", "http://localhost:8080/users?page=2", nil)
+	req.Header.Set("X-Custom", "custom")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s3cr3t"})
+	test.RunRequest(t, handler, req).CodeIs(200)
+
+	expected := regexp.MustCompile(`^custom - application/json; charset=utf-8 s3cr3t 42 localhost /users 200 % é ` +
+		`\d{4}-\d{2}-\d{2} \d{10} \d+ \d+ \d+\n$`)
+	if !expected.Match(buffer.Bytes()) {
+		t.Errorf("Got: %s", buffer.String())
+	}
+}
+
+func TestAccessLogFormatValidate(t *testing.T) {
+
+	for _, format := range []AccessLogFormat{
+		CommonLogFormat,
+		CombinedLogFormat,
+		DefaultLogFormat,
+		"%{end:%d/%b/%Y:%H:%M:%S %z}t %{usec_frac}t %{us}T %L %{TRACE_ID}e",
+	} {
+		if err := format.Validate(); err != nil {
+			t.Errorf("%q expected to be valid, got: %s", format, err)
+		}
+	}
+
+	for format, message := range map[AccessLogFormat]string{
+		"%h %X":       "unknown directive %X at position 3",
+		"%{Name}x":    "unknown directive %{Name}x at position 0",
+		"%{Name":      "unterminated directive at position 0",
+		"%h %":        "incomplete directive at position 3",
+		"%{days}T":    `unknown time unit "days" at position 0`,
+		"%{%Y %Q}t":   "unknown time format %Q at position 0",
+		"%{begin:%}t": `incomplete time format "%" at position 0`,
+	} {
+		err := format.Validate()
+		if err == nil || err.Error() != message {
+			t.Errorf("%q: %q expected, got: %v", format, message, err)
+		}
+	}
+}
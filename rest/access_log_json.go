@@ -2,19 +2,113 @@ package rest
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
 // AccessLogJsonMiddleware produces the access log with records written as JSON. This middleware
 // depends on TimerMiddleware and RecorderMiddleware that must be in the wrapped middlewares. It
-// also uses request.Env["REMOTE_USER"].(string) set by the auth middlewares.
+// also uses request.RemoteUser() set by the auth middlewares, request.RequestId() set by the
+// RequestIdMiddleware, and request.TraceId() set by the TracingMiddleware.
+//
+// By default the records are AccessLogJsonRecord objects. When Fields is set, the records are
+// JSON objects with only the selected fields, eg:
+//
+//	&rest.AccessLogJsonMiddleware{
+//		Fields: []string{"Timestamp", "StatusCode", "Path", "Route", "RequestHeader:X-Tenant"},
+//		KeyNames: map[string]string{
+//			"Timestamp":              "@timestamp",
+//			"RequestHeader:X-Tenant": "tenant",
+//		},
+//		RedactQueryParams: []string{"token"},
+//		SamplingRules: []rest.AccessLogSamplingRule{
+//			{MinStatusCode: 400, Rate: 1},
+//			{PathPrefix: "/health", Rate: 0.01},
+//		},
+//	}
 type AccessLogJsonMiddleware struct {
 
 	// Logger points to the logger object used by this middleware, it defaults to
 	// log.New(os.Stderr, "", 0).
 	Logger *log.Logger
+
+	// Fields of the records, in addition to the AccessLogJsonRecord field names, one of:
+	// RemoteAddr, BytesWritten, Referer, Protocol, Host, Path, Query, Route, or
+	// "RequestHeader:<Name>", "ResponseHeader:<Name>", "Env:<KEY>" for the request headers, the
+	// response headers, and the request.Env values. The empty values are omitted.
+	// Optional, defaults to the AccessLogJsonRecord fields. An unknown field is a fatal error.
+	Fields []string
+
+	// Keys of the fields in the records, by field name. Optional, defaults to the field names.
+	// Only used when Fields is set.
+	KeyNames map[string]string
+
+	// Names of the query string parameters whose values are replaced by "REDACTED", in the
+	// RequestURI and Query fields. Optional.
+	RedactQueryParams []string
+
+	// The first matching rule decides the proportion of the requests that are logged. The
+	// requests that match no rule are all logged. Optional.
+	SamplingRules []AccessLogSamplingRule
+
+	fields []accessLogJsonField
+}
+
+// AccessLogSamplingRule defines the proportion of the matching requests that are logged by
+// AccessLogJsonMiddleware. A request matches when it matches all the criteria that are set.
+type AccessLogSamplingRule struct {
+
+	// HTTP methods of the matching requests. Optional.
+	Methods []string
+
+	// Prefix of the URL path of the matching requests, eg: "/health". Optional.
+	PathPrefix string
+
+	// Lowest status code of the matching requests, eg: 500. Optional.
+	MinStatusCode int
+
+	// Highest status code of the matching requests, eg: 299. Optional.
+	MaxStatusCode int
+
+	// Proportion of the matching requests that are logged, between 0 and 1, eg: 0.01 for 1%.
+	Rate float64
+}
+
+func (rule *AccessLogSamplingRule) matches(r *Request) bool {
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, method := range rule.Methods {
+			if strings.EqualFold(method, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	statusCode, _ := r.StatusCode()
+	if rule.MinStatusCode != 0 && statusCode < rule.MinStatusCode {
+		return false
+	}
+	if rule.MaxStatusCode != 0 && statusCode > rule.MaxStatusCode {
+		return false
+	}
+	return true
+}
+
+type accessLogJsonField struct {
+	key   string
+	value func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{}
 }
 
 // MiddlewareFunc makes AccessLogJsonMiddleware implement the Middleware interface.
@@ -25,13 +119,210 @@ func (mw *AccessLogJsonMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 		mw.Logger = log.New(os.Stderr, "", 0)
 	}
 
+	mw.fields = []accessLogJsonField{}
+	for _, name := range mw.Fields {
+		value := makeAccessLogJsonFieldValue(name)
+		if value == nil {
+			log.Fatalf("AccessLogJsonMiddleware: unknown field %s", name)
+		}
+		key := name
+		if keyName, ok := mw.KeyNames[name]; ok {
+			key = keyName
+		}
+		mw.fields = append(mw.fields, accessLogJsonField{key, value})
+	}
+
 	return func(w ResponseWriter, r *Request) {
 
 		// call the handler
 		h(w, r)
 
-		mw.Logger.Printf("%s", makeAccessLogJsonRecord(r).asJson())
+		if !mw.sampled(r) {
+			return
+		}
+
+		util := &accessLogUtil{w, r}
+
+		if len(mw.fields) == 0 {
+			record := makeAccessLogJsonRecord(r)
+			record.RequestURI = mw.redactedRequestURI(r)
+			mw.Logger.Printf("%s", record.asJson())
+			return
+		}
+
+		record := map[string]interface{}{}
+		for _, field := range mw.fields {
+			value := field.value(util, mw)
+			if value == nil || value == "" {
+				continue
+			}
+			record[field.key] = value
+		}
+		mw.Logger.Printf("%s", marshalAccessLogJsonRecord(record))
+	}
+}
+
+func (mw *AccessLogJsonMiddleware) sampled(r *Request) bool {
+	for _, rule := range mw.SamplingRules {
+		if rule.matches(r) {
+			return rule.Rate >= 1 || rand.Float64() < rule.Rate
+		}
+	}
+	return true
+}
+
+// redactedQuery returns the raw query string, with the values of RedactQueryParams replaced.
+func (mw *AccessLogJsonMiddleware) redactedQuery(r *Request) string {
+	if len(mw.RedactQueryParams) == 0 || r.URL.RawQuery == "" {
+		return r.URL.RawQuery
+	}
+	pairs := strings.Split(r.URL.RawQuery, "&")
+	for i, pair := range pairs {
+		rawName := pair
+		if index := strings.IndexByte(pair, '='); index >= 0 {
+			rawName = pair[:index]
+		}
+		name := rawName
+		if unescaped, err := url.QueryUnescape(rawName); err == nil {
+			name = unescaped
+		}
+		for _, redacted := range mw.RedactQueryParams {
+			if strings.EqualFold(name, redacted) {
+				pairs[i] = rawName + "=REDACTED"
+				break
+			}
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (mw *AccessLogJsonMiddleware) redactedRequestURI(r *Request) string {
+	requestURI := r.URL.RequestURI()
+	if len(mw.RedactQueryParams) == 0 || r.URL.RawQuery == "" {
+		return requestURI
 	}
+	return strings.TrimSuffix(requestURI, "?"+r.URL.RawQuery) + "?" + mw.redactedQuery(r)
+}
+
+// marshalAccessLogJsonRecord returns the JSON record. The values that cannot be marshaled, like
+// some Env values, are replaced by their fmt.Sprint representation.
+func marshalAccessLogJsonRecord(record map[string]interface{}) []byte {
+	b, err := json.Marshal(record)
+	if err == nil {
+		return b
+	}
+	for key, value := range record {
+		if _, err := json.Marshal(value); err != nil {
+			record[key] = fmt.Sprint(value)
+		}
+	}
+	b, err = json.Marshal(record)
+	if err != nil {
+		return []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+	}
+	return b
+}
+
+// makeAccessLogJsonFieldValue returns the function computing the value of the field, nil if the
+// field is unknown.
+func makeAccessLogJsonFieldValue(name string) func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+
+	if header := strings.TrimPrefix(name, "RequestHeader:"); header != name {
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return strings.Join(u.R.Header[http.CanonicalHeaderKey(header)], ", ")
+		}
+	}
+	if header := strings.TrimPrefix(name, "ResponseHeader:"); header != name {
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return strings.Join(u.W.Header()[http.CanonicalHeaderKey(header)], ", ")
+		}
+	}
+	if key := strings.TrimPrefix(name, "Env:"); key != name {
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.R.Env[key]
+		}
+	}
+
+	switch name {
+	case "Timestamp":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			if startTime := u.StartTime(); startTime != nil {
+				return startTime
+			}
+			return nil
+		}
+	case "StatusCode":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.StatusCode()
+		}
+	case "ResponseTime":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			if responseTime := u.ResponseTime(); responseTime != nil {
+				return responseTime
+			}
+			return nil
+		}
+	case "HttpMethod":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.R.Method
+		}
+	case "RequestURI":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return mw.redactedRequestURI(u.R)
+		}
+	case "RemoteUser":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.RemoteUser()
+		}
+	case "UserAgent":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.R.UserAgent()
+		}
+	case "RequestId":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.RequestId()
+		}
+	case "TraceId":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.TraceId()
+		}
+	case "RemoteAddr":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.ApacheRemoteAddr()
+		}
+	case "BytesWritten":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.BytesWritten()
+		}
+	case "Referer":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.R.Referer()
+		}
+	case "Protocol":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.R.Proto
+		}
+	case "Host":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.R.Host
+		}
+	case "Path":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return u.R.URL.Path
+		}
+	case "Query":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			return mw.redactedQuery(u.R)
+		}
+	case "Route":
+		return func(u *accessLogUtil, mw *AccessLogJsonMiddleware) interface{} {
+			if route, ok := u.R.Route(); ok {
+				return route.PathExp
+			}
+			return nil
+		}
+	}
+	return nil
 }
 
 // AccessLogJsonRecord is the data structure used by AccessLogJsonMiddleware to create the JSON
@@ -44,29 +335,29 @@ type AccessLogJsonRecord struct {
 	RequestURI   string
 	RemoteUser   string
 	UserAgent    string
+	RequestId    string `json:",omitempty"`
+	TraceId      string `json:",omitempty"`
 }
 
 func makeAccessLogJsonRecord(r *Request) *AccessLogJsonRecord {
 
 	var timestamp *time.Time
-	if r.Env["START_TIME"] != nil {
-		timestamp = r.Env["START_TIME"].(*time.Time)
+	if startTime, ok := r.StartTime(); ok {
+		timestamp = &startTime
 	}
 
-	var statusCode int
-	if r.Env["STATUS_CODE"] != nil {
-		statusCode = r.Env["STATUS_CODE"].(int)
-	}
+	statusCode, _ := r.StatusCode()
 
 	var responseTime *time.Duration
-	if r.Env["ELAPSED_TIME"] != nil {
-		responseTime = r.Env["ELAPSED_TIME"].(*time.Duration)
+	if elapsedTime, ok := r.ElapsedTime(); ok {
+		responseTime = &elapsedTime
 	}
 
-	var remoteUser string
-	if r.Env["REMOTE_USER"] != nil {
-		remoteUser = r.Env["REMOTE_USER"].(string)
-	}
+	remoteUser, _ := r.RemoteUser()
+
+	requestId, _ := r.RequestId()
+
+	traceId, _ := r.TraceId()
 
 	return &AccessLogJsonRecord{
 		Timestamp:    timestamp,
@@ -76,6 +367,8 @@ func makeAccessLogJsonRecord(r *Request) *AccessLogJsonRecord {
 		RequestURI:   r.URL.RequestURI(),
 		RemoteUser:   remoteUser,
 		UserAgent:    r.UserAgent(),
+		RequestId:    requestId,
+		TraceId:      traceId,
 	}
 }
 
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"github.com/ant0ine/go-json-rest/rest/test"
 	"log"
+	"strings"
 	"testing"
 )
 
@@ -51,3 +52,123 @@ func TestAccessLogJsonMiddleware(t *testing.T) {
 		t.Errorf("HttpMethod GET expected, got %s", decoded.HttpMethod)
 	}
 }
+
+func TestAccessLogJsonMiddlewareFields(t *testing.T) {
+
+	api := NewApi()
+
+	buffer := bytes.NewBufferString("")
+	api.Use(&AccessLogJsonMiddleware{
+		Logger: log.New(buffer, "", 0),
+		Fields: []string{
+			"StatusCode",
+			"RequestURI",
+			"Query",
+			"Route",
+			"BytesWritten",
+			"RemoteAddr",
+			"Protocol",
+			"Host",
+			"Referer",
+			"RequestHeader:X-Tenant",
+			"ResponseHeader:Content-Type",
+			"Env:TENANT_PLAN",
+			"Env:CALLBACK",
+		},
+		KeyNames: map[string]string{
+			"StatusCode":             "status",
+			"RequestHeader:X-Tenant": "tenant",
+		},
+		RedactQueryParams: []string{"token"},
+	})
+	api.Use(&TimerMiddleware{})
+	api.Use(&RecorderMiddleware{})
+	router, err := MakeRouter(
+		Get("/users/:id", func(w ResponseWriter, r *Request) {
+			r.Env["TENANT_PLAN"] = "gold"
+			// cannot be marshaled
+			r.Env["CALLBACK"] = func() {}
+			w.WriteJson(map[string]string{"Id": r.PathParam("id")})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/users/123?page=2&token=s3cr3t", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Tenant", "acme")
+	test.RunRequest(t, api.MakeHandler(), req).CodeIs(200)
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"status":                      float64(200),
+		"RequestURI":                  "/users/123?page=2&token=REDACTED",
+		"Query":                       "page=2&token=REDACTED",
+		"Route":                       "/users/:id",
+		"BytesWritten":                float64(12),
+		"RemoteAddr":                  "127.0.0.1",
+		"Protocol":                    "HTTP/1.1",
+		"Host":                        "localhost",
+		"tenant":                      "acme",
+		"ResponseHeader:Content-Type": "application/json; charset=utf-8",
+		"Env:TENANT_PLAN":             "gold",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("%s: %v expected, got %v", key, value, record[key])
+		}
+	}
+	if callback, ok := record["Env:CALLBACK"].(string); !ok || callback == "" {
+		t.Errorf("Env:CALLBACK expected as a string, got %v", record["Env:CALLBACK"])
+	}
+	delete(record, "Env:CALLBACK")
+	if len(record) != len(expected) {
+		t.Errorf("The empty Referer expected to be omitted, got: %v", record)
+	}
+}
+
+func TestAccessLogJsonMiddlewareSampling(t *testing.T) {
+
+	api := NewApi()
+
+	buffer := bytes.NewBufferString("")
+	api.Use(&AccessLogJsonMiddleware{
+		Logger:            log.New(buffer, "", 0),
+		RedactQueryParams: []string{"token"},
+		SamplingRules: []AccessLogSamplingRule{
+			{MinStatusCode: 400, Rate: 1},
+			{PathPrefix: "/health", MaxStatusCode: 299, Rate: 0},
+		},
+	})
+	api.Use(&TimerMiddleware{})
+	api.Use(&RecorderMiddleware{})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		if r.URL.Query().Get("fail") != "" {
+			Error(w, "failed", 500)
+			return
+		}
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/health", nil))
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/health?fail=1&token=abc", nil))
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/users", nil))
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("2 records expected, got: %s", buffer.String())
+	}
+	decoded := &AccessLogJsonRecord{}
+	if err := json.Unmarshal([]byte(lines[0]), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.StatusCode != 500 || decoded.RequestURI != "/health?fail=1&token=REDACTED" {
+		t.Errorf("Unexpected record: %+v", decoded)
+	}
+}
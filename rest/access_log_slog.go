@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// AccessLogSlogMiddleware produces the access log as log/slog records, with the method, path,
+// route, status, latency, bytes, user, request_id and trace_id attributes. The level of the records
+// is slog.LevelError for the 5xx responses, slog.LevelWarn for the 4xx, and slog.LevelInfo
+// otherwise. This middleware depends on RecorderMiddleware that should be in the wrapped
+// middlewares, the latency is read from request.ElapsedTime() when set by the TimerMiddleware.
+//
+// It also sets the request-scoped logger returned by request.Logger(), with the same handler, and
+// the method and path attributes.
+type AccessLogSlogMiddleware struct {
+
+	// Handler receiving the records. Optional, defaults to slog.Default().Handler().
+	Handler slog.Handler
+
+	// Message of the access log records. Optional, defaults to "request".
+	Message string
+}
+
+// MiddlewareFunc makes AccessLogSlogMiddleware implement the Middleware interface.
+func (mw *AccessLogSlogMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
+
+	if mw.Handler == nil {
+		mw.Handler = slog.Default().Handler()
+	}
+	if mw.Message == "" {
+		mw.Message = "request"
+	}
+	logger := slog.New(mw.Handler)
+
+	return func(w ResponseWriter, r *Request) {
+
+		start := time.Now()
+
+		r.SetLogger(logger.With(
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+		))
+
+		// call the handler
+		h(w, r)
+
+		latency, ok := r.ElapsedTime()
+		if !ok {
+			latency = time.Since(start)
+		}
+		statusCode, _ := r.StatusCode()
+		bytesWritten, _ := r.BytesWritten()
+
+		level := slog.LevelInfo
+		if statusCode >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if statusCode >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+		}
+		if route, ok := r.Route(); ok {
+			attrs = append(attrs, slog.String("route", route.PathExp))
+		}
+		attrs = append(attrs,
+			slog.Int("status", statusCode),
+			slog.Duration("latency", latency),
+			slog.Int64("bytes", bytesWritten),
+		)
+		if remoteUser, ok := r.RemoteUser(); ok && remoteUser != "" {
+			attrs = append(attrs, slog.String("user", remoteUser))
+		}
+		if requestId, ok := r.RequestId(); ok && requestId != "" {
+			attrs = append(attrs, slog.String("request_id", requestId))
+		}
+		if traceId, ok := r.TraceId(); ok && traceId != "" {
+			attrs = append(attrs, slog.String("trace_id", traceId))
+		}
+
+		logger.LogAttrs(r.Context(), level, mw.Message, attrs...)
+	}
+}
@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogSlogMiddleware(t *testing.T) {
+
+	buffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&AccessLogSlogMiddleware{
+		Handler: slog.NewJSONHandler(buffer, nil),
+	})
+	api.Use(&TimerMiddleware{})
+	api.Use(&RecorderMiddleware{})
+	api.Use(&RequestIdMiddleware{})
+	router, err := MakeRouter(
+		Get("/users/:id", func(w ResponseWriter, r *Request) {
+			r.Logger().Info("loading", "id", r.PathParam("id"))
+			w.WriteJson(map[string]string{"Id": r.PathParam("id")})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/users/123", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	test.RunRequest(t, handler, req).CodeIs(200)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/unknown", nil)).CodeIs(404)
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("3 records expected, got %d: %s", len(lines), buffer.String())
+	}
+
+	// the request-scoped logger
+	record := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]interface{}{
+		"msg":        "loading",
+		"id":         "123",
+		"method":     "GET",
+		"path":       "/users/123",
+		"route":      "/users/:id",
+		"request_id": "abc",
+	} {
+		if record[key] != expected {
+			t.Errorf("%s: %v expected, got %v", key, expected, record[key])
+		}
+	}
+
+	// the access log
+	record = map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]interface{}{
+		"level":      "INFO",
+		"msg":        "request",
+		"method":     "GET",
+		"route":      "/users/:id",
+		"status":     float64(200),
+		"bytes":      float64(12),
+		"request_id": "abc",
+	} {
+		if record[key] != expected {
+			t.Errorf("%s: %v expected, got %v", key, expected, record[key])
+		}
+	}
+	if _, ok := record["latency"]; !ok {
+		t.Error("latency expected")
+	}
+
+	record = map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[2]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "WARN" || record["status"] != float64(404) || record["route"] != nil {
+		t.Errorf("Unexpected record: %v", record)
+	}
+}
@@ -8,13 +8,16 @@ import (
 type Api struct {
 	stack []Middleware
 	app   App
+	codec JsonCodec
 }
 
-// NewApi makes a new Api object. The Middleware stack is empty, and the App is nil.
+// NewApi makes a new Api object. The Middleware stack is empty, the App is nil, and the JsonCodec
+// is the default StdJsonCodec.
 func NewApi() *Api {
 	return &Api{
 		stack: []Middleware{},
 		app:   nil,
+		codec: nil,
 	}
 }
 
@@ -29,6 +32,12 @@ func (api *Api) SetApp(app App) {
 	api.app = app
 }
 
+// SetJsonCodec sets the JsonCodec used to encode the responses and decode the request payloads.
+// eg: api.SetJsonCodec(&rest.StdJsonCodec{DisableHTMLEscape: true})
+func (api *Api) SetJsonCodec(codec JsonCodec) {
+	api.codec = codec
+}
+
 // MakeHandler wraps all the Middlewares of the stack and the App together, and returns an
 // http.Handler ready to be used. If the Middleware stack is empty the App is used directly. If the
 // App is nil, a HandlerFunc that does nothing is used instead.
@@ -39,9 +48,14 @@ func (api *Api) MakeHandler() http.Handler {
 	} else {
 		appFunc = func(w ResponseWriter, r *Request) {}
 	}
+	codec := api.codec
+	if codec == nil {
+		codec = defaultJsonCodec
+	}
 	return http.HandlerFunc(
 		adapterFunc(
 			WrapMiddlewares(api.stack, appFunc),
+			codec,
 		),
 	)
 }
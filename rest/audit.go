@@ -0,0 +1,357 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes a request that changed the state of the service, as recorded by the
+// AuditMiddleware.
+type AuditRecord struct {
+	Timestamp  time.Time
+	RemoteUser string
+	HttpMethod string
+	RequestURI string
+
+	// PathExp of the matched Route, empty if no Route matched.
+	Route string `json:",omitempty"`
+
+	PathParams map[string]string `json:",omitempty"`
+	RequestId  string            `json:",omitempty"`
+
+	// SHA-256 of the request body, as in "sha256:<hex>".
+	BodyDigest string `json:",omitempty"`
+
+	// True if the body could not be read entirely, the BodyDigest is then omitted.
+	BodyIncomplete bool `json:",omitempty"`
+
+	// The JSON request body, with the RedactFields replaced, when IncludeBody is set.
+	Body json.RawMessage `json:",omitempty"`
+
+	StatusCode int
+
+	// Hash of the previous record, and of this record, set by the hash-chained sinks.
+	PreviousHash string `json:",omitempty"`
+	Hash         string `json:",omitempty"`
+}
+
+// AuditSink defines the interface that objects must implement in order to store the records of
+// the AuditMiddleware.
+type AuditSink interface {
+
+	// WriteAudit is called once the response is written.
+	WriteAudit(record *AuditRecord) error
+}
+
+// AuditMiddleware records an audit trail of the requests that change the state of the service:
+// who, what, when and with which result. The user is request.RemoteUser(), set by the auth
+// middlewares that should wrap this middleware. The digest of the request body is computed while
+// the body is read by the wrapped handlers, the part they don't read is read afterwards, up to
+// MaxBodySize. The records are written to the Sink, eg: a JsonLinesAuditSink.
+type AuditMiddleware struct {
+
+	// Receives the records. Required.
+	Sink AuditSink
+
+	// HTTP methods of the requests that are not audited.
+	// Optional, defaults to GET, HEAD and OPTIONS.
+	SkipMethods []string
+
+	// If true, the JSON request bodies are included in the records, with the RedactFields
+	// replaced. Optional, defaults to false, only the digest is recorded.
+	IncludeBody bool
+
+	// Paths of the JSON fields to redact from the included bodies, eg: "password", "card.number".
+	// See BodyCaptureMiddleware.RedactFields. Optional.
+	RedactFields []string
+
+	// Maximum size of the bodies included in the records, and of the part of the body read after
+	// the handler to complete the digest. Optional, defaults to 10MB.
+	MaxBodySize int64
+
+	// If true, the requests with a body larger than MaxBodySize are rejected with a
+	// StatusRequestEntityTooLarge (413), the bodies are then read before calling the handler.
+	// Optional, defaults to false, the larger bodies are streamed to the handler.
+	RejectLargeBodies bool
+
+	// Logger used to report the Sink errors. Optional, defaults to log.New(os.Stderr, "", 0).
+	Logger *log.Logger
+
+	redactPaths [][]string
+}
+
+// MiddlewareFunc makes AuditMiddleware implement the Middleware interface.
+func (mw *AuditMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
+
+	if mw.Sink == nil {
+		log.Fatal("Sink is required")
+	}
+	if mw.SkipMethods == nil {
+		mw.SkipMethods = []string{"GET", "HEAD", "OPTIONS"}
+	}
+	if mw.MaxBodySize <= 0 {
+		mw.MaxBodySize = 10 * 1024 * 1024
+	}
+	if mw.Logger == nil {
+		mw.Logger = log.New(os.Stderr, "", 0)
+	}
+	mw.redactPaths = [][]string{}
+	for _, field := range mw.RedactFields {
+		mw.redactPaths = append(mw.redactPaths, strings.Split(field, "."))
+	}
+
+	return func(w ResponseWriter, r *Request) {
+
+		for _, method := range mw.SkipMethods {
+			if strings.EqualFold(method, r.Method) {
+				h(w, r)
+				return
+			}
+		}
+
+		record := &AuditRecord{
+			Timestamp:  time.Now().UTC(),
+			HttpMethod: r.Method,
+			RequestURI: r.URL.RequestURI(),
+		}
+
+		var bodyReader io.Reader
+		var bodyEof *auditEofReader
+		var bodyWriter *auditBodyWriter
+		if r.Body != nil {
+			body := io.Reader(r.Body)
+			if mw.RejectLargeBodies {
+				buffered, err := ioutil.ReadAll(io.LimitReader(r.Body, mw.MaxBodySize+1))
+				if err != nil {
+					Error(w, "Cannot read the request body", http.StatusBadRequest)
+					return
+				}
+				if int64(len(buffered)) > mw.MaxBodySize {
+					Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				body = bytes.NewReader(buffered)
+			}
+			bodyWriter = &auditBodyWriter{hash: sha256.New()}
+			if mw.IncludeBody {
+				bodyWriter.copy = &bodyCopyWriter{limit: int(mw.MaxBodySize)}
+			}
+			bodyEof = &auditEofReader{Reader: body}
+			bodyReader = io.TeeReader(bodyEof, bodyWriter)
+			r.Body = &bodyCaptureReadCloser{
+				Reader: bodyReader,
+				Closer: r.Body,
+			}
+		}
+
+		writer := &recorderResponseWriter{ResponseWriter: w}
+
+		// call the handler
+		h(writer, r)
+
+		if bodyWriter != nil {
+			// complete the digest with the part of the body not read by the handler
+			read := int64(0)
+			var err error
+			if !bodyEof.eof {
+				read, err = io.Copy(ioutil.Discard, io.LimitReader(bodyReader, mw.MaxBodySize+1))
+			}
+			if err != nil || read > mw.MaxBodySize {
+				record.BodyIncomplete = true
+			} else if bodyWriter.size > 0 {
+				record.BodyDigest = "sha256:" + hex.EncodeToString(bodyWriter.hash.Sum(nil))
+				if bodyWriter.copy != nil && !bodyWriter.copy.truncated {
+					record.Body = mw.redactedBody(r.Header.Get("Content-Type"), bodyWriter.copy.buffer.Bytes())
+				}
+			}
+		}
+
+		record.StatusCode = writer.statusCode
+		record.RemoteUser, _ = r.RemoteUser()
+		record.RequestId, _ = r.RequestId()
+		if route, ok := r.Route(); ok {
+			record.Route = route.PathExp
+		}
+		if len(r.PathParams) > 0 {
+			record.PathParams = map[string]string{}
+			for name, value := range r.PathParams {
+				record.PathParams[name] = value
+			}
+		}
+
+		if err := mw.Sink.WriteAudit(record); err != nil {
+			mw.Logger.Printf("AuditMiddleware: cannot write the audit record: %s", err)
+		}
+	}
+}
+
+// Records whether the end of the request body has been reached.
+type auditEofReader struct {
+	io.Reader
+	eof bool
+}
+
+func (r *auditEofReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Computes the digest of the request body, and keeps a copy of it when IncludeBody is set.
+type auditBodyWriter struct {
+	hash hash.Hash
+	size int64
+	copy *bodyCopyWriter
+}
+
+func (w *auditBodyWriter) Write(b []byte) (int, error) {
+	w.hash.Write(b)
+	w.size += int64(len(b))
+	if w.copy != nil {
+		w.copy.Write(b)
+	}
+	return len(b), nil
+}
+
+// redactedBody returns the JSON body with the RedactFields replaced, nil if the body is not JSON.
+func (mw *AuditMiddleware) redactedBody(contentType string, body []byte) json.RawMessage {
+	if !isJsonMediaType(contentType) {
+		return nil
+	}
+	redacted, err := redactJson(body, mw.redactPaths)
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+// JsonLinesAuditSink is an AuditSink that appends each record as a line of JSON to a file. The
+// records are hash-chained: each record includes the hash of the previous one, and its own hash,
+// computed on the record without the Hash field. A modification or a removal of a record breaks
+// the chain, see VerifyJsonLinesAudit. It is safe for concurrent use.
+type JsonLinesAuditSink struct {
+	lock     sync.Mutex
+	file     *os.File
+	lastHash string
+}
+
+// NewJsonLinesAuditSink opens, or creates, the file at path, and continues the chain of its
+// existing records.
+func NewJsonLinesAuditSink(path string) (*JsonLinesAuditSink, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	lastHash := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid audit record in %s: %s", path, err)
+		}
+		lastHash = record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &JsonLinesAuditSink{file: file, lastHash: lastHash}, nil
+}
+
+// WriteAudit makes JsonLinesAuditSink implement the AuditSink interface.
+func (s *JsonLinesAuditSink) WriteAudit(record *AuditRecord) error {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	record.PreviousHash = s.lastHash
+	hash, err := auditRecordHash(record)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.lastHash = hash
+	return nil
+}
+
+// Close closes the file.
+func (s *JsonLinesAuditSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.file.Close()
+}
+
+// VerifyJsonLinesAudit reads the records written by a JsonLinesAuditSink, and returns an error
+// describing the first record that breaks the hash chain.
+func VerifyJsonLinesAudit(reader io.Reader) error {
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	previousHash := ""
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		record := &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return fmt.Errorf("line %d: invalid audit record: %s", line, err)
+		}
+		if record.PreviousHash != previousHash {
+			return fmt.Errorf("line %d: the chain is broken, a previous record is missing or modified", line)
+		}
+		hash, err := auditRecordHash(record)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if hash != record.Hash {
+			return fmt.Errorf("line %d: the record is modified", line)
+		}
+		previousHash = record.Hash
+	}
+	return scanner.Err()
+}
+
+// auditRecordHash returns the SHA-256 of the JSON record, without its Hash field.
+func auditRecordHash(record *AuditRecord) (string, error) {
+	unhashed := *record
+	unhashed.Hash = ""
+	b, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
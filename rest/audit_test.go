@@ -0,0 +1,214 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditMiddleware(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	sink, err := NewJsonLinesAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeHandler := func(sink AuditSink) http.Handler {
+		api := NewApi()
+		api.Use(&AuthBasicMiddleware{
+			Realm: "test zone",
+			Authenticator: func(userId string, password string) bool {
+				return userId == "admin" && password == "admin"
+			},
+		})
+		api.Use(&AuditMiddleware{
+			Sink:         sink,
+			IncludeBody:  true,
+			RedactFields: []string{"password"},
+		})
+		router, err := MakeRouter(
+			Get("/users/:id", func(w ResponseWriter, r *Request) {
+				w.WriteJson(map[string]string{"Id": r.PathParam("id")})
+			}),
+			Put("/users/:id", func(w ResponseWriter, r *Request) {
+				payload := map[string]string{}
+				if err := r.DecodeJsonPayload(&payload); err != nil {
+					Error(w, err.Error(), 400)
+					return
+				}
+				w.WriteJson(map[string]string{"Id": r.PathParam("id"), "Name": payload["Name"]})
+			}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.SetApp(router)
+		return api.MakeHandler()
+	}
+	handler := makeHandler(sink)
+
+	for _, req := range []*http.Request{
+		test.MakeSimpleRequest("GET", "http://localhost/users/1", nil),
+		test.MakeSimpleRequest("PUT", "http://localhost/users/1", map[string]string{"Name": "Antoine", "password": "s3cr3t"}),
+		test.MakeSimpleRequest("PUT", "http://localhost/users/2", map[string]string{"Name": "Bob"}),
+	} {
+		req.SetBasicAuth("admin", "admin")
+		test.RunRequest(t, handler, req).CodeIs(200)
+	}
+	sink.Close()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("2 records expected, got: %s", content)
+	}
+
+	record := &AuditRecord{}
+	if err := json.Unmarshal([]byte(lines[0]), record); err != nil {
+		t.Fatal(err)
+	}
+	if record.RemoteUser != "admin" || record.HttpMethod != "PUT" || record.Route != "/users/:id" ||
+		record.PathParams["id"] != "1" || record.StatusCode != 200 {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+	if string(record.Body) != `{"Name":"Antoine","password":"REDACTED"}` {
+		t.Errorf("Unexpected body: %s", record.Body)
+	}
+	if !strings.HasPrefix(record.BodyDigest, "sha256:") || record.PreviousHash != "" || record.Hash == "" {
+		t.Errorf("Unexpected digest or hashes: %+v", record)
+	}
+
+	if err := VerifyJsonLinesAudit(bytes.NewReader(content)); err != nil {
+		t.Errorf("Valid chain expected, got: %s", err)
+	}
+
+	// the chain continues after a reopening
+	sink, err = NewJsonLinesAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := test.MakeSimpleRequest("DELETE", "http://localhost/users/2", nil)
+	req.SetBasicAuth("admin", "admin")
+	test.RunRequest(t, makeHandler(sink), req).CodeIs(405)
+	sink.Close()
+
+	content, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyJsonLinesAudit(bytes.NewReader(content)); err != nil {
+		t.Errorf("Valid chain expected, got: %s", err)
+	}
+
+	// tampering
+	tampered := strings.Replace(string(content), `"Name":"Antoine"`, `"Name":"Mallory"`, 1)
+	if err := VerifyJsonLinesAudit(strings.NewReader(tampered)); err == nil || err.Error() != "line 1: the record is modified" {
+		t.Errorf("Modified record expected, got: %v", err)
+	}
+	removed := strings.Join(strings.Split(string(content), "\n")[1:], "\n")
+	if err := VerifyJsonLinesAudit(strings.NewReader(removed)); err == nil || !strings.Contains(err.Error(), "chain is broken") {
+		t.Errorf("Broken chain expected, got: %v", err)
+	}
+}
+
+type testAuditSink struct {
+	records []*AuditRecord
+}
+
+func (s *testAuditSink) WriteAudit(record *AuditRecord) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestAuditMiddlewareLargeBodies(t *testing.T) {
+
+	sink := &testAuditSink{}
+	audit := &AuditMiddleware{
+		Sink:        sink,
+		IncludeBody: true,
+		MaxBodySize: 8,
+	}
+
+	api := NewApi()
+	api.Use(audit)
+	router, err := MakeRouter(
+		Post("/upload", func(w ResponseWriter, r *Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			w.WriteJson(map[string]int{"Size": len(b)})
+		}),
+		Post("/ignore", func(w ResponseWriter, r *Request) {
+			r.Body.Close()
+			w.WriteJson(map[string]string{"Status": "ok"})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	digest := func(body string) string {
+		hash := sha256.Sum256([]byte(body))
+		return "sha256:" + hex.EncodeToString(hash[:])
+	}
+	post := func(path, body string) *test.Recorded {
+		req := test.MakeSimpleRequest("POST", "http://localhost"+path, nil)
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return test.RunRequest(t, handler, req)
+	}
+
+	// streamed to the handler, not included
+	post("/upload", `{"Name":"Antoine"}`).BodyIs(`{"Size":18}`)
+	record := sink.records[0]
+	if record.BodyDigest != digest(`{"Name":"Antoine"}`) || record.Body != nil || record.BodyIncomplete {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	// small enough to be included
+	post("/upload", `{"A":1}`).CodeIs(200)
+	record = sink.records[1]
+	if record.BodyDigest != digest(`{"A":1}`) || string(record.Body) != `{"A":1}` {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	// not read by the handler, the digest is completed
+	post("/ignore", `{"A":1}`).CodeIs(200)
+	record = sink.records[2]
+	if record.BodyDigest != digest(`{"A":1}`) || record.BodyIncomplete {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	// not read by the handler, and too large to be completed
+	post("/ignore", `{"Name":"Antoine"}`).CodeIs(200)
+	record = sink.records[3]
+	if record.BodyDigest != "" || !record.BodyIncomplete {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+
+	// rejected
+	audit.RejectLargeBodies = true
+	post("/upload", `{"Name":"Antoine"}`).CodeIs(413)
+	post("/upload", `{"A":1}`).CodeIs(200)
+	if len(sink.records) != 5 {
+		t.Errorf("5 records expected, got %d", len(sink.records))
+	}
+}
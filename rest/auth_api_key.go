@@ -0,0 +1,182 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ApiKey describes an API key as stored in an ApiKeyStore. Only the hash of the key is stored.
+type ApiKey struct {
+
+	// Hash of the key, as returned by HashApiKey.
+	Hash string
+
+	// Id of the user owning the key, made available as request.RemoteUser().
+	UserId string
+
+	// Scopes granted to the key, see RequireScopes.
+	Scopes []string
+
+	// Expiration time of the key. The zero value means that the key does not expire.
+	ExpiresAt time.Time
+}
+
+// ApiKeyStore defines the interface that objects must implement in order to provide the API keys
+// to the ApiKeyMiddleware.
+type ApiKeyStore interface {
+
+	// Lookup returns the ApiKey for the hash of the key, or nil if the key is unknown.
+	Lookup(hash string) (*ApiKey, error)
+}
+
+// HashApiKey returns the hex encoded SHA-256 of the key, as stored in ApiKey.Hash.
+func HashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// InMemoryApiKeyStore is an ApiKeyStore implementation that keeps the keys in memory.
+// It is safe for concurrent use.
+type InMemoryApiKeyStore struct {
+	lock sync.RWMutex
+	keys map[string]*ApiKey
+}
+
+// NewInMemoryApiKeyStore returns an empty InMemoryApiKeyStore.
+func NewInMemoryApiKeyStore() *InMemoryApiKeyStore {
+	return &InMemoryApiKeyStore{
+		keys: map[string]*ApiKey{},
+	}
+}
+
+// Add stores the ApiKey, apiKey.Hash must be set.
+func (s *InMemoryApiKeyStore) Add(apiKey *ApiKey) {
+	s.lock.Lock()
+	s.keys[apiKey.Hash] = apiKey
+	s.lock.Unlock()
+}
+
+// Remove deletes the ApiKey with the given hash.
+func (s *InMemoryApiKeyStore) Remove(hash string) {
+	s.lock.Lock()
+	delete(s.keys, hash)
+	s.lock.Unlock()
+}
+
+// Lookup makes InMemoryApiKeyStore implement the ApiKeyStore interface.
+func (s *InMemoryApiKeyStore) Lookup(hash string) (*ApiKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.keys[hash], nil
+}
+
+// ApiKeyMiddleware provides an API key authentication. The key is read from a request header, or
+// from a query string parameter, and looked up by hash in the Store. On failure, a 401 HTTP
+// response is returned. On success, the wrapped middleware is called, the userId is made
+// available as request.RemoteUser(), and the scopes of the key as request.ApiKeyScopes(). See
+// RequireScopes to check them per route.
+type ApiKeyMiddleware struct {
+
+	// Store of the API keys. Required.
+	Store ApiKeyStore
+
+	// Name of the request header containing the key. Optional, defaults to "X-Api-Key".
+	HeaderName string
+
+	// Name of the query string parameter containing the key, used when the header is missing.
+	// The parameter is removed from the request URL, so the key does not end up in the access
+	// logs. Optional, the query string is not used by default.
+	QueryParam string
+
+	// Callback function that should perform the authorization of the authenticated user. Called
+	// only after an authentication success. Must return true on success, false on failure.
+	// Optional, default to success.
+	Authorizator func(userId string, request *Request) bool
+}
+
+// MiddlewareFunc makes ApiKeyMiddleware implement the Middleware interface.
+func (mw *ApiKeyMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.Store == nil {
+		log.Fatal("Store is required")
+	}
+
+	if mw.HeaderName == "" {
+		mw.HeaderName = "X-Api-Key"
+	}
+
+	if mw.Authorizator == nil {
+		mw.Authorizator = func(userId string, request *Request) bool {
+			return true
+		}
+	}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		key := request.Header.Get(mw.HeaderName)
+		if key == "" && mw.QueryParam != "" {
+			query := request.URL.Query()
+			key = query.Get(mw.QueryParam)
+			if key != "" {
+				query.Del(mw.QueryParam)
+				request.URL.RawQuery = query.Encode()
+			}
+		}
+		if key == "" {
+			Error(writer, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+
+		apiKey, err := mw.Store.Lookup(HashApiKey(key))
+		if err != nil {
+			Error(writer, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if apiKey == nil {
+			Error(writer, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		if !apiKey.ExpiresAt.IsZero() && !time.Now().Before(apiKey.ExpiresAt) {
+			Error(writer, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !mw.Authorizator(apiKey.UserId, request) {
+			Error(writer, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+
+		request.SetRemoteUser(apiKey.UserId)
+		request.SetApiKeyScopes(apiKey.Scopes)
+
+		handler(writer, request)
+	}
+}
+
+// RequireScopes wraps the HandlerFunc of a Route, and returns a StatusForbidden (403) HTTP error
+// response if the API key does not have all the scopes. It depends on request.ApiKeyScopes() set
+// by ApiKeyMiddleware.
+// eg: rest.Delete("/users/:id", rest.RequireScopes(DeleteUser, "users:write"))
+func RequireScopes(handler HandlerFunc, scopes ...string) HandlerFunc {
+	return func(writer ResponseWriter, request *Request) {
+
+		granted := map[string]bool{}
+		apiKeyScopes, _ := request.ApiKeyScopes()
+		for _, scope := range apiKeyScopes {
+			granted[scope] = true
+		}
+
+		for _, scope := range scopes {
+			if !granted[scope] {
+				Error(writer, "Insufficient scope", http.StatusForbidden)
+				return
+			}
+		}
+
+		handler(writer, request)
+	}
+}
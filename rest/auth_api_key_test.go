@@ -0,0 +1,115 @@
+package rest
+
+import (
+	"bytes"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiKeyMiddleware(t *testing.T) {
+
+	store := NewInMemoryApiKeyStore()
+	store.Add(&ApiKey{
+		Hash:   HashApiKey("reader-key"),
+		UserId: "reader",
+		Scopes: []string{"users:read"},
+	})
+	store.Add(&ApiKey{
+		Hash:   HashApiKey("admin-key"),
+		UserId: "admin",
+		Scopes: []string{"users:read", "users:write"},
+	})
+	store.Add(&ApiKey{
+		Hash:      HashApiKey("expired-key"),
+		UserId:    "old",
+		Scopes:    []string{"users:read"},
+		ExpiresAt: time.Now().Add(-time.Hour),
+	})
+
+	buffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&AccessLogApacheMiddleware{
+		Logger: log.New(buffer, "", 0),
+		Format: "%u %r",
+	})
+	api.Use(&ApiKeyMiddleware{
+		Store:      store,
+		QueryParam: "api_key",
+	})
+	router, err := MakeRouter(
+		Get("/users", RequireScopes(func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]interface{}{"User": r.Env["REMOTE_USER"]})
+		}, "users:read")),
+		Delete("/users/:id", RequireScopes(func(w ResponseWriter, r *Request) {
+			w.WriteHeader(204)
+		}, "users:read", "users:write")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	// no key
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/users", nil))
+	recorded.CodeIs(401)
+
+	// unknown key
+	req := test.MakeSimpleRequest("GET", "http://localhost/users", nil)
+	req.Header.Set("X-Api-Key", "unknown")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	// expired key
+	req = test.MakeSimpleRequest("GET", "http://localhost/users", nil)
+	req.Header.Set("X-Api-Key", "expired-key")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	// valid key in the header
+	req = test.MakeSimpleRequest("GET", "http://localhost/users", nil)
+	req.Header.Set("X-Api-Key", "reader-key")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"User":"reader"}`)
+
+	// missing scope
+	req = test.MakeSimpleRequest("DELETE", "http://localhost/users/1", nil)
+	req.Header.Set("X-Api-Key", "reader-key")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(403)
+
+	// valid key in the query string, not logged
+	buffer.Reset()
+	req = test.MakeSimpleRequest("DELETE", "http://localhost/users/1?api_key=admin-key&a=b", nil)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(204)
+	if strings.Contains(buffer.String(), "admin-key") {
+		t.Errorf("The key is not expected in the access log: %s", buffer.String())
+	}
+	if !strings.HasPrefix(buffer.String(), "admin DELETE /users/1?a=b") {
+		t.Errorf("Unexpected access log: %s", buffer.String())
+	}
+}
+
+func TestRequireScopesWithoutApiKey(t *testing.T) {
+
+	api := NewApi()
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			// not set by the ApiKeyMiddleware
+			r.Env["API_KEY_SCOPES"] = "users:read"
+			handler(w, r)
+		}
+	}))
+	api.SetApp(AppSimple(RequireScopes(func(w ResponseWriter, r *Request) {
+		w.WriteHeader(204)
+	}, "users:read")))
+
+	recorded := test.RunRequest(t, api.MakeHandler(), test.MakeSimpleRequest("GET", "http://localhost/users", nil))
+	recorded.CodeIs(403)
+}
@@ -10,7 +10,7 @@ import (
 
 // AuthBasicMiddleware provides a simple AuthBasic implementation. On failure, a 401 HTTP response
 //is returned. On success, the wrapped middleware is called, and the userId is made available as
-// request.Env["REMOTE_USER"].(string)
+// request.RemoteUser()
 type AuthBasicMiddleware struct {
 
 	// Realm name to display to the user. Required.
@@ -68,7 +68,7 @@ func (mw *AuthBasicMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
 			return
 		}
 
-		request.Env["REMOTE_USER"] = providedUserId
+		request.SetRemoteUser(providedUserId)
 
 		handler(writer, request)
 	}
@@ -0,0 +1,367 @@
+package rest
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DigestHA1 returns the hex encoded HA1 of the user, as expected from AuthDigestMiddleware.Lookup.
+// algorithm is "MD5" or "SHA-256". Storing the HA1 instead of the password is recommended.
+func DigestHA1(algorithm, userId, realm, password string) string {
+	return digestHash(algorithm, userId+":"+realm+":"+password)
+}
+
+// AuthDigestMiddleware provides an HTTP Digest authentication, as described in RFC 7616, with the
+// MD5 and SHA-256 algorithms (and their -sess variants) and the "auth" qop. The nonces are
+// stateless and expire after NonceTimeout, an authentic request with an expired nonce gets a new
+// challenge with the stale=true flag. The nonce counts are tracked to reject the replayed
+// requests, the concurrent requests can use them out of order within a window of 64 counts. On
+// failure, a 401 HTTP response is returned. On success, the wrapped middleware is
+// called, and the userId is made available as request.RemoteUser()
+type AuthDigestMiddleware struct {
+
+	// Realm name to display to the user. Required.
+	Realm string
+
+	// Callback function that returns the hex encoded HA1 (see DigestHA1) of the user for the
+	// realm and the algorithm ("MD5" or "SHA-256"). Must return an empty string if the user is
+	// unknown. Required.
+	Lookup func(userId string, realm string, algorithm string) string
+
+	// Callback function that should perform the authorization of the authenticated user. Called
+	// only after an authentication success. Must return true on success, false on failure.
+	// Optional, default to success.
+	Authorizator func(userId string, request *Request) bool
+
+	// Algorithms offered in the challenges, by order of preference. Supported values are "MD5",
+	// "MD5-sess", "SHA-256" and "SHA-256-sess". Optional, defaults to ["SHA-256", "MD5"].
+	Algorithms []string
+
+	// Duration of validity of the nonces. Optional, defaults to 5 minutes.
+	NonceTimeout time.Duration
+
+	nonceKey []byte
+	opaque   string
+
+	lock      sync.Mutex
+	counts    map[string]*digestNonceCounts
+	lastSweep time.Time
+}
+
+// The nonce counts used with a nonce: the highest one, and a bitmap of the 64 counts up to it.
+type digestNonceCounts struct {
+	highest uint64
+	seen    uint64
+}
+
+// MiddlewareFunc makes AuthDigestMiddleware implement the Middleware interface.
+func (mw *AuthDigestMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.Realm == "" {
+		log.Fatal("Realm is required")
+	}
+
+	if mw.Lookup == nil {
+		log.Fatal("Lookup is required")
+	}
+
+	if mw.Authorizator == nil {
+		mw.Authorizator = func(userId string, request *Request) bool {
+			return true
+		}
+	}
+
+	if len(mw.Algorithms) == 0 {
+		mw.Algorithms = []string{"SHA-256", "MD5"}
+	}
+	for _, algorithm := range mw.Algorithms {
+		if digestHashFunc(algorithm) == nil {
+			log.Fatalf("Unsupported digest algorithm: %s", algorithm)
+		}
+	}
+
+	if mw.NonceTimeout <= 0 {
+		mw.NonceTimeout = 5 * time.Minute
+	}
+
+	mw.nonceKey = digestRandom(32)
+	mw.opaque = hex.EncodeToString(digestRandom(16))
+	mw.counts = map[string]*digestNonceCounts{}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		authHeader := request.Header.Get("Authorization")
+		if authHeader == "" {
+			mw.unauthorized(writer, false)
+			return
+		}
+
+		params, err := parseDigestAuthHeader(authHeader)
+		if err != nil {
+			Error(writer, "Invalid authentication", http.StatusBadRequest)
+			return
+		}
+
+		algorithm := params["algorithm"]
+		if algorithm == "" {
+			algorithm = "MD5"
+		}
+		// the configured spelling, the algorithm names are case insensitive
+		algorithm, ok := mw.offeredAlgorithm(algorithm)
+		if !ok {
+			mw.unauthorized(writer, false)
+			return
+		}
+
+		userId := params["username"]
+		if params["realm"] != mw.Realm ||
+			params["opaque"] != mw.opaque ||
+			params["qop"] != "auth" ||
+			params["uri"] != request.URL.RequestURI() ||
+			userId == "" {
+			mw.unauthorized(writer, false)
+			return
+		}
+
+		nc, err := strconv.ParseUint(params["nc"], 16, 64)
+		if err != nil || params["cnonce"] == "" {
+			Error(writer, "Invalid authentication", http.StatusBadRequest)
+			return
+		}
+
+		baseAlgorithm := digestBaseAlgorithm(algorithm)
+		ha1 := mw.Lookup(userId, mw.Realm, baseAlgorithm)
+		if ha1 == "" {
+			mw.unauthorized(writer, false)
+			return
+		}
+		if baseAlgorithm != algorithm {
+			ha1 = digestHash(algorithm, ha1+":"+params["nonce"]+":"+params["cnonce"])
+		}
+		ha2 := digestHash(algorithm, request.Method+":"+params["uri"])
+		expected := digestHash(algorithm, strings.Join([]string{
+			ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2,
+		}, ":"))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+			mw.unauthorized(writer, false)
+			return
+		}
+
+		// the credentials are valid, but the nonce may not be.
+		issued, ok := mw.checkNonce(params["nonce"])
+		if !ok || time.Since(issued) > mw.NonceTimeout {
+			mw.unauthorized(writer, true)
+			return
+		}
+		if !mw.checkCount(params["nonce"], nc, issued) {
+			mw.unauthorized(writer, false)
+			return
+		}
+
+		if !mw.Authorizator(userId, request) {
+			mw.unauthorized(writer, false)
+			return
+		}
+
+		request.SetRemoteUser(userId)
+
+		handler(writer, request)
+	}
+}
+
+func (mw *AuthDigestMiddleware) unauthorized(writer ResponseWriter, stale bool) {
+	nonce := mw.newNonce()
+	for _, algorithm := range mw.Algorithms {
+		challenge := fmt.Sprintf(
+			`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s", opaque="%s"`,
+			mw.Realm, algorithm, nonce, mw.opaque,
+		)
+		if stale {
+			challenge += ", stale=true"
+		}
+		writer.Header().Add("WWW-Authenticate", challenge)
+	}
+	Error(writer, "Not Authorized", http.StatusUnauthorized)
+}
+
+func (mw *AuthDigestMiddleware) offeredAlgorithm(algorithm string) (string, bool) {
+	for _, offered := range mw.Algorithms {
+		if strings.EqualFold(offered, algorithm) {
+			return offered, true
+		}
+	}
+	return "", false
+}
+
+// The nonce is made of the issue time and a random part, signed with a private key, so no state
+// is kept for the nonces that are never used.
+func (mw *AuthDigestMiddleware) newNonce() string {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+	copy(payload[8:], digestRandom(8))
+	return hex.EncodeToString(payload) + hex.EncodeToString(mw.signNonce(payload))
+}
+
+func (mw *AuthDigestMiddleware) signNonce(payload []byte) []byte {
+	mac := hmac.New(sha256.New, mw.nonceKey)
+	mac.Write(payload)
+	return mac.Sum(nil)[:16]
+}
+
+// checkNonce returns the issue time of the nonce, and false if the nonce was not issued by this
+// middleware.
+func (mw *AuthDigestMiddleware) checkNonce(nonce string) (time.Time, bool) {
+	decoded, err := hex.DecodeString(nonce)
+	if err != nil || len(decoded) != 32 {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(decoded[16:], mw.signNonce(decoded[:16])) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(decoded[:8]))), true
+}
+
+// checkCount returns false if the nonce count has already been used for this nonce.
+func (mw *AuthDigestMiddleware) checkCount(nonce string, nc uint64, issued time.Time) bool {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(mw.lastSweep) > mw.NonceTimeout {
+		for seen := range mw.counts {
+			if seenIssued, _ := mw.checkNonce(seen); now.Sub(seenIssued) > mw.NonceTimeout {
+				delete(mw.counts, seen)
+			}
+		}
+		mw.lastSweep = now
+	}
+
+	if nc == 0 {
+		return false
+	}
+	counts := mw.counts[nonce]
+	if counts == nil {
+		counts = &digestNonceCounts{}
+		mw.counts[nonce] = counts
+	}
+
+	if nc > counts.highest {
+		shift := nc - counts.highest
+		if shift >= 64 {
+			counts.seen = 1
+		} else {
+			counts.seen = counts.seen<<shift | 1
+		}
+		counts.highest = nc
+		return true
+	}
+
+	offset := counts.highest - nc
+	if offset >= 64 || counts.seen&(1<<offset) != 0 {
+		return false
+	}
+	counts.seen |= 1 << offset
+	return true
+}
+
+// digestBaseAlgorithm returns the algorithm without its -sess suffix, whatever its case.
+func digestBaseAlgorithm(algorithm string) string {
+	if len(algorithm) > 5 && strings.EqualFold(algorithm[len(algorithm)-5:], "-sess") {
+		return algorithm[:len(algorithm)-5]
+	}
+	return algorithm
+}
+
+func digestHashFunc(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(digestBaseAlgorithm(algorithm)) {
+	case "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+func digestHash(algorithm, data string) string {
+	h := digestHashFunc(algorithm)()
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func digestRandom(size int) []byte {
+	random := make([]byte, size)
+	if _, err := rand.Read(random); err != nil {
+		panic(err)
+	}
+	return random
+}
+
+// parseDigestAuthHeader parses the comma separated list of key=value pairs of a Digest
+// Authorization header. The values can be quoted strings.
+func parseDigestAuthHeader(header string) (map[string]string, error) {
+
+	parts := strings.SplitN(header, " ", 2)
+	if !(len(parts) == 2 && strings.EqualFold(parts[0], "Digest")) {
+		return nil, errors.New("Invalid authentication")
+	}
+
+	params := map[string]string{}
+	rest := parts[1]
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		if rest == "" {
+			return params, nil
+		}
+
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil, errors.New("Invalid authentication")
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			closed := false
+			i := 1
+			for ; i < len(rest); i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+					value += string(rest[i])
+					continue
+				}
+				if rest[i] == '"' {
+					closed = true
+					break
+				}
+				value += string(rest[i])
+			}
+			if !closed {
+				return nil, errors.New("Invalid authentication")
+			}
+			rest = rest[i+1:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		params[key] = value
+	}
+}
@@ -0,0 +1,225 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// digestChallenge returns the parameters of the challenge for the algorithm.
+func digestChallenge(t *testing.T, header http.Header, algorithm string) map[string]string {
+	for _, challenge := range header["Www-Authenticate"] {
+		params, err := parseDigestAuthHeader(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params["algorithm"] == algorithm {
+			return params
+		}
+	}
+	t.Fatalf("No challenge for %s in %v", algorithm, header["Www-Authenticate"])
+	return nil
+}
+
+func digestAuthorization(challenge map[string]string, method, uri, userId, password string, nc int) string {
+	algorithm := challenge["algorithm"]
+	ncValue := fmt.Sprintf("%08x", nc)
+	ha1 := DigestHA1(algorithm, userId, challenge["realm"], password)
+	ha2 := digestHash(algorithm, method+":"+uri)
+	response := digestHash(algorithm, strings.Join([]string{
+		ha1, challenge["nonce"], ncValue, "0a4f113b", "auth", ha2,
+	}, ":"))
+	return fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="0a4f113b", response="%s", opaque="%s"`,
+		userId, challenge["realm"], challenge["nonce"], uri, algorithm, ncValue, response, challenge["opaque"],
+	)
+}
+
+func TestAuthDigest(t *testing.T) {
+
+	authMiddleware := &AuthDigestMiddleware{
+		Realm: "test zone",
+		Lookup: func(userId string, realm string, algorithm string) string {
+			if userId == "admin" {
+				return DigestHA1(algorithm, "admin", realm, "admin")
+			}
+			return ""
+		},
+		Authorizator: func(userId string, request *Request) bool {
+			return request.Method == "GET"
+		},
+	}
+
+	api := NewApi()
+	api.Use(authMiddleware)
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"User": r.Env["REMOTE_USER"].(string)})
+	}))
+	handler := api.MakeHandler()
+
+	// simple request fails, with a challenge per algorithm
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil))
+	recorded.CodeIs(401)
+	recorded.ContentTypeIsJson()
+	if len(recorded.Recorder.Header()["Www-Authenticate"]) != 2 {
+		t.Errorf("Two challenges expected, got: %v", recorded.Recorder.Header()["Www-Authenticate"])
+	}
+	sha256Challenge := digestChallenge(t, recorded.Recorder.Header(), "SHA-256")
+	md5Challenge := digestChallenge(t, recorded.Recorder.Header(), "MD5")
+
+	// wrong password
+	req := test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil)
+	req.Header.Set("Authorization", digestAuthorization(sha256Challenge, "GET", "/a?b=c", "admin", "AdmIn", 1))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	// right credentials, SHA-256
+	req = test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil)
+	req.Header.Set("Authorization", digestAuthorization(sha256Challenge, "GET", "/a?b=c", "admin", "admin", 1))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"User":"admin"}`)
+
+	// replayed nonce count
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	// next nonce count
+	req = test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil)
+	req.Header.Set("Authorization", digestAuthorization(sha256Challenge, "GET", "/a?b=c", "admin", "admin", 2))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	// right credentials, MD5, the nonce is shared by the challenges
+	req = test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil)
+	req.Header.Set("Authorization", digestAuthorization(md5Challenge, "GET", "/a?b=c", "admin", "admin", 3))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	// out of order nonce counts, as sent by concurrent requests
+	for _, c := range []struct {
+		nc   int
+		code int
+	}{
+		{20, 200},
+		{19, 200},
+		{19, 401},
+		{100, 200},
+		{30, 401},
+	} {
+		req = test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil)
+		req.Header.Set("Authorization", digestAuthorization(sha256Challenge, "GET", "/a?b=c", "admin", "admin", c.nc))
+		recorded = test.RunRequest(t, handler, req)
+		if recorded.Recorder.Code != c.code {
+			t.Errorf("nc %d: code %d expected, got: %d", c.nc, c.code, recorded.Recorder.Code)
+		}
+	}
+
+	// uri mismatch
+	req = test.MakeSimpleRequest("GET", "http://localhost/other", nil)
+	req.Header.Set("Authorization", digestAuthorization(sha256Challenge, "GET", "/a?b=c", "admin", "admin", 4))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	// right credentials and wrong method
+	req = test.MakeSimpleRequest("POST", "http://localhost/a?b=c", nil)
+	req.Header.Set("Authorization", digestAuthorization(sha256Challenge, "POST", "/a?b=c", "admin", "admin", 5))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	// nonce not issued by the middleware, stale
+	forged := map[string]string{}
+	for key, value := range sha256Challenge {
+		forged[key] = value
+	}
+	forged["nonce"] = strings.Repeat("0", 64)
+	req = test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil)
+	req.Header.Set("Authorization", digestAuthorization(forged, "GET", "/a?b=c", "admin", "admin", 1))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	if !strings.HasSuffix(recorded.Recorder.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("stale=true expected, got: %s", recorded.Recorder.Header().Get("WWW-Authenticate"))
+	}
+
+	// invalid header
+	req = test.MakeSimpleRequest("GET", "http://localhost/a?b=c", nil)
+	req.Header.Set("Authorization", `Digest username="admin`)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(400)
+}
+
+func TestAuthDigestAlgorithmCase(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&AuthDigestMiddleware{
+		Realm: "test zone",
+		Lookup: func(userId string, realm string, algorithm string) string {
+			if algorithm != "MD5" {
+				t.Errorf("MD5 expected, got: %s", algorithm)
+			}
+			return DigestHA1(algorithm, "admin", realm, "admin")
+		},
+		Algorithms: []string{"MD5-sess"},
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	challenge := digestChallenge(t, recorded.Recorder.Header(), "MD5-sess")
+
+	// the client spelling differs from the configured one
+	ha1 := digestHash("MD5", DigestHA1("MD5", "admin", "test zone", "admin")+":"+challenge["nonce"]+":0a4f113b")
+	ha2 := digestHash("MD5", "GET:/")
+	response := digestHash("MD5", ha1+":"+challenge["nonce"]+":00000001:0a4f113b:auth:"+ha2)
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="admin", realm="test zone", nonce="%s", uri="/", algorithm=MD5-SESS, qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="%s"`,
+		challenge["nonce"], response, challenge["opaque"],
+	))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+}
+
+func TestAuthDigestExpiredNonce(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&AuthDigestMiddleware{
+		Realm: "test zone",
+		Lookup: func(userId string, realm string, algorithm string) string {
+			return DigestHA1(algorithm, "admin", realm, "admin")
+		},
+		Algorithms:   []string{"SHA-256-sess"},
+		NonceTimeout: time.Millisecond,
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	challenge := digestChallenge(t, recorded.Recorder.Header(), "SHA-256-sess")
+
+	time.Sleep(5 * time.Millisecond)
+
+	// the -sess HA1 is derived from the nonce and cnonce
+	ha1 := digestHash("SHA-256", DigestHA1("SHA-256", "admin", "test zone", "admin")+":"+challenge["nonce"]+":0a4f113b")
+	ha2 := digestHash("SHA-256", "GET:/")
+	response := digestHash("SHA-256", ha1+":"+challenge["nonce"]+":00000001:0a4f113b:auth:"+ha2)
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="admin", realm="test zone", nonce="%s", uri="/", algorithm=SHA-256-sess, qop=auth, nc=00000001, cnonce="0a4f113b", response="%s", opaque="%s"`,
+		challenge["nonce"], response, challenge["opaque"],
+	))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	if !strings.HasSuffix(recorded.Recorder.Header().Get("WWW-Authenticate"), "stale=true") {
+		t.Errorf("stale=true expected, got: %s", recorded.Recorder.Header().Get("WWW-Authenticate"))
+	}
+}
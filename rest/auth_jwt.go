@@ -0,0 +1,621 @@
+package rest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrJwtInvalid is returned when the token is malformed or its signature is invalid.
+	ErrJwtInvalid = errors.New("JWT is invalid")
+
+	// ErrJwtExpired is returned when the token is expired, or not valid yet.
+	ErrJwtExpired = errors.New("JWT is expired or not valid yet")
+
+	// ErrJwtClaims is returned when the iss or aud claims don't match.
+	ErrJwtClaims = errors.New("JWT claims are invalid")
+
+	// ErrJwtUnknownKey is returned when no key is found for the token kid and alg.
+	ErrJwtUnknownKey = errors.New("JWT signing key is unknown")
+)
+
+// AuthJwtMiddleware provides a JSON Web Token (RFC 7519) authentication implementation. The
+// token is read from the "Authorization: Bearer" header, or from a cookie. The signature is
+// verified with HS256, RS256 or ES256, and the exp (required), nbf, iss and aud claims are
+// checked. On failure, a 401 HTTP response is returned. On success, the wrapped middleware is
+// called, the subject is made available as request.RemoteUser(), and the claims as
+// request.Env["JWT_CLAIMS"].(map[string]interface{}).
+// LoginHandler and RefreshHandler can optionally be used to issue the tokens.
+type AuthJwtMiddleware struct {
+
+	// Realm name used in the WWW-Authenticate header. Required.
+	Realm string
+
+	// Callback function that returns the verification key for the key id (kid header, possibly
+	// empty) and algorithm of the token: []byte for HS256, *rsa.PublicKey for RS256,
+	// *ecdsa.PublicKey for ES256. Required, unless KeySetFile is specified.
+	KeyFunc func(kid string, alg string) (interface{}, error)
+
+	// Path of a local JWKS file (RFC 7517) containing the verification keys indexed by kid.
+	// The file is read again when a token uses an unknown kid, in order to support the key
+	// rotation. Used when KeyFunc is not specified.
+	KeySetFile string
+
+	// List of the accepted algorithms. Optional, defaults to HS256, RS256 and ES256.
+	Algorithms []string
+
+	// Name of the cookie containing the token, used when the Authorization header is missing.
+	// Optional, no cookie is used by default.
+	CookieName string
+
+	// Expected value of the iss claim. Optional, not checked if empty.
+	Issuer string
+
+	// Expected value, or one of the values, of the aud claim. Optional, not checked if empty.
+	Audience string
+
+	// Tolerance applied when checking the exp and nbf claims. Optional, defaults to 0.
+	ClockSkew time.Duration
+
+	// If true, the tokens without exp claim are accepted, and never expire.
+	// Optional, defaults to false, the exp claim is required.
+	AllowMissingExp bool
+
+	// Callback function that should perform the authorization of the authenticated user. Called
+	// only after an authentication success. Must return true on success, false on failure.
+	// Optional, default to success.
+	Authorizator func(userId string, request *Request) bool
+
+	// Callback function that should perform the authentication of the user based on userId and
+	// password, used by LoginHandler. Must return true on success, false on failure.
+	Authenticator func(userId string, password string) bool
+
+	// Algorithm used to sign the tokens issued by LoginHandler and RefreshHandler.
+	// Optional, defaults to HS256.
+	SigningAlgorithm string
+
+	// Key used to sign the issued tokens: []byte for HS256, *rsa.PrivateKey for RS256,
+	// *ecdsa.PrivateKey for ES256. Required to issue tokens.
+	SigningKey interface{}
+
+	// Key id set in the kid header of the issued tokens. Optional.
+	SigningKeyId string
+
+	// Duration the issued tokens are valid for. Optional, defaults to one hour.
+	Timeout time.Duration
+
+	// Duration after the original login during which a token can be refreshed, the orig_iat
+	// claim keeps track of the login time. Optional, defaults to 0, no refresh.
+	MaxRefresh time.Duration
+
+	// Callback function that returns additional claims for the tokens issued by LoginHandler.
+	// Optional.
+	PayloadFunc func(userId string) map[string]interface{}
+
+	algorithms map[string]bool
+	keySet     *jwkSet
+}
+
+// MiddlewareFunc makes AuthJwtMiddleware implement the Middleware interface.
+func (mw *AuthJwtMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.Realm == "" {
+		log.Fatal("Realm is required")
+	}
+
+	if mw.KeyFunc == nil {
+		if mw.KeySetFile == "" {
+			log.Fatal("KeyFunc or KeySetFile is required")
+		}
+		mw.keySet = &jwkSet{path: mw.KeySetFile}
+		if err := mw.keySet.load(); err != nil {
+			log.Fatal(err)
+		}
+		mw.KeyFunc = mw.keySet.key
+	}
+
+	if len(mw.Algorithms) == 0 {
+		mw.Algorithms = []string{"HS256", "RS256", "ES256"}
+	}
+	mw.algorithms = map[string]bool{}
+	for _, alg := range mw.Algorithms {
+		mw.algorithms[alg] = true
+	}
+
+	if mw.Authorizator == nil {
+		mw.Authorizator = func(userId string, request *Request) bool {
+			return true
+		}
+	}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		token := mw.extractToken(request)
+		if token == "" {
+			mw.unauthorized(writer, "")
+			return
+		}
+
+		claims, err := mw.ParseToken(token)
+		if err != nil {
+			mw.unauthorized(writer, "invalid_token")
+			return
+		}
+
+		userId, _ := claims["sub"].(string)
+
+		if !mw.Authorizator(userId, request) {
+			mw.unauthorized(writer, "")
+			return
+		}
+
+		request.SetRemoteUser(userId)
+		request.Env["JWT_CLAIMS"] = claims
+
+		handler(writer, request)
+	}
+}
+
+func (mw *AuthJwtMiddleware) extractToken(request *Request) string {
+	authHeader := request.Header.Get("Authorization")
+	if authHeader != "" {
+		parts := strings.SplitN(authHeader, " ", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "Bearer") {
+			return strings.TrimSpace(parts[1])
+		}
+		return ""
+	}
+	if mw.CookieName != "" {
+		cookie, err := request.Cookie(mw.CookieName)
+		if err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func (mw *AuthJwtMiddleware) unauthorized(writer ResponseWriter, errorCode string) {
+	challenge := "Bearer realm=\"" + mw.Realm + "\""
+	if errorCode != "" {
+		challenge += ", error=\"" + errorCode + "\""
+	}
+	writer.Header().Set("WWW-Authenticate", challenge)
+	Error(writer, "Not Authorized", http.StatusUnauthorized)
+}
+
+// ParseToken verifies the signature of the token and the claims, and returns the claims.
+func (mw *AuthJwtMiddleware) ParseToken(token string) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJwtInvalid
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJwtSegment(parts[0], &header); err != nil {
+		return nil, ErrJwtInvalid
+	}
+	if !mw.algorithms[header.Alg] {
+		return nil, ErrJwtInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJwtInvalid
+	}
+
+	key, err := mw.KeyFunc(header.Kid, header.Alg)
+	if err != nil || key == nil {
+		return nil, ErrJwtUnknownKey
+	}
+
+	if !verifyJwtSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrJwtInvalid
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJwtSegment(parts[1], &claims); err != nil {
+		return nil, ErrJwtInvalid
+	}
+
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok {
+		if !now.Add(-mw.ClockSkew).Before(jwtTime(exp)) {
+			return nil, ErrJwtExpired
+		}
+	} else if !mw.AllowMissingExp {
+		return nil, ErrJwtClaims
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(mw.ClockSkew).Before(jwtTime(nbf)) {
+			return nil, ErrJwtExpired
+		}
+	}
+	if mw.Issuer != "" && claims["iss"] != mw.Issuer {
+		return nil, ErrJwtClaims
+	}
+	if mw.Audience != "" && !jwtAudienceMatches(claims["aud"], mw.Audience) {
+		return nil, ErrJwtClaims
+	}
+
+	return claims, nil
+}
+
+// IssueToken creates a token for the userId with the additional claims, signed with the
+// SigningKey. It returns the token and its expiration time.
+func (mw *AuthJwtMiddleware) IssueToken(userId string, extraClaims map[string]interface{}) (string, time.Time, error) {
+
+	timeout := mw.Timeout
+	if timeout <= 0 {
+		timeout = time.Hour
+	}
+
+	now := time.Now()
+	expire := now.Add(timeout)
+
+	claims := map[string]interface{}{}
+	for name, value := range extraClaims {
+		claims[name] = value
+	}
+	claims["sub"] = userId
+	claims["iat"] = now.Unix()
+	claims["exp"] = expire.Unix()
+	if claims["orig_iat"] == nil {
+		claims["orig_iat"] = now.Unix()
+	}
+	if mw.Issuer != "" {
+		claims["iss"] = mw.Issuer
+	}
+	if mw.Audience != "" && claims["aud"] == nil {
+		claims["aud"] = mw.Audience
+	}
+
+	alg := mw.SigningAlgorithm
+	if alg == "" {
+		alg = "HS256"
+	}
+
+	token, err := signJwt(alg, mw.SigningKeyId, mw.SigningKey, claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expire, nil
+}
+
+// LoginHandler can be used by clients to get a token. The payload must be
+// '{"username": "...", "password": "..."}', the credentials are verified with the Authenticator.
+// The response is '{"token": "...", "expire": "..."}'. This handler must not be wrapped by the
+// middleware.
+func (mw *AuthJwtMiddleware) LoginHandler(writer ResponseWriter, request *Request) {
+
+	login := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{}
+	err := request.DecodeJsonPayload(&login)
+	if err != nil {
+		Error(writer, "Invalid login payload", http.StatusBadRequest)
+		return
+	}
+
+	if mw.Authenticator == nil || !mw.Authenticator(login.Username, login.Password) {
+		mw.unauthorized(writer, "")
+		return
+	}
+
+	var extraClaims map[string]interface{}
+	if mw.PayloadFunc != nil {
+		extraClaims = mw.PayloadFunc(login.Username)
+	}
+
+	mw.writeToken(writer, login.Username, extraClaims)
+}
+
+// RefreshHandler can be used by clients to get a new token from a valid one, until MaxRefresh
+// after the original login. The response is '{"token": "...", "expire": "..."}'. This handler
+// must be wrapped by the middleware.
+func (mw *AuthJwtMiddleware) RefreshHandler(writer ResponseWriter, request *Request) {
+
+	claims, ok := request.Env["JWT_CLAIMS"].(map[string]interface{})
+	if !ok {
+		mw.unauthorized(writer, "")
+		return
+	}
+
+	origIat, ok := claims["orig_iat"].(float64)
+	if !ok || !time.Now().Before(jwtTime(origIat).Add(mw.MaxRefresh)) {
+		mw.unauthorized(writer, "invalid_token")
+		return
+	}
+
+	extraClaims := map[string]interface{}{}
+	for name, value := range claims {
+		switch name {
+		case "sub", "iat", "exp", "nbf":
+			continue
+		}
+		extraClaims[name] = value
+	}
+
+	userId, _ := claims["sub"].(string)
+	mw.writeToken(writer, userId, extraClaims)
+}
+
+func (mw *AuthJwtMiddleware) writeToken(writer ResponseWriter, userId string, extraClaims map[string]interface{}) {
+	token, expire, err := mw.IssueToken(userId, extraClaims)
+	if err != nil {
+		Error(writer, "Could not issue the token", http.StatusInternalServerError)
+		return
+	}
+	writer.WriteJson(map[string]string{
+		"token":  token,
+		"expire": expire.Format(time.RFC3339),
+	})
+}
+
+func jwtTime(value float64) time.Time {
+	return time.Unix(int64(value), 0)
+}
+
+func jwtAudienceMatches(aud interface{}, expected string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == expected
+	case []interface{}:
+		for _, item := range aud {
+			if item == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJwtSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Verify the signature, the type of the key must match the algorithm.
+func verifyJwtSignature(alg string, key interface{}, signed []byte, signature []byte) bool {
+
+	hashed := sha256.Sum256(signed)
+
+	switch alg {
+
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(signature, mac.Sum(nil))
+
+	case "RS256":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature) == nil
+
+	case "ES256":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || publicKey.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, hashed[:], r, s)
+	}
+
+	return false
+}
+
+func signJwt(alg string, kid string, key interface{}, claims map[string]interface{}) (string, error) {
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(headerJson) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJson)
+	hashed := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+
+	switch alg {
+
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return "", errors.New("HS256 requires a []byte SigningKey")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+
+	case "RS256":
+		privateKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return "", errors.New("RS256 requires a *rsa.PrivateKey SigningKey")
+		}
+		signature, err = rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hashed[:])
+		if err != nil {
+			return "", err
+		}
+
+	case "ES256":
+		privateKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return "", errors.New("ES256 requires a *ecdsa.PrivateKey SigningKey")
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashed[:])
+		if err != nil {
+			return "", err
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+
+	default:
+		return "", errors.New("unsupported JWT signing algorithm " + alg)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// The verification keys of a JWKS file, indexed by kid.
+type jwkSet struct {
+	lock    sync.RWMutex
+	path    string
+	modTime time.Time
+	keys    map[string]interface{}
+}
+
+// Return the key for the kid, reading the file again if the kid is unknown and the file
+// has changed.
+func (s *jwkSet) key(kid string, alg string) (interface{}, error) {
+	s.lock.RLock()
+	key := s.keys[kid]
+	s.lock.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.lock.RUnlock()
+	if changed {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		s.lock.RLock()
+		key = s.keys[kid]
+		s.lock.RUnlock()
+	}
+	if key == nil {
+		return nil, ErrJwtUnknownKey
+	}
+	return key, nil
+}
+
+func (s *jwkSet) load() error {
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseJwkSet(content)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.lock.Unlock()
+	return nil
+}
+
+// ParseJwkSet parses a JSON Web Key Set (RFC 7517), and returns the public keys indexed by kid:
+// []byte for the "oct" keys, *rsa.PublicKey for the "RSA" keys, *ecdsa.PublicKey for the "EC"
+// P-256 keys. The keys of other types are ignored.
+func ParseJwkSet(content []byte) (map[string]interface{}, error) {
+
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	err := json.Unmarshal(content, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		switch jwk.Kty {
+
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil {
+				return nil, err
+			}
+			keys[jwk.Kid] = secret
+
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil {
+				return nil, errors.New("invalid RSA JWK " + jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				return nil, errors.New("invalid EC JWK " + jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
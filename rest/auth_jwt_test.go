@@ -0,0 +1,245 @@
+package rest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthJwtHS256(t *testing.T) {
+
+	secret := []byte("secret")
+
+	authMiddleware := &AuthJwtMiddleware{
+		Realm: "test zone",
+		KeyFunc: func(kid string, alg string) (interface{}, error) {
+			return secret, nil
+		},
+		Issuer:     "test",
+		Audience:   "api",
+		CookieName: "jwt",
+		ClockSkew:  time.Minute,
+		Authorizator: func(userId string, request *Request) bool {
+			return userId != "banned"
+		},
+		SigningKey: secret,
+		Authenticator: func(userId string, password string) bool {
+			return password == "admin"
+		},
+		PayloadFunc: func(userId string) map[string]interface{} {
+			return map[string]interface{}{"role": "admin"}
+		},
+		MaxRefresh: time.Hour,
+	}
+
+	api := NewApi()
+	api.Use(&IfMiddleware{
+		Condition: func(request *Request) bool {
+			return request.URL.Path != "/login"
+		},
+		IfTrue: authMiddleware,
+	})
+	router, err := MakeRouter(
+		Post("/login", authMiddleware.LoginHandler),
+		Get("/refresh", authMiddleware.RefreshHandler),
+		Get("/", func(w ResponseWriter, r *Request) {
+			claims := r.Env["JWT_CLAIMS"].(map[string]interface{})
+			w.WriteJson(map[string]interface{}{
+				"User": r.Env["REMOTE_USER"],
+				"Role": claims["role"],
+			})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	// no token
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone"`)
+
+	// login failure
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login",
+		map[string]string{"username": "admin", "password": "wrong"}))
+	recorded.CodeIs(401)
+
+	// login success
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login",
+		map[string]string{"username": "admin", "password": "admin"}))
+	recorded.CodeIs(200)
+	login := map[string]string{}
+	if err := recorded.DecodeJsonPayload(&login); err != nil {
+		t.Fatal(err)
+	}
+	token := login["token"]
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Role":"admin","User":"admin"}`)
+
+	// token from the cookie
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.AddCookie(&http.Cookie{Name: "jwt", Value: token})
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	// refresh
+	req = test.MakeSimpleRequest("GET", "http://localhost/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	refreshed := map[string]string{}
+	if err := recorded.DecodeJsonPayload(&refreshed); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := authMiddleware.ParseToken(refreshed["token"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["role"] != "admin" || claims["sub"] != "admin" {
+		t.Errorf("Unexpected refreshed claims: %v", claims)
+	}
+
+	// tampered signature
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+token[:len(token)-2]+"xx")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.HeaderIs("WWW-Authenticate", `Bearer realm="test zone", error="invalid_token"`)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	cases := []struct {
+		claims map[string]interface{}
+		code   int
+	}{
+		// within the clock skew
+		{map[string]interface{}{"sub": "u", "iss": "test", "aud": "api", "exp": time.Now().Add(-30 * time.Second).Unix()}, 200},
+		{map[string]interface{}{"sub": "u", "iss": "test", "aud": "api", "exp": time.Now().Add(-2 * time.Minute).Unix()}, 401},
+		{map[string]interface{}{"sub": "u", "iss": "test", "aud": "api", "exp": exp, "nbf": time.Now().Add(2 * time.Minute).Unix()}, 401},
+		{map[string]interface{}{"sub": "u", "iss": "other", "aud": "api", "exp": exp}, 401},
+		{map[string]interface{}{"sub": "u", "iss": "test", "aud": []string{"other", "api"}, "exp": exp}, 200},
+		{map[string]interface{}{"sub": "u", "iss": "test", "aud": "other", "exp": exp}, 401},
+		{map[string]interface{}{"sub": "banned", "iss": "test", "aud": "api", "exp": exp}, 401},
+		// exp is required
+		{map[string]interface{}{"sub": "u", "iss": "test", "aud": "api"}, 401},
+	}
+	for _, c := range cases {
+		token, err := signJwt("HS256", "", secret, c.claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorded := test.RunRequest(t, handler, req)
+		if recorded.Recorder.Code != c.code {
+			t.Errorf("%v: code %d expected, got: %d", c.claims, c.code, recorded.Recorder.Code)
+		}
+	}
+
+	// unless explicitly allowed
+	authMiddleware.AllowMissingExp = true
+	token, err = signJwt("HS256", "", secret, map[string]interface{}{"sub": "u", "iss": "test", "aud": "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	test.RunRequest(t, handler, req).CodeIs(200)
+}
+
+func TestAuthJwtKeySetFile(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	rsaJwk := fmt.Sprintf(`{"kty":"RSA","kid":"rsa1","n":"%s","e":"%s"}`,
+		encode(rsaKey.N), encode(big.NewInt(int64(rsaKey.E))))
+	ecJwk := fmt.Sprintf(`{"kty":"EC","kid":"ec1","crv":"P-256","x":"%s","y":"%s"}`,
+		encode(ecKey.X), encode(ecKey.Y))
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, []byte(`{"keys":[`+rsaJwk+`]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewApi()
+	api.Use(&AuthJwtMiddleware{
+		Realm:      "test zone",
+		KeySetFile: path,
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]interface{}{"User": r.Env["REMOTE_USER"]})
+	}))
+	handler := api.MakeHandler()
+
+	run := func(alg string, kid string, key interface{}) *test.Recorded {
+		token, err := signJwt(alg, kid, key, map[string]interface{}{"sub": "admin", "exp": time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return test.RunRequest(t, handler, req)
+	}
+
+	recorded := run("RS256", "rsa1", rsaKey)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"User":"admin"}`)
+
+	// unknown kid
+	recorded = run("ES256", "ec1", ecKey)
+	recorded.CodeIs(401)
+
+	// key rotation, the file is read again
+	future := time.Now().Add(time.Second)
+	if err := ioutil.WriteFile(path, []byte(`{"keys":[`+rsaJwk+`,`+ecJwk+`]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, future, future)
+	recorded = run("ES256", "ec1", ecKey)
+	recorded.CodeIs(200)
+
+	// algorithm confusion, HMAC signed with the RSA kid
+	recorded = run("HS256", "rsa1", []byte("secret"))
+	recorded.CodeIs(401)
+
+	// alg none
+	recorded = run("RS256", "rsa1", rsaKey)
+	recorded.CodeIs(200)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa1"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "."
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("Authorization", "Bearer "+none)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+}
@@ -0,0 +1,347 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// BodyCapture is a request and response exchange, as captured by the BodyCaptureMiddleware.
+type BodyCapture struct {
+	Timestamp  time.Time
+	HttpMethod string
+	RequestURI string
+	RequestId  string `json:",omitempty"`
+	StatusCode int
+
+	RequestContentType string `json:",omitempty"`
+	RequestBody        string `json:",omitempty"`
+
+	// True if the request body is larger than MaxBodySize.
+	RequestBodyTruncated bool `json:",omitempty"`
+
+	ResponseContentType string `json:",omitempty"`
+	ResponseBody        string `json:",omitempty"`
+
+	// True if the response body is larger than MaxBodySize.
+	ResponseBodyTruncated bool `json:",omitempty"`
+}
+
+// BodyCaptureSink defines the interface that objects must implement in order to receive the
+// exchanges captured by the BodyCaptureMiddleware.
+type BodyCaptureSink interface {
+
+	// Capture is called once the response is written.
+	Capture(capture *BodyCapture) error
+}
+
+// The body of a JSON payload that cannot be redacted, because it is truncated or invalid.
+const bodyCaptureUnredactable = "[not captured, cannot redact the JSON]"
+
+// BodyCaptureMiddleware captures the request and response bodies, for debugging. The request body
+// is copied while read by the wrapped handlers, the part they don't read is read afterwards, up to
+// MaxBodySize. The response body is copied while written. The JSON fields listed in RedactFields
+// are replaced by "REDACTED". The captures go to the Sink, or are written as JSON with the Logger.
+// Condition, as in IfMiddleware, enables the capture per request, eg: only with a debug header.
+type BodyCaptureMiddleware struct {
+
+	// Runtime condition that enables the capture for the request.
+	// Optional, defaults to capturing all the requests.
+	Condition func(r *Request) bool
+
+	// Maximum number of bytes captured for each body. Optional, defaults to 64KB.
+	MaxBodySize int
+
+	// Media types of the captured bodies, with wildcards as in "text/*".
+	// Optional, defaults to application/json, application/x-www-form-urlencoded and text/*.
+	ContentTypes []string
+
+	// Paths of the JSON fields to redact, from the root of the payload, with dots to separate the
+	// names, eg: "password", "card.number". The arrays are traversed, so "items.secret" applies to
+	// all the items. Optional.
+	RedactFields []string
+
+	// Receives the captures. Optional, defaults to writing them as JSON with the Logger.
+	Sink BodyCaptureSink
+
+	// Logger used when no Sink is set, or to report the Sink errors. Optional, defaults to
+	// log.New(os.Stderr, "", 0).
+	Logger *log.Logger
+
+	redactPaths [][]string
+}
+
+// MiddlewareFunc makes BodyCaptureMiddleware implement the Middleware interface.
+func (mw *BodyCaptureMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
+
+	if mw.Condition == nil {
+		mw.Condition = func(r *Request) bool {
+			return true
+		}
+	}
+	if mw.MaxBodySize <= 0 {
+		mw.MaxBodySize = 64 * 1024
+	}
+	if len(mw.ContentTypes) == 0 {
+		mw.ContentTypes = []string{"application/json", "application/x-www-form-urlencoded", "text/*"}
+	}
+	if mw.Logger == nil {
+		mw.Logger = log.New(os.Stderr, "", 0)
+	}
+	mw.redactPaths = [][]string{}
+	for _, field := range mw.RedactFields {
+		mw.redactPaths = append(mw.redactPaths, strings.Split(field, "."))
+	}
+
+	return func(w ResponseWriter, r *Request) {
+
+		if !mw.Condition(r) {
+			h(w, r)
+			return
+		}
+
+		capture := &BodyCapture{
+			Timestamp:          time.Now(),
+			HttpMethod:         r.Method,
+			RequestURI:         r.URL.RequestURI(),
+			RequestContentType: r.Header.Get("Content-Type"),
+		}
+
+		var requestReader io.Reader
+		var requestCopy *bodyCopyWriter
+		if r.Body != nil && mw.isCaptured(capture.RequestContentType) {
+			requestCopy = &bodyCopyWriter{limit: mw.MaxBodySize}
+			requestReader = io.TeeReader(r.Body, requestCopy)
+			r.Body = &bodyCaptureReadCloser{
+				Reader: requestReader,
+				Closer: r.Body,
+			}
+		}
+
+		writer := &bodyCaptureResponseWriter{w, false, 0, nil, false, mw}
+
+		// call the handler
+		h(writer, r)
+
+		if requestCopy != nil {
+			// complete the copy with the part of the body not read by the handler
+			if !requestCopy.truncated {
+				ioutil.ReadAll(io.LimitReader(requestReader, int64(mw.MaxBodySize-requestCopy.buffer.Len()+1)))
+			}
+			capture.RequestBodyTruncated = requestCopy.truncated
+			capture.RequestBody = mw.redact(capture.RequestContentType, requestCopy.buffer.Bytes(), requestCopy.truncated)
+		}
+
+		capture.StatusCode = writer.statusCode
+		capture.RequestId, _ = r.RequestId()
+		if writer.buffer != nil {
+			capture.ResponseContentType = writer.Header().Get("Content-Type")
+			capture.ResponseBodyTruncated = writer.truncated
+			capture.ResponseBody = mw.redact(capture.ResponseContentType, writer.buffer.Bytes(), writer.truncated)
+		}
+
+		if mw.Sink != nil {
+			if err := mw.Sink.Capture(capture); err != nil {
+				mw.Logger.Printf("BodyCaptureMiddleware: cannot capture the bodies: %s", err)
+			}
+			return
+		}
+		b, err := json.Marshal(capture)
+		if err != nil {
+			panic(err)
+		}
+		mw.Logger.Printf("%s", b)
+	}
+}
+
+// isCaptured returns true if the media type matches one of the ContentTypes.
+func (mw *BodyCaptureMiddleware) isCaptured(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, accepted := range mw.ContentTypes {
+		if accepted == mediaType {
+			return true
+		}
+		if prefix := strings.TrimSuffix(accepted, "*"); prefix != accepted && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact returns the body with the RedactFields replaced, when the body is JSON.
+func (mw *BodyCaptureMiddleware) redact(contentType string, body []byte, truncated bool) string {
+
+	if len(mw.redactPaths) == 0 || len(body) == 0 || !isJsonMediaType(contentType) {
+		return string(body)
+	}
+	if truncated {
+		return bodyCaptureUnredactable
+	}
+	redacted, err := redactJson(body, mw.redactPaths)
+	if err != nil {
+		return bodyCaptureUnredactable
+	}
+	return string(redacted)
+}
+
+// isJsonMediaType returns true for application/json and the +json media types.
+func isJsonMediaType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// redactJson returns the JSON payload with the values at the paths replaced by "REDACTED". The
+// numbers are kept as they are.
+func redactJson(body []byte, paths [][]string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var payload interface{}
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		redactJsonPath(payload, path)
+	}
+	return json.Marshal(payload)
+}
+
+func redactJsonPath(value interface{}, path []string) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		child, ok := typed[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			typed[path[0]] = "REDACTED"
+			return
+		}
+		redactJsonPath(child, path[1:])
+	case []interface{}:
+		for _, item := range typed {
+			redactJsonPath(item, path)
+		}
+	}
+}
+
+// Reads the request body through a copy, and closes the original body.
+type bodyCaptureReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Keeps a copy of the beginning of the bytes written, up to limit.
+type bodyCopyWriter struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (w *bodyCopyWriter) Write(b []byte) (int, error) {
+	remaining := w.limit - w.buffer.Len()
+	if len(b) > remaining {
+		w.buffer.Write(b[:remaining])
+		w.truncated = true
+	} else {
+		w.buffer.Write(b)
+	}
+	return len(b), nil
+}
+
+// Private responseWriter intantiated by the body capture middleware.
+// It keeps a copy of the beginning of the payload.
+// It implements the following interfaces:
+// ResponseWriter
+// http.ResponseWriter
+// http.Flusher
+// http.CloseNotifier
+// http.Hijacker
+type bodyCaptureResponseWriter struct {
+	ResponseWriter
+	wroteHeader bool
+	statusCode  int
+	buffer      *bytes.Buffer
+	truncated   bool
+	mw          *BodyCaptureMiddleware
+}
+
+// Record the status code, decide if the payload is captured, and call the parent WriteHeader.
+func (w *bodyCaptureResponseWriter) WriteHeader(code int) {
+	w.ResponseWriter.WriteHeader(code)
+	if w.wroteHeader {
+		return
+	}
+	w.statusCode = code
+	if w.mw.isCaptured(w.Header().Get("Content-Type")) {
+		w.buffer = &bytes.Buffer{}
+	}
+	w.wroteHeader = true
+}
+
+// Make sure the local Write is called.
+func (w *bodyCaptureResponseWriter) WriteJson(v interface{}) error {
+	b, err := w.EncodeJson(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Make sure the local WriteHeader is called, and call the parent Flush.
+// Provided in order to implement the http.Flusher interface.
+func (w *bodyCaptureResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flusher := w.ResponseWriter.(http.Flusher)
+	flusher.Flush()
+}
+
+// Call the parent CloseNotify.
+// Provided in order to implement the http.CloseNotifier interface.
+func (w *bodyCaptureResponseWriter) CloseNotify() <-chan bool {
+	notifier := w.ResponseWriter.(http.CloseNotifier)
+	return notifier.CloseNotify()
+}
+
+// Provided in order to implement the http.Hijacker interface.
+func (w *bodyCaptureResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker := w.ResponseWriter.(http.Hijacker)
+	return hijacker.Hijack()
+}
+
+// Make sure the local WriteHeader is called, copy the payload up to MaxBodySize, and call the
+// parent Write.
+// Provided in order to implement the http.ResponseWriter interface.
+func (w *bodyCaptureResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffer != nil && !w.truncated {
+		remaining := w.mw.MaxBodySize - w.buffer.Len()
+		if len(b) > remaining {
+			w.buffer.Write(b[:remaining])
+			w.truncated = true
+		} else {
+			w.buffer.Write(b)
+		}
+	}
+	writer := w.ResponseWriter.(http.ResponseWriter)
+	return writer.Write(b)
+}
@@ -0,0 +1,178 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+type testBodyCaptureSink struct {
+	captures []*BodyCapture
+}
+
+func (s *testBodyCaptureSink) Capture(capture *BodyCapture) error {
+	s.captures = append(s.captures, capture)
+	return nil
+}
+
+func TestBodyCaptureMiddleware(t *testing.T) {
+
+	sink := &testBodyCaptureSink{}
+
+	api := NewApi()
+	api.Use(&BodyCaptureMiddleware{
+		Condition: func(r *Request) bool {
+			return r.Header.Get("X-Debug") != ""
+		},
+		RedactFields: []string{"password", "card.number", "items.secret"},
+		Sink:         sink,
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		payload := map[string]interface{}{}
+		if err := r.DecodeJsonPayload(&payload); err != nil {
+			Error(w, err.Error(), 400)
+			return
+		}
+		payload["password"] = "returned"
+		w.WriteJson(payload)
+	}))
+	handler := api.MakeHandler()
+
+	body := map[string]interface{}{
+		"login":    "admin",
+		"password": "s3cr3t",
+		"card":     map[string]interface{}{"number": "4111111111111111", "expiry": "12/30"},
+		"items":    []interface{}{map[string]interface{}{"secret": 1}, map[string]interface{}{"secret": 2}},
+	}
+
+	// not enabled
+	test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/login", body)).CodeIs(200)
+	if len(sink.captures) != 0 {
+		t.Fatalf("No capture expected, got %d", len(sink.captures))
+	}
+
+	// enabled, the handler still reads the whole body
+	req := test.MakeSimpleRequest("POST", "http://localhost/login", body)
+	req.Header.Set("X-Debug", "1")
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	if !strings.Contains(recorded.Recorder.Body.String(), `"number":"4111111111111111"`) {
+		t.Errorf("The response expected to be unchanged, got: %s", recorded.Recorder.Body.String())
+	}
+
+	if len(sink.captures) != 1 {
+		t.Fatalf("1 capture expected, got %d", len(sink.captures))
+	}
+	capture := sink.captures[0]
+	if capture.StatusCode != 200 || capture.HttpMethod != "POST" || capture.RequestURI != "/login" {
+		t.Errorf("Unexpected capture: %+v", capture)
+	}
+	expected := `{"card":{"expiry":"12/30","number":"REDACTED"},"items":[{"secret":"REDACTED"},{"secret":"REDACTED"}],"login":"admin","password":"REDACTED"}`
+	if capture.RequestBody != expected {
+		t.Errorf("Unexpected request body: %s", capture.RequestBody)
+	}
+	if capture.ResponseBody != expected {
+		t.Errorf("Unexpected response body: %s", capture.ResponseBody)
+	}
+}
+
+func TestBodyCaptureMiddlewareLimits(t *testing.T) {
+
+	buffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&BodyCaptureMiddleware{
+		MaxBodySize:  8,
+		RedactFields: []string{"password"},
+		Logger:       log.New(buffer, "", 0),
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(200)
+		w.(io.Writer).Write(b)
+	}))
+	handler := api.MakeHandler()
+
+	// text is truncated
+	req := test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	req.Body = ioutil.NopCloser(strings.NewReader("0123456789"))
+	req.Header.Set("Content-Type", "text/plain")
+	recorded := test.RunRequest(t, handler, req)
+	recorded.BodyIs("0123456789")
+
+	capture := &BodyCapture{}
+	if err := json.Unmarshal(buffer.Bytes(), capture); err != nil {
+		t.Fatal(err)
+	}
+	if capture.RequestBody != "01234567" || !capture.RequestBodyTruncated {
+		t.Errorf("Unexpected request body: %s %t", capture.RequestBody, capture.RequestBodyTruncated)
+	}
+	if capture.ResponseBody != "01234567" || !capture.ResponseBodyTruncated {
+		t.Errorf("Unexpected response body: %s %t", capture.ResponseBody, capture.ResponseBodyTruncated)
+	}
+
+	// truncated JSON cannot be redacted, binary is not captured
+	buffer.Reset()
+	req = test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"password": "s3cr3t"})
+	recorded = test.RunRequest(t, handler, req)
+	capture = &BodyCapture{}
+	if err := json.Unmarshal(buffer.Bytes(), capture); err != nil {
+		t.Fatal(err)
+	}
+	if capture.RequestBody != bodyCaptureUnredactable {
+		t.Errorf("Unexpected request body: %s", capture.RequestBody)
+	}
+
+	buffer.Reset()
+	req = test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	req.Body = ioutil.NopCloser(strings.NewReader("binary"))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	test.RunRequest(t, handler, req).BodyIs("binary")
+	capture = &BodyCapture{}
+	if err := json.Unmarshal(buffer.Bytes(), capture); err != nil {
+		t.Fatal(err)
+	}
+	if capture.RequestBody != "" {
+		t.Errorf("No request body expected, got: %s", capture.RequestBody)
+	}
+}
+
+func TestBodyCaptureMiddlewareUnreadBody(t *testing.T) {
+
+	sink := &testBodyCaptureSink{}
+
+	api := NewApi()
+	api.Use(&BodyCaptureMiddleware{
+		MaxBodySize: 8,
+		Sink:        sink,
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		// reads only the beginning of the body
+		b := make([]byte, 2)
+		io.ReadFull(r.Body, b)
+		w.WriteJson(map[string]string{"Read": string(b)})
+	}))
+	handler := api.MakeHandler()
+
+	for body, expected := range map[string]string{
+		"0123":       "0123",
+		"0123456789": "01234567",
+	} {
+		sink.captures = nil
+		req := test.MakeSimpleRequest("POST", "http://localhost/", nil)
+		req.Body = ioutil.NopCloser(strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		test.RunRequest(t, handler, req).BodyIs(`{"Read":"01"}`)
+
+		capture := sink.captures[0]
+		if capture.RequestBody != expected || capture.RequestBodyTruncated != (len(body) > 8) {
+			t.Errorf("Unexpected request body: %s %t", capture.RequestBody, capture.RequestBodyTruncated)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache is an in-memory LRU store of HTTP responses, bounded by the total size of the
+// stored payloads. It is used by CacheMiddleware, and can be shared by multiple CacheMiddleware
+// instances, for instance to configure different TTLs per route. The Invalidate methods are
+// meant to be called by the handlers after writes.
+type ResponseCache struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	paths   map[string]map[string]bool
+	calls   map[string]*cacheCall
+}
+
+// A stored response.
+type cacheEntry struct {
+	key        string
+	path       string
+	statusCode int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+// An in-flight request, the concurrent requests for the same key wait for it to be done.
+type cacheCall struct {
+	done chan struct{}
+}
+
+const defaultResponseCacheMaxSize = 64 << 20
+
+// NewResponseCache returns a ResponseCache that evicts the least recently used responses when the
+// total size exceeds maxSize bytes. A maxSize of 0 means the default, 64MB.
+func NewResponseCache(maxSize int64) *ResponseCache {
+	if maxSize <= 0 {
+		maxSize = defaultResponseCacheMaxSize
+	}
+	return &ResponseCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		paths:   map[string]map[string]bool{},
+		calls:   map[string]*cacheCall{},
+	}
+}
+
+// Invalidate removes all the stored responses for the given URL path, whatever the query string
+// and the Vary headers.
+func (c *ResponseCache) Invalidate(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key := range c.paths[path] {
+		c.remove(c.entries[key])
+	}
+}
+
+// InvalidatePrefix removes all the stored responses for the URL paths starting with prefix.
+func (c *ResponseCache) InvalidatePrefix(prefix string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for path, keys := range c.paths {
+		if strings.HasPrefix(path, prefix) {
+			for key := range keys {
+				c.remove(c.entries[key])
+			}
+		}
+	}
+}
+
+// Purge removes all the stored responses.
+func (c *ResponseCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.size = 0
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.paths = map[string]map[string]bool{}
+}
+
+// Len returns the number of stored responses.
+func (c *ResponseCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// Return the entry if it exists and is not expired.
+func (c *ResponseCache) get(key string, now time.Time) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element := c.entries[key]
+	if element == nil {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+func (c *ResponseCache) set(entry *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	size := entry.size()
+	if size > c.maxSize {
+		return
+	}
+	if element := c.entries[entry.key]; element != nil {
+		c.remove(element)
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	if c.paths[entry.path] == nil {
+		c.paths[entry.path] = map[string]bool{}
+	}
+	c.paths[entry.path][entry.key] = true
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Must be called with the lock held.
+func (c *ResponseCache) remove(element *list.Element) {
+	if element == nil {
+		return
+	}
+	entry := element.Value.(*cacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+	delete(c.paths[entry.path], entry.key)
+	if len(c.paths[entry.path]) == 0 {
+		delete(c.paths, entry.path)
+	}
+	c.size -= entry.size()
+}
+
+// Register an in-flight request for the key. Return the call and true if the caller is the
+// first one, and must call done, or the existing call to wait for.
+func (c *ResponseCache) acquire(key string) (*cacheCall, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if call := c.calls[key]; call != nil {
+		return call, false
+	}
+	call := &cacheCall{make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+func (c *ResponseCache) release(key string, call *cacheCall) {
+	c.lock.Lock()
+	delete(c.calls, key)
+	c.lock.Unlock()
+	close(call.done)
+}
+
+// CacheMiddleware stores the complete GET responses (status, headers, payload) in a
+// ResponseCache, and serves the following matching requests from it. The responses are keyed by
+// URL path, query string and the values of the VaryHeaders. The concurrent requests for the same
+// key are coalesced, only one is executed while the others wait for its result.
+// The Cache-Control directives are respected: the handler can disable the caching (no-store,
+// no-cache, private) or set the TTL (s-maxage, max-age), the client can bypass the stored
+// responses (no-cache, max-age). As required for a shared cache by RFC 7234 section 3.2, the
+// responses to authenticated requests, with an Authorization header or a request.RemoteUser(), are
+// only stored when their Cache-Control explicitly allows it (public, s-maxage, must-revalidate).
+// Per route TTLs can be configured by wrapping the routes with
+// their own CacheMiddleware sharing the same ResponseCache, see WrapMiddlewares.
+type CacheMiddleware struct {
+
+	// The ResponseCache where the responses are stored.
+	// Optional, defaults to a new ResponseCache with the default size.
+	Cache *ResponseCache
+
+	// Time to live of the responses that don't specify a max-age. Zero means that only the
+	// responses with a Cache-Control max-age are stored.
+	TTL time.Duration
+
+	// List of the request headers that are part of the cache key. The responses with a Vary
+	// header naming other headers are not stored, eg: "Accept-Encoding" must be in this list for
+	// the responses of a wrapped GzipMiddleware to be stored.
+	VaryHeaders []string
+
+	// Maximum size in bytes of a stored payload. Defaults to 1MB.
+	MaxEntrySize int
+}
+
+const defaultCacheMaxEntrySize = 1 << 20
+
+// MiddlewareFunc makes CacheMiddleware implement the Middleware interface.
+func (mw *CacheMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
+
+	if mw.Cache == nil {
+		mw.Cache = NewResponseCache(0)
+	}
+
+	if mw.MaxEntrySize <= 0 {
+		mw.MaxEntrySize = defaultCacheMaxEntrySize
+	}
+
+	return func(w ResponseWriter, r *Request) {
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			h(w, r)
+			return
+		}
+
+		clientControl := parseCacheControl(r.Header.Get("Cache-Control"))
+		if _, ok := clientControl["no-store"]; ok {
+			h(w, r)
+			return
+		}
+
+		key := mw.cacheKey(r)
+
+		_, noCache := clientControl["no-cache"]
+		if r.Header.Get("Pragma") == "no-cache" {
+			noCache = true
+		}
+		maxAge := time.Duration(-1)
+		if seconds, err := strconv.Atoi(clientControl["max-age"]); err == nil {
+			maxAge = time.Duration(seconds) * time.Second
+		}
+
+		if !noCache {
+			if mw.serveFromCache(w, key, maxAge) {
+				return
+			}
+
+			call, isFirst := mw.Cache.acquire(key)
+			if !isFirst {
+				// wait for the concurrent request, and use its response if stored
+				<-call.done
+				if mw.serveFromCache(w, key, maxAge) {
+					return
+				}
+			} else {
+				defer mw.Cache.release(key, call)
+			}
+		}
+
+		if r.Method == "HEAD" {
+			// HEAD responses are served from the GET responses, but not stored
+			h(w, r)
+			return
+		}
+
+		preHeader := cloneHeader(w.Header())
+		writer := &cacheResponseWriter{w, false, 0, nil, &bytes.Buffer{}, true, mw.MaxEntrySize}
+
+		// call the handler
+		h(writer, r)
+
+		if !writer.cacheable || !writer.wroteHeader {
+			return
+		}
+
+		_, hasRemoteUser := r.RemoteUser()
+		authenticated := r.Header.Get("Authorization") != "" || hasRemoteUser
+
+		ttl := mw.responseTTL(writer.statusCode, writer.header, authenticated)
+		if ttl <= 0 {
+			return
+		}
+
+		// only store the headers set by the wrapped handlers
+		header := http.Header{}
+		for name, values := range writer.header {
+			if !reflect.DeepEqual(preHeader[name], values) {
+				header[name] = values
+			}
+		}
+
+		now := time.Now()
+		mw.Cache.set(&cacheEntry{
+			key:        key,
+			path:       r.URL.Path,
+			statusCode: writer.statusCode,
+			header:     header,
+			body:       writer.buffer.Bytes(),
+			stored:     now,
+			expires:    now.Add(ttl),
+		})
+	}
+}
+
+// Write the stored response if it exists, and is fresh enough for the client.
+func (mw *CacheMiddleware) serveFromCache(w ResponseWriter, key string, maxAge time.Duration) bool {
+	now := time.Now()
+	entry := mw.Cache.get(key, now)
+	if entry == nil {
+		return false
+	}
+	age := now.Sub(entry.stored)
+	if maxAge >= 0 && age > maxAge {
+		return false
+	}
+
+	// copy the values, the stored header must not be modified by the outer middlewares
+	for name, values := range entry.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	w.WriteHeader(entry.statusCode)
+	writer := w.(http.ResponseWriter)
+	writer.Write(entry.body)
+	return true
+}
+
+// Method, path, sorted query string, and Vary header values.
+func (mw *CacheMiddleware) cacheKey(r *Request) string {
+	key := "GET " + r.URL.Path + "?" + r.URL.Query().Encode()
+	for _, name := range mw.VaryHeaders {
+		key += "\n" + http.CanonicalHeaderKey(name) + ": " + strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+	}
+	return key
+}
+
+// The status codes that are cacheable by default, RFC 7231 section 6.1.
+var cacheableStatusCodes = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Return the TTL of the response, or zero if it must not be stored. The responses to
+// authenticated requests must explicitly allow the storage.
+func (mw *CacheMiddleware) responseTTL(statusCode int, header http.Header, authenticated bool) time.Duration {
+
+	if !cacheableStatusCodes[statusCode] {
+		return 0
+	}
+	if header.Get("Set-Cookie") != "" || !mw.coversVary(header) {
+		return 0
+	}
+
+	control := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := control[directive]; ok {
+			return 0
+		}
+	}
+	if authenticated {
+		allowed := false
+		for _, directive := range []string{"public", "s-maxage", "must-revalidate"} {
+			if _, ok := control[directive]; ok {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return 0
+		}
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := control[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return mw.TTL
+}
+
+// Return true if the headers named by the Vary response header are all part of the cache key.
+func (mw *CacheMiddleware) coversVary(header http.Header) bool {
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			covered := false
+			for _, varyHeader := range mw.VaryHeaders {
+				if strings.EqualFold(varyHeader, name) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Parse the Cache-Control header into a map of directives to values.
+func parseCacheControl(value string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		nameValue := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(nameValue[0]))
+		if len(nameValue) == 2 {
+			directives[name] = strings.Trim(strings.TrimSpace(nameValue[1]), "\"")
+		} else {
+			directives[name] = ""
+		}
+	}
+	return directives
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := http.Header{}
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
+// Private responseWriter intantiated by the cache middleware.
+// It keeps a copy of the status code, the headers and the payload.
+// It implements the following interfaces:
+// ResponseWriter
+// http.ResponseWriter
+// http.Flusher
+// http.CloseNotifier
+// http.Hijacker
+type cacheResponseWriter struct {
+	ResponseWriter
+	wroteHeader  bool
+	statusCode   int
+	header       http.Header
+	buffer       *bytes.Buffer
+	cacheable    bool
+	maxEntrySize int
+}
+
+// Record the status code and the headers, and call the parent WriteHeader. The headers are
+// recorded before the parent WriteHeader, that of the wrapping middlewares, is called.
+func (w *cacheResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.statusCode = code
+		w.header = cloneHeader(w.Header())
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Make sure the local Write is called.
+func (w *cacheResponseWriter) WriteJson(v interface{}) error {
+	b, err := w.EncodeJson(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Streamed responses are not stored. Call the parent Flush.
+// Provided in order to implement the http.Flusher interface.
+func (w *cacheResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.cacheable = false
+	flusher := w.ResponseWriter.(http.Flusher)
+	flusher.Flush()
+}
+
+// Call the parent CloseNotify.
+// Provided in order to implement the http.CloseNotifier interface.
+func (w *cacheResponseWriter) CloseNotify() <-chan bool {
+	notifier := w.ResponseWriter.(http.CloseNotifier)
+	return notifier.CloseNotify()
+}
+
+// Hijacked connections are not stored.
+// Provided in order to implement the http.Hijacker interface.
+func (w *cacheResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.cacheable = false
+	hijacker := w.ResponseWriter.(http.Hijacker)
+	return hijacker.Hijack()
+}
+
+// Make sure the local WriteHeader is called, keep a copy of the payload, and call the parent
+// Write. Provided in order to implement the http.ResponseWriter interface.
+func (w *cacheResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.cacheable {
+		if w.buffer.Len()+len(b) > w.maxEntrySize {
+			w.cacheable = false
+		} else {
+			w.buffer.Write(b)
+		}
+	}
+	writer := w.ResponseWriter.(http.ResponseWriter)
+	return writer.Write(b)
+}
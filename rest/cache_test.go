@@ -0,0 +1,309 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheMiddleware(t *testing.T) {
+
+	cache := NewResponseCache(0)
+	count := 0
+
+	api := NewApi()
+	api.Use(&PoweredByMiddleware{})
+	api.Use(&CacheMiddleware{
+		Cache: cache,
+		TTL:   time.Minute,
+	})
+
+	router, err := MakeRouter(
+		Get("/r", func(w ResponseWriter, r *Request) {
+			count++
+			w.Header().Set("X-Count", fmt.Sprintf("%d", count))
+			w.WriteJson(map[string]int{"Count": count})
+		}),
+		Get("/nostore", func(w ResponseWriter, r *Request) {
+			count++
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteJson(map[string]int{"Count": count})
+		}),
+		Get("/error", func(w ResponseWriter, r *Request) {
+			count++
+			Error(w, "not stored", 500)
+		}),
+		Post("/r", func(w ResponseWriter, r *Request) {
+			cache.Invalidate("/r")
+			w.WriteJson(map[string]string{"Status": "ok"})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/r", nil))
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Count":1}`)
+
+	// served from the cache, with the handler headers
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/r", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.HeaderIs("X-Count", "1")
+	recorded.HeaderIs("Age", "0")
+	recorded.BodyIs(`{"Count":1}`)
+	if len(recorded.Recorder.Header()["X-Powered-By"]) != 1 {
+		t.Errorf("One X-Powered-By header expected, got: %v", recorded.Recorder.Header()["X-Powered-By"])
+	}
+
+	// different query string
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/r?a=1", nil))
+	recorded.BodyIs(`{"Count":2}`)
+
+	// client bypass
+	req := test.MakeSimpleRequest("GET", "http://localhost/r", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.BodyIs(`{"Count":3}`)
+
+	// the response has been stored again
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/r", nil))
+	recorded.BodyIs(`{"Count":3}`)
+
+	// invalidated by the write
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/r", nil))
+	recorded.CodeIs(200)
+	if cache.Len() != 0 {
+		t.Errorf("Empty cache expected, got %d entries", cache.Len())
+	}
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/r", nil))
+	recorded.BodyIs(`{"Count":4}`)
+
+	// handler Cache-Control and status codes
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/nostore", nil))
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/nostore", nil))
+	recorded.BodyIs(`{"Count":6}`)
+
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/error", nil))
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/error", nil))
+	if count != 8 {
+		t.Errorf("8 handler calls expected, got: %d", count)
+	}
+}
+
+func TestCacheMiddlewareAuthenticated(t *testing.T) {
+
+	cache := NewResponseCache(0)
+	count := 0
+	servedCount := ""
+
+	api := NewApi()
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			handler(w, r)
+			// modify the served header in place, must not affect the stored response
+			if values := w.Header()["X-Count"]; len(values) > 0 {
+				servedCount = values[0]
+				values[0] = "modified"
+			}
+		}
+	}))
+	api.Use(&CacheMiddleware{
+		Cache: cache,
+		TTL:   time.Minute,
+	})
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			if user := r.Header.Get("X-User"); user != "" {
+				r.SetRemoteUser(user)
+			}
+			handler(w, r)
+		}
+	}))
+
+	router, err := MakeRouter(
+		Get("/private", func(w ResponseWriter, r *Request) {
+			count++
+			w.Header().Set("X-Count", fmt.Sprintf("%d", count))
+			w.WriteJson(map[string]int{"Count": count})
+		}),
+		Get("/public", func(w ResponseWriter, r *Request) {
+			count++
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Header().Set("X-Count", fmt.Sprintf("%d", count))
+			w.WriteJson(map[string]int{"Count": count})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	// Authorization header, not stored
+	req := test.MakeSimpleRequest("GET", "http://localhost/private", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	test.RunRequest(t, handler, req).BodyIs(`{"Count":1}`)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/private", nil)).BodyIs(`{"Count":2}`)
+
+	// RemoteUser set by a wrapped middleware, not stored
+	cache.Purge()
+	req = test.MakeSimpleRequest("GET", "http://localhost/private", nil)
+	req.Header.Set("X-User", "alice")
+	test.RunRequest(t, handler, req).BodyIs(`{"Count":3}`)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/private", nil)).BodyIs(`{"Count":4}`)
+
+	// explicitly public, stored
+	req = test.MakeSimpleRequest("GET", "http://localhost/public", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	test.RunRequest(t, handler, req).BodyIs(`{"Count":5}`)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/public", nil)).BodyIs(`{"Count":5}`)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/public", nil)).BodyIs(`{"Count":5}`)
+	if servedCount != "5" {
+		t.Errorf("Stored X-Count 5 expected, got: %s", servedCount)
+	}
+}
+
+func TestCacheMiddlewareVary(t *testing.T) {
+
+	for _, varyHeaders := range [][]string{nil, {"Accept-Encoding"}} {
+
+		cache := NewResponseCache(0)
+		count := 0
+
+		api := NewApi()
+		api.Use(&CacheMiddleware{
+			Cache:       cache,
+			TTL:         time.Minute,
+			VaryHeaders: varyHeaders,
+		})
+		api.Use(&GzipMiddleware{})
+		api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+			count++
+			w.WriteJson(map[string]int{"Count": count})
+		}))
+		handler := api.MakeHandler()
+
+		gzipped := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+		gzipped.ContentEncodingIsGzip()
+
+		// a client that does not accept gzip never gets the gzipped response
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Del("Accept-Encoding")
+		plain := test.RunRequest(t, handler, req)
+		plain.HeaderIs("Content-Encoding", "")
+		plain.BodyIs(`{"Count":2}`)
+
+		if varyHeaders == nil {
+			if cache.Len() != 0 {
+				t.Errorf("Vary: Accept-Encoding not covered, no entry expected, got %d", cache.Len())
+			}
+			continue
+		}
+
+		// stored per encoding
+		if cache.Len() != 2 {
+			t.Errorf("2 entries expected, got %d", cache.Len())
+		}
+		plain = test.RunRequest(t, handler, req)
+		plain.HeaderIs("Content-Encoding", "")
+		plain.BodyIs(`{"Count":2}`)
+		gzipped = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+		gzipped.ContentEncodingIsGzip()
+		body, err := gzipped.DecodedBody()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `{"Count":1}` {
+			t.Errorf("Stored gzipped response expected, got %s", body)
+		}
+	}
+}
+
+func TestCacheMiddlewarePerRouteTTLAndEviction(t *testing.T) {
+
+	cache := NewResponseCache(50)
+
+	api := NewApi()
+	router, err := MakeRouter(
+		Get("/short", WrapMiddlewares(
+			[]Middleware{&CacheMiddleware{Cache: cache, TTL: time.Millisecond}},
+			func(w ResponseWriter, r *Request) {
+				w.WriteJson(time.Now().UnixNano())
+			},
+		)),
+		Get("/long/:id", WrapMiddlewares(
+			[]Middleware{&CacheMiddleware{Cache: cache, TTL: time.Hour}},
+			func(w ResponseWriter, r *Request) {
+				w.WriteJson(map[string]string{"Id": r.PathParam("id")})
+			},
+		)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/short", nil))
+	first, _ := recorded.DecodedBody()
+	time.Sleep(5 * time.Millisecond)
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/short", nil))
+	second, _ := recorded.DecodedBody()
+	if string(first) == string(second) {
+		t.Error("Expired response expected to be refreshed")
+	}
+
+	// each entry is about 22 bytes, the oldest ones are evicted
+	for i := 0; i < 5; i++ {
+		test.RunRequest(t, handler, test.MakeSimpleRequest("GET", fmt.Sprintf("http://localhost/long/%d", i), nil))
+	}
+	if cache.Len() > 2 {
+		t.Errorf("At most 2 entries expected, got: %d", cache.Len())
+	}
+
+	cache.InvalidatePrefix("/long/")
+	if cache.Len() != 0 {
+		t.Errorf("Empty cache expected, got %d entries", cache.Len())
+	}
+}
+
+func TestCacheMiddlewareCoalescing(t *testing.T) {
+
+	var count int32
+	release := make(chan struct{})
+
+	api := NewApi()
+	api.Use(&CacheMiddleware{TTL: time.Minute})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		atomic.AddInt32(&count, 1)
+		<-release
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+			recorded.CodeIs(200)
+			recorded.BodyIs(`{"Id":"123"}`)
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&count) != 1 {
+		t.Errorf("One handler call expected, got: %d", count)
+	}
+}
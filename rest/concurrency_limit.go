@@ -0,0 +1,188 @@
+package rest
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimitMiddleware caps the number of requests executed concurrently by the wrapped
+// handler. The requests over the limit wait in a bounded queue, and when the queue is full or the
+// QueueTimeout is reached, a StatusServiceUnavailable (503) HTTP error response is returned, with a
+// Retry-After header.
+//
+// In adaptive mode, the limit is lowered when the latency of the requests exceeds LatencyTarget,
+// and slowly raised back to MaxInFlight when it does not. The latency is read from
+// request.ElapsedTime(), or computed from request.StartTime(), as set by the TimerMiddleware.
+// Without it, the latency is measured by this middleware.
+//
+// A per Route limit can be set by wrapping the Route handler, post routing, see WrapMiddlewares.
+type ConcurrencyLimitMiddleware struct {
+
+	// Maximum number of requests executed concurrently. Required.
+	MaxInFlight int
+
+	// Maximum number of requests waiting for a slot. Optional, defaults to MaxInFlight.
+	// Set a negative value to disable the queue.
+	MaxQueue int
+
+	// Maximum time spent waiting in the queue. Optional, defaults to 1 second.
+	QueueTimeout time.Duration
+
+	// Value of the Retry-After header of the shed requests. Optional, defaults to 1 second.
+	RetryAfter time.Duration
+
+	// Enables the adaptive limit, when set. Optional.
+	LatencyTarget time.Duration
+
+	// Lower bound of the adaptive limit. Optional, defaults to 1.
+	MinInFlight int
+
+	lock         sync.Mutex
+	limit        float64
+	inFlight     int
+	waiters      []chan struct{}
+	lastDecrease time.Time
+}
+
+// MiddlewareFunc makes ConcurrencyLimitMiddleware implement the Middleware interface.
+func (mw *ConcurrencyLimitMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.MaxInFlight <= 0 {
+		log.Fatal("MaxInFlight is required")
+	}
+	if mw.MaxQueue == 0 {
+		mw.MaxQueue = mw.MaxInFlight
+	}
+	if mw.QueueTimeout <= 0 {
+		mw.QueueTimeout = time.Second
+	}
+	if mw.RetryAfter <= 0 {
+		mw.RetryAfter = time.Second
+	}
+	if mw.MinInFlight <= 0 {
+		mw.MinInFlight = 1
+	}
+	mw.limit = float64(mw.MaxInFlight)
+
+	retryAfter := strconv.Itoa(ceilSeconds(mw.RetryAfter))
+
+	return func(writer ResponseWriter, request *Request) {
+
+		if !mw.acquire(request) {
+			writer.Header().Set("Retry-After", retryAfter)
+			Error(writer, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		start := time.Now()
+		defer func() {
+			mw.release(mw.latency(request, start))
+		}()
+
+		handler(writer, request)
+	}
+}
+
+// Limit returns the current limit, lower than MaxInFlight when the adaptive mode sheds load.
+func (mw *ConcurrencyLimitMiddleware) Limit() int {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	return int(mw.limit)
+}
+
+// InFlight returns the number of requests currently executed.
+func (mw *ConcurrencyLimitMiddleware) InFlight() int {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	return mw.inFlight
+}
+
+// acquire returns false if the request must be shed.
+func (mw *ConcurrencyLimitMiddleware) acquire(request *Request) bool {
+
+	mw.lock.Lock()
+	if mw.inFlight < int(mw.limit) {
+		mw.inFlight++
+		mw.lock.Unlock()
+		return true
+	}
+	if len(mw.waiters) >= mw.MaxQueue {
+		mw.lock.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	mw.waiters = append(mw.waiters, ready)
+	mw.lock.Unlock()
+
+	timer := time.NewTimer(mw.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-request.Context().Done():
+	}
+
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+	for i, waiter := range mw.waiters {
+		if waiter == ready {
+			mw.waiters = append(mw.waiters[:i], mw.waiters[i+1:]...)
+			return false
+		}
+	}
+	// the slot has been handed over in the meantime, give it back.
+	mw.releaseLocked()
+	return false
+}
+
+func (mw *ConcurrencyLimitMiddleware) release(latency time.Duration) {
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+
+	if mw.LatencyTarget > 0 {
+		now := time.Now()
+		if latency > mw.LatencyTarget {
+			// multiplicative decrease, at most once per LatencyTarget
+			if now.Sub(mw.lastDecrease) > mw.LatencyTarget {
+				mw.limit *= 0.9
+				if mw.limit < float64(mw.MinInFlight) {
+					mw.limit = float64(mw.MinInFlight)
+				}
+				mw.lastDecrease = now
+			}
+		} else {
+			// additive increase, about one per limit requests
+			mw.limit += 1 / mw.limit
+			if mw.limit > float64(mw.MaxInFlight) {
+				mw.limit = float64(mw.MaxInFlight)
+			}
+		}
+	}
+
+	mw.releaseLocked()
+}
+
+// releaseLocked frees a slot, or hands it over to the first waiter.
+func (mw *ConcurrencyLimitMiddleware) releaseLocked() {
+	if len(mw.waiters) > 0 && mw.inFlight <= int(mw.limit) {
+		close(mw.waiters[0])
+		mw.waiters = mw.waiters[1:]
+		return
+	}
+	mw.inFlight--
+}
+
+func (mw *ConcurrencyLimitMiddleware) latency(request *Request, start time.Time) time.Duration {
+	if elapsedTime, ok := request.ElapsedTime(); ok {
+		return elapsedTime
+	}
+	if startTime, ok := request.StartTime(); ok {
+		return time.Since(startTime)
+	}
+	return time.Since(start)
+}
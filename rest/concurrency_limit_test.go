@@ -0,0 +1,161 @@
+package rest
+
+import (
+	"context"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitQueued blocks until n requests are waiting for a slot.
+func waitQueued(limiter *ConcurrencyLimitMiddleware, n int) {
+	for {
+		limiter.lock.Lock()
+		queued := len(limiter.waiters)
+		limiter.lock.Unlock()
+		if queued == n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+
+	started := make(chan bool, 10)
+	unblock := make(chan bool)
+
+	limiter := &ConcurrencyLimitMiddleware{
+		MaxInFlight:  1,
+		MaxQueue:     1,
+		QueueTimeout: time.Hour,
+	}
+
+	api := NewApi()
+	api.Use(limiter)
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		started <- true
+		if r.URL.Path == "/block" {
+			<-unblock
+		}
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// occupies the only slot
+	blocked := make(chan *test.Recorded)
+	go func() {
+		blocked <- test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/block", nil))
+	}()
+	<-started
+
+	// queued, then canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan *test.Recorded)
+	go func() {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		queued <- test.RunRequest(t, handler, req.WithContext(ctx))
+	}()
+	waitQueued(limiter, 1)
+
+	// queue full, shed immediately
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(503)
+	recorded.ContentTypeIsJson()
+	recorded.HeaderIs("Retry-After", "1")
+
+	cancel()
+	recorded = <-queued
+	recorded.CodeIs(503)
+
+	// queued, then executed when the slot is released
+	go func() {
+		queued <- test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	}()
+	waitQueued(limiter, 1)
+	unblock <- true
+	(<-blocked).CodeIs(200)
+	(<-queued).CodeIs(200)
+
+	if limiter.InFlight() != 0 {
+		t.Errorf("No request expected in flight, got %d", limiter.InFlight())
+	}
+}
+
+func TestConcurrencyLimitMiddlewareQueueTimeout(t *testing.T) {
+
+	started := make(chan bool)
+	unblock := make(chan bool)
+
+	limiter := &ConcurrencyLimitMiddleware{
+		MaxInFlight:  1,
+		QueueTimeout: 20 * time.Millisecond,
+	}
+
+	api := NewApi()
+	api.Use(limiter)
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		started <- true
+		<-unblock
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	blocked := make(chan *test.Recorded)
+	go func() {
+		blocked <- test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	}()
+	<-started
+
+	start := time.Now()
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(503)
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("The queued request is expected to wait for QueueTimeout")
+	}
+
+	unblock <- true
+	(<-blocked).CodeIs(200)
+}
+
+func TestConcurrencyLimitMiddlewareAdaptive(t *testing.T) {
+
+	limiter := &ConcurrencyLimitMiddleware{
+		MaxInFlight:   10,
+		LatencyTarget: time.Millisecond,
+		MinInFlight:   2,
+	}
+
+	// the latency is reported as the elapsed time, instead of being measured
+	latency := 10 * time.Millisecond
+	api := NewApi()
+	api.Use(limiter)
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			handler(w, r)
+			r.SetElapsedTime(latency)
+		}
+	}))
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// the decreases are limited to one per LatencyTarget
+	deadline := time.Now().Add(10 * time.Second)
+	for limiter.Limit() > 2 && time.Now().Before(deadline) {
+		test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil)).CodeIs(200)
+	}
+	if limiter.Limit() != 2 {
+		t.Errorf("Limit expected to be lowered to MinInFlight, got %d", limiter.Limit())
+	}
+
+	latency = 0
+	for i := 0; i < 200; i++ {
+		test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil)).CodeIs(200)
+	}
+	if limiter.Limit() != 10 {
+		t.Errorf("Limit expected to be raised back to MaxInFlight, got %d", limiter.Limit())
+	}
+}
@@ -0,0 +1,578 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EntityEncoder defines the interface that objects must implement in order to be registered in
+// the ContentNegotiationMiddleware.
+type EntityEncoder interface {
+
+	// ContentType returns the value of the Content-Type response header,
+	// eg: "application/xml; charset=utf-8". Its media type is matched against the Accept header.
+	ContentType() string
+
+	// Encode returns the encoded representation of v.
+	Encode(v interface{}) ([]byte, error)
+}
+
+// EntityDecoder defines the interface that the EntityEncoders implement when they can also decode
+// the request payloads of their media type, see ContentNegotiationMiddleware.
+type EntityDecoder interface {
+
+	// Decode decodes the payload into v.
+	Decode(data []byte, v interface{}) error
+}
+
+// ContentNegotiationMiddleware selects, based on the Accept request header, the EntityEncoder used
+// to serialize the data structures passed to WriteJson, and sets the matching Content-Type.
+// A StatusNotAcceptable (406) HTTP error response is returned if no encoder fits.
+// The selected media type is available to the wrapped handlers as
+// request.Env["NEGOTIATED_MEDIA_TYPE"].(string).
+// This middleware replaces EncodeJson, it must be wrapped by JsonIndentMiddleware and
+// JsonpMiddleware, if used, for their JSON output to be preserved.
+// When the request Content-Type matches an encoder that is also an EntityDecoder, eg:
+// XmlEntityEncoder, request.DecodeJsonPayload decodes the payload with it. The media types that
+// can be decoded are returned by RequestMediaTypes, to configure ContentTypeCheckerMiddleware.
+type ContentNegotiationMiddleware struct {
+
+	// List of the available encoders, in order of preference. The first one is used when the
+	// request does not specify a preference.
+	// Optional, defaults to JsonEntityEncoder and XmlEntityEncoder.
+	Encoders []EntityEncoder
+
+	mediaTypes []string
+}
+
+// MiddlewareFunc makes ContentNegotiationMiddleware implement the Middleware interface.
+func (mw *ContentNegotiationMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if len(mw.Encoders) == 0 {
+		mw.Encoders = defaultEntityEncoders()
+	}
+
+	// precompute the media types at init time
+	mw.mediaTypes = []string{}
+	for _, encoder := range mw.Encoders {
+		mediaType, _, err := mime.ParseMediaType(encoder.ContentType())
+		if err != nil {
+			log.Fatalf("ContentNegotiationMiddleware: invalid Content-Type %s", encoder.ContentType())
+		}
+		mw.mediaTypes = append(mw.mediaTypes, mediaType)
+	}
+
+	return func(w ResponseWriter, r *Request) {
+
+		w.Header().Add("Vary", "Accept")
+
+		index := mw.selectEncoder(r.Header.Get("Accept"))
+		if index < 0 {
+			Error(w, "Not Acceptable", http.StatusNotAcceptable)
+			return
+		}
+
+		r.Env["NEGOTIATED_MEDIA_TYPE"] = mw.mediaTypes[index]
+
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+			for i, encoderMediaType := range mw.mediaTypes {
+				if encoderMediaType == mediaType {
+					if decoder, ok := mw.Encoders[i].(EntityDecoder); ok {
+						r.decoder = decoder
+					}
+					break
+				}
+			}
+		}
+
+		writer := &negotiatedResponseWriter{w, false, mw.Encoders[index]}
+		// call the wrapped handler
+		handler(writer, r)
+	}
+}
+
+// MediaTypes returns the media types of the registered encoders. Only available once the
+// middleware has been initialized by the Api.
+func (mw *ContentNegotiationMiddleware) MediaTypes() []string {
+	return mw.mediaTypes
+}
+
+// RequestMediaTypes returns the media types of the request payloads that can be decoded:
+// "application/json" and the media types of the encoders that are also EntityDecoders.
+// Convenient to configure ContentTypeCheckerMiddleware.AcceptedMediaTypes.
+func (mw *ContentNegotiationMiddleware) RequestMediaTypes() []string {
+	encoders := mw.Encoders
+	if len(encoders) == 0 {
+		encoders = defaultEntityEncoders()
+	}
+	mediaTypes := []string{"application/json"}
+	for _, encoder := range encoders {
+		if _, ok := encoder.(EntityDecoder); !ok {
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(encoder.ContentType())
+		if err == nil && mediaType != "application/json" {
+			mediaTypes = append(mediaTypes, mediaType)
+		}
+	}
+	return mediaTypes
+}
+
+func defaultEntityEncoders() []EntityEncoder {
+	return []EntityEncoder{
+		&JsonEntityEncoder{},
+		&XmlEntityEncoder{},
+	}
+}
+
+// Return the index of the encoder that best matches the Accept header, or -1.
+func (mw *ContentNegotiationMiddleware) selectEncoder(accept string) int {
+
+	ranges := parseAcceptHeader(accept)
+	if len(ranges) == 0 {
+		return 0
+	}
+
+	bestIndex := -1
+	bestQuality := 0.0
+	for i, mediaType := range mw.mediaTypes {
+		quality := acceptQuality(ranges, mediaType)
+		if quality > bestQuality {
+			bestIndex = i
+			bestQuality = quality
+		}
+	}
+	return bestIndex
+}
+
+// A media range of the Accept header, as defined in RFC 7231 section 5.3.2.
+type acceptRange struct {
+	mediaType string
+	quality   float64
+}
+
+func parseAcceptHeader(accept string) []acceptRange {
+	ranges := []acceptRange{}
+	for _, part := range strings.Split(accept, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, quality})
+	}
+	return ranges
+}
+
+// Return the quality of the most specific range matching the media type, 0 if none matches.
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	bestSpecificity := -1
+	quality := 0.0
+	for _, r := range ranges {
+		specificity := -1
+		if r.mediaType == mediaType {
+			specificity = 2
+		} else if r.mediaType == "*/*" {
+			specificity = 0
+		} else if strings.HasSuffix(r.mediaType, "/*") &&
+			strings.HasPrefix(mediaType, strings.TrimSuffix(r.mediaType, "*")) {
+			specificity = 1
+		}
+		if specificity > bestSpecificity {
+			bestSpecificity = specificity
+			quality = r.quality
+		}
+	}
+	return quality
+}
+
+// Private responseWriter intantiated by the content negotiation middleware.
+// It encodes the payload with the selected encoder and set the proper headers.
+// It implements the following interfaces:
+// ResponseWriter
+// http.ResponseWriter
+// http.Flusher
+// http.CloseNotifier
+// http.Hijacker
+type negotiatedResponseWriter struct {
+	ResponseWriter
+	wroteHeader bool
+	encoder     EntityEncoder
+}
+
+// Set the Content-Type of the selected encoder, unless already specified.
+func (w *negotiatedResponseWriter) WriteHeader(code int) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", w.encoder.ContentType())
+	}
+	w.ResponseWriter.WriteHeader(code)
+	w.wroteHeader = true
+}
+
+// Replace the parent EncodeJson with the selected encoder. The JSON encoding is left to the parent
+// in order to use the JsonCodec of the Api, and the wrapped JSON related middlewares.
+func (w *negotiatedResponseWriter) EncodeJson(v interface{}) ([]byte, error) {
+	if _, ok := w.encoder.(*JsonEntityEncoder); ok {
+		return w.ResponseWriter.EncodeJson(v)
+	}
+	return w.encoder.Encode(v)
+}
+
+// Make sure the local EncodeJson and local Write are called.
+// Does not call the parent WriteJson.
+func (w *negotiatedResponseWriter) WriteJson(v interface{}) error {
+	b, err := w.EncodeJson(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Make sure the local WriteHeader is called, and call the parent Flush.
+// Provided in order to implement the http.Flusher interface.
+func (w *negotiatedResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flusher := w.ResponseWriter.(http.Flusher)
+	flusher.Flush()
+}
+
+// Call the parent CloseNotify.
+// Provided in order to implement the http.CloseNotifier interface.
+func (w *negotiatedResponseWriter) CloseNotify() <-chan bool {
+	notifier := w.ResponseWriter.(http.CloseNotifier)
+	return notifier.CloseNotify()
+}
+
+// Provided in order to implement the http.Hijacker interface.
+func (w *negotiatedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker := w.ResponseWriter.(http.Hijacker)
+	return hijacker.Hijack()
+}
+
+// Make sure the local WriteHeader is called, and call the parent Write.
+// Provided in order to implement the http.ResponseWriter interface.
+func (w *negotiatedResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	writer := w.ResponseWriter.(http.ResponseWriter)
+	return writer.Write(b)
+}
+
+// JsonEntityEncoder produces "application/json". When selected by the ContentNegotiationMiddleware,
+// the encoding is done by the wrapped ResponseWriter, with the JsonCodec of the Api.
+type JsonEntityEncoder struct{}
+
+// ContentType makes JsonEntityEncoder implement the EntityEncoder interface.
+func (e *JsonEntityEncoder) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+// Encode makes JsonEntityEncoder implement the EntityEncoder interface.
+func (e *JsonEntityEncoder) Encode(v interface{}) ([]byte, error) {
+	return defaultJsonCodec.Marshal(v)
+}
+
+// XmlEntityEncoder produces "application/xml" with encoding/xml. Structs are encoded by
+// xml.Marshal. Maps with string keys and slices are also supported at the top level, wrapped in
+// a RootName element, with one element per key or per item. eg: the error responses
+// '<response><Error>Resource not found</Error></response>'
+// Unlike the other encoders, the element names are the ones of encoding/xml: the struct field
+// names, or their "xml" tags, the "json" tags are not used. It is also an EntityDecoder, the
+// request payloads are decoded by xml.Unmarshal.
+type XmlEntityEncoder struct {
+
+	// Name of the root element used to wrap the maps and slices. Defaults to "response".
+	RootName string
+
+	// Name of the elements used for the slice items. Defaults to "item".
+	ItemName string
+}
+
+// ContentType makes XmlEntityEncoder implement the EntityEncoder interface.
+func (e *XmlEntityEncoder) ContentType() string {
+	return "application/xml; charset=utf-8"
+}
+
+// Encode makes XmlEntityEncoder implement the EntityEncoder interface.
+func (e *XmlEntityEncoder) Encode(v interface{}) ([]byte, error) {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() == reflect.Struct {
+		return xml.Marshal(v)
+	}
+	rootName := e.RootName
+	if rootName == "" {
+		rootName = "response"
+	}
+	itemName := e.ItemName
+	if itemName == "" {
+		itemName = "item"
+	}
+	return xml.Marshal(&xmlEntity{v, rootName, itemName})
+}
+
+// Decode makes XmlEntityEncoder implement the EntityDecoder interface.
+func (e *XmlEntityEncoder) Decode(data []byte, v interface{}) error {
+	return xml.Unmarshal(data, v)
+}
+
+// Marshal maps and slices as sequences of elements.
+type xmlEntity struct {
+	v        interface{}
+	name     string
+	itemName string
+}
+
+func (x *xmlEntity) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+
+	start = xml.StartElement{Name: xml.Name{Local: x.name}}
+
+	value := reflect.ValueOf(x.v)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return e.EncodeElement("", start)
+		}
+		value = value.Elem()
+	}
+
+	switch {
+
+	case value.Kind() == reflect.Map && value.Type().Key().Kind() == reflect.String:
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		keys := value.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			item := &xmlEntity{value.MapIndex(key).Interface(), key.String(), x.itemName}
+			if err := e.Encode(item); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+
+	case (value.Kind() == reflect.Slice || value.Kind() == reflect.Array) &&
+		value.Type().Elem().Kind() != reflect.Uint8:
+		if err := e.EncodeToken(start); err != nil {
+			return err
+		}
+		for i := 0; i < value.Len(); i++ {
+			item := &xmlEntity{value.Index(i).Interface(), x.itemName, x.itemName}
+			if err := e.Encode(item); err != nil {
+				return err
+			}
+		}
+		return e.EncodeToken(start.End())
+	}
+
+	return e.EncodeElement(value.Interface(), start)
+}
+
+// CsvEntityEncoder produces "text/csv" with encoding/csv. Supported values are: [][]string,
+// slices of structs or of maps with string keys (one record per item), and single structs or
+// maps (one record). A header record is written first, with the struct field names
+// (overridden by the "csv" or "json" tags), or the sorted map keys.
+type CsvEntityEncoder struct {
+
+	// Field delimiter. Defaults to ','.
+	Comma rune
+
+	// If true, the header record is not written.
+	OmitHeader bool
+}
+
+// ContentType makes CsvEntityEncoder implement the EntityEncoder interface.
+func (e *CsvEntityEncoder) ContentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+// Encode makes CsvEntityEncoder implement the EntityEncoder interface.
+func (e *CsvEntityEncoder) Encode(v interface{}) ([]byte, error) {
+
+	records, err := csvRecords(v)
+	if err != nil {
+		return nil, err
+	}
+	if e.OmitHeader && len(records) > 0 {
+		records = records[1:]
+	}
+
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	if e.Comma != 0 {
+		writer.Comma = e.Comma
+	}
+	err = writer.WriteAll(records)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Convert the value to CSV records, the first one being the header, except for [][]string.
+func csvRecords(v interface{}) ([][]string, error) {
+
+	if records, ok := v.([][]string); ok {
+		return records, nil
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(v))
+
+	rows := []reflect.Value{}
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			rows = append(rows, reflect.Indirect(value.Index(i)))
+		}
+	case reflect.Struct, reflect.Map:
+		rows = append(rows, value)
+	default:
+		return nil, fmt.Errorf("CSV encoding of %T is not supported", v)
+	}
+
+	if len(rows) == 0 {
+		return [][]string{}, nil
+	}
+
+	switch rows[0].Kind() {
+
+	case reflect.Struct:
+		fields := entityFields(rows[0].Type(), "csv")
+		header := []string{}
+		for _, field := range fields {
+			header = append(header, field.name)
+		}
+		records := [][]string{header}
+		for _, row := range rows {
+			if row.Kind() != reflect.Struct || row.Type() != rows[0].Type() {
+				return nil, errors.New("CSV encoding requires items of the same type")
+			}
+			record := []string{}
+			for _, field := range fields {
+				record = append(record, csvField(row.FieldByIndex(field.index)))
+			}
+			records = append(records, record)
+		}
+		return records, nil
+
+	case reflect.Map:
+		keySet := map[string]bool{}
+		for _, row := range rows {
+			if row.Kind() != reflect.Map || row.Type().Key().Kind() != reflect.String {
+				return nil, errors.New("CSV encoding requires maps with string keys")
+			}
+			for _, key := range row.MapKeys() {
+				keySet[key.String()] = true
+			}
+		}
+		header := []string{}
+		for key := range keySet {
+			header = append(header, key)
+		}
+		sort.Strings(header)
+		records := [][]string{header}
+		for _, row := range rows {
+			record := []string{}
+			for _, key := range header {
+				fieldValue := row.MapIndex(reflect.ValueOf(key).Convert(row.Type().Key()))
+				record = append(record, csvField(fieldValue))
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	return nil, fmt.Errorf("CSV encoding of %T is not supported", v)
+}
+
+// Format one CSV field, empty for nil and invalid values.
+func csvField(value reflect.Value) string {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// An exported struct field, with the name used by the encoders.
+type entityField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// Return the exported fields of the struct type, named after the tag (eg: "csv"), then the "json"
+// tag, then the field name. The fields tagged "-" are skipped, the embedded structs are flattened.
+func entityFields(structType reflect.Type, tagName string) []entityField {
+	fields := []entityField{}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+
+		tag, ok := field.Tag.Lookup(tagName)
+		if !ok {
+			tag = field.Tag.Get("json")
+		}
+		if tag == "-" {
+			continue
+		}
+		options := strings.Split(tag, ",")
+		name := options[0]
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for _, embedded := range entityFields(field.Type, tagName) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		omitEmpty := false
+		for _, option := range options[1:] {
+			if option == "omitempty" {
+				omitEmpty = true
+			}
+		}
+		fields = append(fields, entityField{name, []int{i}, omitEmpty})
+	}
+	return fields
+}
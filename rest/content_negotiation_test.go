@@ -0,0 +1,192 @@
+package rest
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type negotiationTestUser struct {
+	Id   string `json:"id"`
+	Name string
+}
+
+func makeNegotiationTestHandler(t *testing.T, mw *ContentNegotiationMiddleware) *Api {
+
+	api := NewApi()
+	api.Use(mw)
+
+	router, err := MakeRouter(
+		Get("/user", func(w ResponseWriter, r *Request) {
+			w.WriteJson(&negotiationTestUser{Id: "123", Name: "Antoine"})
+		}),
+		Get("/users", func(w ResponseWriter, r *Request) {
+			w.WriteJson([]negotiationTestUser{
+				{Id: "123", Name: "Antoine"},
+				{Id: "456", Name: "Bob, Jr."},
+			})
+		}),
+		Get("/error", func(w ResponseWriter, r *Request) {
+			Error(w, "Negotiated error", 500)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	return api
+}
+
+func TestContentNegotiationDefaultEncoders(t *testing.T) {
+
+	handler := makeNegotiationTestHandler(t, &ContentNegotiationMiddleware{}).MakeHandler()
+
+	// no Accept header, the first encoder is used
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/user", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.HeaderIs("Vary", "Accept")
+	recorded.BodyIs(`{"id":"123","Name":"Antoine"}`)
+
+	// XML preferred
+	req := test.MakeSimpleRequest("GET", "http://localhost/user", nil)
+	req.Header.Set("Accept", "application/json;q=0.5, application/xml")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Content-Type", "application/xml; charset=utf-8")
+	recorded.BodyIs(`<negotiationTestUser><Id>123</Id><Name>Antoine</Name></negotiationTestUser>`)
+
+	// XML error
+	req = test.MakeSimpleRequest("GET", "http://localhost/error", nil)
+	req.Header.Set("Accept", "application/*;q=0.2, application/xml")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(500)
+	recorded.HeaderIs("Content-Type", "application/xml; charset=utf-8")
+	recorded.BodyIs(`<response><Error>Negotiated error</Error></response>`)
+
+	// XML slice
+	req = test.MakeSimpleRequest("GET", "http://localhost/users", nil)
+	req.Header.Set("Accept", "text/html, application/xml;q=0.9, */*;q=0.8")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Content-Type", "application/xml; charset=utf-8")
+	recorded.BodyIs(`<response><item><Id>123</Id><Name>Antoine</Name></item><item><Id>456</Id><Name>Bob, Jr.</Name></item></response>`)
+
+	// wildcard
+	req = test.MakeSimpleRequest("GET", "http://localhost/user", nil)
+	req.Header.Set("Accept", "*/*")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+
+	// nothing fits
+	req = test.MakeSimpleRequest("GET", "http://localhost/user", nil)
+	req.Header.Set("Accept", "text/html, application/json;q=0")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(406)
+	recorded.ContentTypeIsJson()
+}
+
+func TestContentNegotiationCsvAndMsgpack(t *testing.T) {
+
+	api := makeNegotiationTestHandler(t, &ContentNegotiationMiddleware{
+		Encoders: []EntityEncoder{
+			&JsonEntityEncoder{},
+			&CsvEntityEncoder{},
+			&MsgpackEntityEncoder{},
+		},
+	})
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/users", nil)
+	req.Header.Set("Accept", "text/csv")
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Content-Type", "text/csv; charset=utf-8")
+	recorded.BodyIs("id,Name\n123,Antoine\n456,\"Bob, Jr.\"\n")
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/error", nil)
+	req.Header.Set("Accept", "text/csv")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(500)
+	recorded.BodyIs("Error\nNegotiated error\n")
+
+	req = test.MakeSimpleRequest("GET", "http://localhost/user", nil)
+	req.Header.Set("Accept", "application/msgpack")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Content-Type", "application/msgpack")
+	recorded.BodyIs("\x82\xa2id\xa3123\xa4Name\xa7Antoine")
+}
+
+func TestContentNegotiationWithJsonIndent(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&JsonIndentMiddleware{})
+	api.Use(&ContentNegotiationMiddleware{})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	// the JSON encoding is left to the wrapping middlewares
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs("{\n  \"Id\": \"123\"\n}")
+}
+
+func TestContentNegotiationDecoding(t *testing.T) {
+
+	negotiation := &ContentNegotiationMiddleware{
+		Encoders: []EntityEncoder{
+			&JsonEntityEncoder{},
+			&XmlEntityEncoder{},
+			&CsvEntityEncoder{},
+		},
+	}
+	mediaTypes := negotiation.RequestMediaTypes()
+	if strings.Join(mediaTypes, ",") != "application/json,application/xml" {
+		t.Errorf("Unexpected request media types: %v", mediaTypes)
+	}
+
+	api := NewApi()
+	api.Use(negotiation)
+	api.Use(&ContentTypeCheckerMiddleware{AcceptedMediaTypes: mediaTypes})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		user := negotiationTestUser{}
+		if err := r.DecodeJsonPayload(&user); err != nil {
+			Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteJson(&user)
+	}))
+	handler := api.MakeHandler()
+
+	// XML in and out, with the field names
+	body := `<negotiationTestUser><Id>123</Id><Name>Antoine</Name></negotiationTestUser>`
+	req := test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Accept", "application/xml")
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(body)
+
+	// JSON in, XML out
+	req = test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"id": "456", "Name": "Bob"})
+	req.Header.Set("Accept", "application/xml")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`<negotiationTestUser><Id>456</Id><Name>Bob</Name></negotiationTestUser>`)
+
+	// no decoder for CSV
+	req = test.MakeSimpleRequest("POST", "http://localhost/", nil)
+	body = "id,Name\n123,Antoine\n"
+	req.Body = ioutil.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "text/csv")
+	test.RunRequest(t, handler, req).CodeIs(415)
+}
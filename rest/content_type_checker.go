@@ -8,13 +8,32 @@ import (
 
 // ContentTypeCheckerMiddleware verifies the request Content-Type header and returns a
 // StatusUnsupportedMediaType (415) HTTP error response if it's incorrect. The expected
-// Content-Type is 'application/json' if the content is non-null. Note: If a charset parameter
-// exists, it MUST be UTF-8.
-type ContentTypeCheckerMiddleware struct{}
+// Content-Type is 'application/json' if the content is non-null, or one of the
+// AcceptedMediaTypes if specified. Note: If a charset parameter exists, it MUST be UTF-8.
+type ContentTypeCheckerMiddleware struct {
+
+	// List of the accepted media types, eg: ContentNegotiationMiddleware.RequestMediaTypes(), the
+	// media types that request.DecodeJsonPayload can decode. Optional, defaults to
+	// "application/json".
+	AcceptedMediaTypes []string
+}
 
 // MiddlewareFunc makes ContentTypeCheckerMiddleware implement the Middleware interface.
 func (mw *ContentTypeCheckerMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
 
+	acceptedMediaTypes := map[string]bool{}
+	for _, mediaType := range mw.AcceptedMediaTypes {
+		acceptedMediaTypes[strings.ToLower(mediaType)] = true
+	}
+	if len(acceptedMediaTypes) == 0 {
+		acceptedMediaTypes["application/json"] = true
+	}
+
+	expected := "'" + strings.Join(mw.AcceptedMediaTypes, "', '") + "'"
+	if len(mw.AcceptedMediaTypes) == 0 {
+		expected = "'application/json'"
+	}
+
 	return func(w ResponseWriter, r *Request) {
 
 		mediatype, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
@@ -25,10 +44,10 @@ func (mw *ContentTypeCheckerMiddleware) MiddlewareFunc(handler HandlerFunc) Hand
 
 		// per net/http doc, means that the length is known and non-null
 		if r.ContentLength > 0 &&
-			!(mediatype == "application/json" && strings.ToUpper(charset) == "UTF-8") {
+			!(acceptedMediaTypes[mediatype] && strings.ToUpper(charset) == "UTF-8") {
 
 			Error(w,
-				"Bad Content-Type or charset, expected 'application/json'",
+				"Bad Content-Type or charset, expected "+expected,
 				http.StatusUnsupportedMediaType,
 			)
 			return
@@ -46,3 +46,38 @@ func TestContentTypeCheckerMiddleware(t *testing.T) {
 	recorded = test.RunRequest(t, handler, req)
 	recorded.CodeIs(415)
 }
+
+func TestContentTypeCheckerMiddlewareAcceptedMediaTypes(t *testing.T) {
+
+	api := NewApi()
+
+	// the middleware to test
+	api.Use(&ContentTypeCheckerMiddleware{
+		AcceptedMediaTypes: []string{"application/json", "application/xml"},
+	})
+
+	// a simple app
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+
+	// wrap all
+	handler := api.MakeHandler()
+
+	// JSON payload
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"Id": "123"}))
+	recorded.CodeIs(200)
+
+	// XML payload
+	req := test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"Id": "123"})
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	// CSV payload, not accepted
+	req = test.MakeSimpleRequest("POST", "http://localhost/", map[string]string{"Id": "123"})
+	req.Header.Set("Content-Type", "text/csv")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(415)
+	recorded.BodyIs(`{"Error":"Bad Content-Type or charset, expected 'application/json', 'application/xml'"}`)
+}
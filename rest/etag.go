@@ -0,0 +1,256 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETagMiddleware buffers the responses, computes an ETag from the payload, and answers the
+// conditional GET and HEAD requests (If-None-Match, If-Modified-Since) with a StatusNotModified
+// (304) response. If the handler sets the ETag header, this value is used instead of the computed
+// one. Responses bigger than MaxBufferSize, or flushed by the handler, are streamed without ETag.
+// For the PUT, PATCH and DELETE requests, the preconditions (If-Match, If-Unmodified-Since,
+// If-None-Match) are evaluated against the ResourceState, and a StatusPreconditionFailed (412)
+// HTTP error response is returned if they fail.
+type ETagMiddleware struct {
+
+	// If true, weak ETags (W/"...") are generated, indicating semantic equivalence only.
+	Weak bool
+
+	// Maximum size in bytes of a buffered response. Defaults to 1MB.
+	MaxBufferSize int
+
+	// Callback function that returns the current ETag and Last-Modified time of the resource
+	// targeted by a PUT, PATCH or DELETE request. Called before the handler, an empty ETag or
+	// a zero time disable the corresponding checks. Optional, the handlers can also call
+	// CheckPreconditions themselves.
+	ResourceState func(request *Request) (etag string, lastModified time.Time)
+}
+
+const defaultETagMaxBufferSize = 1 << 20
+
+// MiddlewareFunc makes ETagMiddleware implement the Middleware interface.
+func (mw *ETagMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
+
+	if mw.MaxBufferSize <= 0 {
+		mw.MaxBufferSize = defaultETagMaxBufferSize
+	}
+
+	return func(w ResponseWriter, r *Request) {
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			switch r.Method {
+			case "PUT", "PATCH", "DELETE":
+				if mw.ResourceState != nil {
+					etag, lastModified := mw.ResourceState(r)
+					if !CheckPreconditions(w, r, etag, lastModified) {
+						return
+					}
+				}
+			}
+			h(w, r)
+			return
+		}
+
+		writer := &etagResponseWriter{w, false, 0, &bytes.Buffer{}, false, mw.MaxBufferSize}
+
+		// call the handler
+		h(writer, r)
+
+		if writer.streaming || !writer.wroteHeader {
+			return
+		}
+
+		if writer.statusCode == http.StatusOK {
+			etag := w.Header().Get("ETag")
+			if etag == "" {
+				etag = mw.computeETag(writer.buffer.Bytes())
+				w.Header().Set("ETag", etag)
+			}
+			if isNotModified(r, etag, w.Header().Get("Last-Modified")) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		writer.flushBuffer()
+	}
+}
+
+func (mw *ETagMiddleware) computeETag(payload []byte) string {
+	etag := fmt.Sprintf("\"%x\"", sha1.Sum(payload))
+	if mw.Weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// Evaluate If-None-Match, then If-Modified-Since if If-None-Match is absent.
+func isNotModified(r *Request, etag string, lastModified string) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" {
+		return etagListMatches(ifNoneMatch, etag, false)
+	}
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.After(ifModifiedSince)
+}
+
+// CheckPreconditions evaluates the If-Match, If-Unmodified-Since, and for the methods other than
+// GET and HEAD the If-None-Match request headers, against the current ETag and Last-Modified time
+// of the resource, following RFC 7232. An empty etag means that the resource does not exist, a
+// zero lastModified disables the If-Unmodified-Since check. On failure, a
+// StatusPreconditionFailed (412) HTTP error response is written and false is returned.
+func CheckPreconditions(w ResponseWriter, r *Request, etag string, lastModified time.Time) bool {
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, true) {
+			Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return false
+		}
+	} else if !lastModified.IsZero() {
+		ifUnmodifiedSince, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+		if err == nil && lastModified.Truncate(time.Second).After(ifUnmodifiedSince) {
+			Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		if ifNoneMatch != "" && etagListMatches(ifNoneMatch, etag, false) {
+			Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Return true if the comma separated list of entity tags (or "*") matches the etag, using the
+// strong or the weak comparison function.
+func etagListMatches(list string, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strong {
+			if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+				return true
+			}
+		} else if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Private responseWriter intantiated by the ETag middleware.
+// It buffers the payload until the ETag is computed.
+// It implements the following interfaces:
+// ResponseWriter
+// http.ResponseWriter
+// http.Flusher
+// http.CloseNotifier
+// http.Hijacker
+type etagResponseWriter struct {
+	ResponseWriter
+	wroteHeader   bool
+	statusCode    int
+	buffer        *bytes.Buffer
+	streaming     bool
+	maxBufferSize int
+}
+
+// Record the status code, the header is written later.
+func (w *etagResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.statusCode = code
+	w.wroteHeader = true
+}
+
+// Make sure the local Write is called.
+func (w *etagResponseWriter) WriteJson(v interface{}) error {
+	b, err := w.EncodeJson(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Stop buffering, and call the parent Flush.
+// Provided in order to implement the http.Flusher interface.
+func (w *etagResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.flushBuffer()
+	flusher := w.ResponseWriter.(http.Flusher)
+	flusher.Flush()
+}
+
+// Call the parent CloseNotify.
+// Provided in order to implement the http.CloseNotifier interface.
+func (w *etagResponseWriter) CloseNotify() <-chan bool {
+	notifier := w.ResponseWriter.(http.CloseNotifier)
+	return notifier.CloseNotify()
+}
+
+// Provided in order to implement the http.Hijacker interface.
+func (w *etagResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker := w.ResponseWriter.(http.Hijacker)
+	return hijacker.Hijack()
+}
+
+// Make sure the local WriteHeader is called, and buffer the payload, up to maxBufferSize.
+// Provided in order to implement the http.ResponseWriter interface.
+func (w *etagResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.streaming && w.buffer.Len()+len(b) > w.maxBufferSize {
+		w.flushBuffer()
+	}
+	if w.streaming {
+		writer := w.ResponseWriter.(http.ResponseWriter)
+		return writer.Write(b)
+	}
+	return w.buffer.Write(b)
+}
+
+// Write the header and the buffered payload to the parent, and switch to streaming.
+func (w *etagResponseWriter) flushBuffer() {
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	if w.buffer.Len() > 0 {
+		writer := w.ResponseWriter.(http.ResponseWriter)
+		writer.Write(w.buffer.Bytes())
+	}
+	w.buffer = nil
+}
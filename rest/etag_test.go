@@ -0,0 +1,153 @@
+package rest
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestETagMiddleware(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&ETagMiddleware{})
+
+	router, err := MakeRouter(
+		Get("/r", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+		Get("/explicit", func(w ResponseWriter, r *Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+		Get("/error", func(w ResponseWriter, r *Request) {
+			Error(w, "not cached", 500)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/r", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Id":"123"}`)
+	etag := recorded.Recorder.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) || len(etag) != 42 {
+		t.Fatalf("Strong SHA1 ETag expected, got: %s", etag)
+	}
+
+	// matching If-None-Match
+	req := test.MakeSimpleRequest("GET", "http://localhost/r", nil)
+	req.Header.Set("If-None-Match", `"other", W/`+etag)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(304)
+	recorded.HeaderIs("ETag", etag)
+	recorded.BodyIs("")
+
+	// non matching If-None-Match
+	req = test.MakeSimpleRequest("GET", "http://localhost/r", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"123"}`)
+
+	// ETag set by the handler
+	req = test.MakeSimpleRequest("GET", "http://localhost/explicit", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(304)
+
+	// no ETag on errors
+	req = test.MakeSimpleRequest("GET", "http://localhost/error", nil)
+	req.Header.Set("If-None-Match", "*")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(500)
+	recorded.HeaderIs("ETag", "")
+}
+
+func TestETagMiddlewareWeakAndStreaming(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&ETagMiddleware{
+		Weak:          true,
+		MaxBufferSize: 20,
+	})
+
+	router, err := MakeRouter(
+		Get("/small", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+		Get("/big", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+			w.WriteJson(map[string]string{"Id": "456"})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/small", nil))
+	recorded.CodeIs(200)
+	if !strings.HasPrefix(recorded.Recorder.Header().Get("ETag"), `W/"`) {
+		t.Errorf("Weak ETag expected, got: %s", recorded.Recorder.Header().Get("ETag"))
+	}
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/big", nil))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("ETag", "")
+	recorded.BodyIs(`{"Id":"123"}{"Id":"456"}`)
+}
+
+func TestETagMiddlewarePreconditions(t *testing.T) {
+
+	lastModified := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	api := NewApi()
+	api.Use(&ETagMiddleware{
+		ResourceState: func(r *Request) (string, time.Time) {
+			return `"v2"`, lastModified
+		},
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	cases := []struct {
+		header string
+		value  string
+		code   int
+	}{
+		{"If-Match", `"v2"`, 200},
+		{"If-Match", `"v1", "v2"`, 200},
+		{"If-Match", `"v1"`, 412},
+		{"If-Match", `W/"v2"`, 412},
+		{"If-Match", "*", 200},
+		{"If-Unmodified-Since", lastModified.Format(http.TimeFormat), 200},
+		{"If-Unmodified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat), 412},
+		{"If-None-Match", "*", 412},
+		{"If-None-Match", `"v1"`, 200},
+	}
+
+	for _, c := range cases {
+		req := test.MakeSimpleRequest("PUT", "http://localhost/", map[string]string{"Id": "123"})
+		req.Header.Set(c.header, c.value)
+		recorded := test.RunRequest(t, handler, req)
+		if recorded.Recorder.Code != c.code {
+			t.Errorf("%s: %s, code %d expected, got: %d", c.header, c.value, c.code, recorded.Recorder.Code)
+		}
+	}
+
+	// the preconditions are not evaluated for the other methods
+	for _, method := range []string{"POST", "OPTIONS"} {
+		req := test.MakeSimpleRequest(method, "http://localhost/", map[string]string{"Id": "123"})
+		req.Header.Set("If-Match", `"v1"`)
+		test.RunRequest(t, handler, req).CodeIs(200)
+	}
+}
@@ -2,38 +2,180 @@ package rest
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"io"
+	"log"
+	"mime"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-// GzipMiddleware is responsible for compressing the payload with gzip and setting the proper
-// headers when supported by the client. It must be wrapped by TimerMiddleware for the
-// compression time to be captured. And It must be wrapped by RecorderMiddleware for the
+// GzipMiddleware is responsible for compressing the payload with gzip, or deflate, and setting the
+// proper headers when supported by the client. The encoding is negotiated from the q-values of the
+// Accept-Encoding header. The responses that already have a Content-Encoding, that have no body,
+// or whose content type is not allowed are not compressed. It must be wrapped by TimerMiddleware
+// for the compression time to be captured. And It must be wrapped by RecorderMiddleware for the
 // compressed BYTES_WRITTEN to be captured.
-type GzipMiddleware struct{}
+type GzipMiddleware struct {
+
+	// Compression level, from gzip.BestSpeed to gzip.BestCompression, or gzip.HuffmanOnly.
+	// Optional, defaults to gzip.DefaultCompression.
+	Level int
+
+	// If true, the deflate encoding is also supported, used when preferred by the client.
+	// Optional, defaults to false.
+	EnableDeflate bool
+
+	// Minimum size of the compressed responses. The beginning of the payload is buffered until
+	// this size is reached, the smaller responses are sent uncompressed. A Flush of the response
+	// starts the compression, whatever the size. Optional, defaults to 0, all the responses are
+	// compressed.
+	MinSize int
+
+	// Media types of the compressed responses, with wildcards as in "text/*".
+	// Optional, defaults to all the media types.
+	ContentTypes []string
+
+	gzipPool  *sync.Pool
+	flatePool *sync.Pool
+}
 
 // MiddlewareFunc makes GzipMiddleware implement the Middleware interface.
 func (mw *GzipMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
+
+	if mw.Level == 0 {
+		mw.Level = gzip.DefaultCompression
+	}
+	if mw.Level < gzip.HuffmanOnly || mw.Level > gzip.BestCompression {
+		log.Fatalf("GzipMiddleware: invalid compression Level %d", mw.Level)
+	}
+
+	level := mw.Level
+	mw.gzipPool = &sync.Pool{
+		New: func() interface{} {
+			writer, _ := gzip.NewWriterLevel(nil, level)
+			return writer
+		},
+	}
+	mw.flatePool = &sync.Pool{
+		New: func() interface{} {
+			writer, _ := flate.NewWriter(nil, level)
+			return writer
+		},
+	}
+
 	return func(w ResponseWriter, r *Request) {
-		// gzip support enabled
-		canGzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
-		// client accepts gzip ?
-		writer := &gzipResponseWriter{w, false, canGzip, nil}
-		defer func() {
-			// need to close gzip writer
-			if writer.gzipWriter != nil {
-				writer.gzipWriter.Close()
-			}
-		}()
+
+		// client accepts gzip or deflate ?
+		encoding := mw.negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if r.Method == "HEAD" {
+			encoding = ""
+		}
+
+		writer := &gzipResponseWriter{ResponseWriter: w, mw: mw, encoding: encoding}
+
 		// call the handler with the wrapped writer
 		h(writer, r)
+
+		// need to close the compressor, or to send the small buffered responses
+		writer.close()
+	}
+}
+
+// negotiateEncoding returns the supported encoding with the highest q-value in the
+// Accept-Encoding header, gzip being preferred in case of equality. Empty if none is acceptable.
+func (mw *GzipMiddleware) negotiateEncoding(acceptEncoding string) string {
+
+	qValues := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			nameValue := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(nameValue) == 2 && strings.ToLower(strings.TrimSpace(nameValue[0])) == "q" {
+				value, err := strconv.ParseFloat(strings.TrimSpace(nameValue[1]), 64)
+				if err != nil {
+					value = 0
+				}
+				q = value
+			}
+		}
+		qValues[coding] = q
+	}
+
+	supported := []string{"gzip"}
+	if mw.EnableDeflate {
+		supported = append(supported, "deflate")
+	}
+
+	encoding := ""
+	bestQ := 0.0
+	for _, coding := range supported {
+		q, ok := qValues[coding]
+		if !ok {
+			q, ok = qValues["*"]
+		}
+		if ok && q > bestQ {
+			encoding = coding
+			bestQ = q
+		}
+	}
+	return encoding
+}
+
+// isCompressible returns true if the media type is allowed by ContentTypes. An empty content type
+// is the JSON set by default when the header is written.
+func (mw *GzipMiddleware) isCompressible(contentType string) bool {
+	if len(mw.ContentTypes) == 0 {
+		return true
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
 	}
+	for _, allowed := range mw.ContentTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The compressor states of the gzipResponseWriter.
+const (
+	gzipUndecided = iota
+	gzipBuffering
+	gzipCompressing
+	gzipPassThrough
+)
+
+// The writers of the pools.
+type gzipCompressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
 }
 
 // Private responseWriter intantiated by the gzip middleware.
-// It encodes the payload with gzip and set the proper headers.
+// It encodes the payload with gzip or deflate and set the proper headers.
 // It implements the following interfaces:
 // ResponseWriter
 // http.ResponseWriter
@@ -42,24 +184,94 @@ func (mw *GzipMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 // http.Hijacker
 type gzipResponseWriter struct {
 	ResponseWriter
+	mw          *GzipMiddleware
+	encoding    string
 	wroteHeader bool
-	canGzip     bool
-	gzipWriter  *gzip.Writer
+	statusCode  int
+	state       int
+	buffer      bytes.Buffer
+	compressor  gzipCompressor
 }
 
-// Set the right headers for gzip encoded responses.
+// Record the status code, and decide if the payload is compressed. The parent WriteHeader is
+// called once the decision is made.
 func (w *gzipResponseWriter) WriteHeader(code int) {
 
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = code
+
 	// Always set the Vary header, even if this particular request
 	// is not gzipped.
 	w.Header().Add("Vary", "Accept-Encoding")
 
-	if w.canGzip {
-		w.Header().Set("Content-Encoding", "gzip")
+	if w.encoding == "" ||
+		code < http.StatusOK || code == http.StatusNoContent || code == http.StatusNotModified ||
+		w.Header().Get("Content-Encoding") != "" ||
+		!w.mw.isCompressible(w.Header().Get("Content-Type")) {
+		w.passThrough()
+		return
 	}
 
-	w.ResponseWriter.WriteHeader(code)
-	w.wroteHeader = true
+	if w.mw.MinSize > 0 {
+		w.state = gzipBuffering
+		return
+	}
+	w.startCompression()
+}
+
+// Write the parent header, without compression.
+func (w *gzipResponseWriter) passThrough() {
+	w.state = gzipPassThrough
+	w.ResponseWriter.WriteHeader(w.statusCode)
+}
+
+// Set the headers of the compressed response, write the parent header, and compress the
+// buffered payload.
+func (w *gzipResponseWriter) startCompression() error {
+
+	w.state = gzipCompressing
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.statusCode)
+
+	writer := w.ResponseWriter.(http.ResponseWriter)
+	if w.encoding == "deflate" {
+		w.compressor = w.mw.flatePool.Get().(*flate.Writer)
+	} else {
+		w.compressor = w.mw.gzipPool.Get().(*gzip.Writer)
+	}
+	w.compressor.Reset(writer)
+
+	if w.buffer.Len() > 0 {
+		_, err := w.compressor.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+		return err
+	}
+	return nil
+}
+
+// Close the compressor and return it to its pool, or send the buffered payload uncompressed
+// when smaller than MinSize.
+func (w *gzipResponseWriter) close() {
+
+	switch w.state {
+	case gzipBuffering:
+		w.passThrough()
+		writer := w.ResponseWriter.(http.ResponseWriter)
+		writer.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+	case gzipCompressing:
+		w.compressor.Close()
+		if w.encoding == "deflate" {
+			w.mw.flatePool.Put(w.compressor)
+		} else {
+			w.mw.gzipPool.Put(w.compressor)
+		}
+		w.compressor = nil
+	}
 }
 
 // Make sure the local Write is called.
@@ -75,12 +287,19 @@ func (w *gzipResponseWriter) WriteJson(v interface{}) error {
 	return nil
 }
 
-// Make sure the local WriteHeader is called, and call the parent Flush.
+// Make sure the local WriteHeader is called, start the compression of the buffered payload,
+// flush the compressor, and call the parent Flush.
 // Provided in order to implement the http.Flusher interface.
 func (w *gzipResponseWriter) Flush() {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
+	if w.state == gzipBuffering {
+		w.startCompression()
+	}
+	if w.state == gzipCompressing {
+		w.compressor.Flush()
+	}
 	flusher := w.ResponseWriter.(http.Flusher)
 	flusher.Flush()
 }
@@ -106,27 +325,24 @@ func (w *gzipResponseWriter) Write(b []byte) (int, error) {
 		w.WriteHeader(http.StatusOK)
 	}
 
-	writer := w.ResponseWriter.(http.ResponseWriter)
-
-	if w.canGzip {
+	switch w.state {
+	case gzipBuffering:
+		w.buffer.Write(b)
+		if w.buffer.Len() >= w.mw.MinSize {
+			if err := w.startCompression(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	case gzipCompressing:
 		// Write can be called multiple times for a given response.
 		// (see the streaming example:
 		// https://github.com/ant0ine/go-json-rest-examples/tree/master/streaming)
-		// The gzipWriter is instantiated only once, and flushed after
-		// each write.
-		if w.gzipWriter == nil {
-			w.gzipWriter = gzip.NewWriter(writer)
-		}
-		count, errW := w.gzipWriter.Write(b)
-		errF := w.gzipWriter.Flush()
-		if errW != nil {
-			return count, errW
-		}
-		if errF != nil {
-			return count, errF
-		}
-		return count, nil
+		// The compressor is flushed only when the response is, to keep the
+		// compression ratio.
+		return w.compressor.Write(b)
 	}
 
+	writer := w.ResponseWriter.(http.ResponseWriter)
 	return writer.Write(b)
 }
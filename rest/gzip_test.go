@@ -1,7 +1,14 @@
 package rest
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"github.com/ant0ine/go-json-rest/rest/test"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
 	"testing"
 )
 
@@ -66,3 +73,133 @@ func TestGzipDisabled(t *testing.T) {
 	recorded.HeaderIs("Content-Encoding", "")
 	recorded.HeaderIs("Vary", "")
 }
+
+func TestGzipNegotiation(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&GzipMiddleware{EnableDeflate: true})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Content-Length", "12")
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	for acceptEncoding, expected := range map[string]string{
+		"gzip":                        "gzip",
+		"gzip;q=0":                    "",
+		"deflate":                     "deflate",
+		"gzip;q=0.5, deflate;q=0.8":   "deflate",
+		"gzip, deflate":               "gzip",
+		"br, *;q=0.1":                 "gzip",
+		"*;q=0":                       "",
+		"identity":                    "",
+		"x-gzip":                      "gzip",
+		"GZIP; Q=0.2, deflate;q=0.1":  "gzip",
+		"deflate;q=0.5, gzip;q=bogus": "deflate",
+	} {
+		req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		recorded := test.RunRequest(t, handler, req)
+		recorded.CodeIs(200)
+		recorded.HeaderIs("Content-Encoding", expected)
+		if expected != "" {
+			recorded.HeaderIs("Content-Length", "")
+		} else {
+			recorded.HeaderIs("Content-Length", "12")
+		}
+
+		var reader io.Reader = recorded.Recorder.Body
+		switch expected {
+		case "gzip":
+			gzipReader, err := gzip.NewReader(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader = gzipReader
+		case "deflate":
+			reader = flate.NewReader(reader)
+		}
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `{"Id":"123"}` {
+			t.Errorf("%s: unexpected body: %s", acceptEncoding, body)
+		}
+	}
+}
+
+func TestGzipFiltering(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&GzipMiddleware{
+		MinSize:      100,
+		ContentTypes: []string{"application/json", "text/*"},
+		Level:        gzip.BestSpeed,
+	})
+	router, err := MakeRouter(
+		Get("/small", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+		Get("/large", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": strings.Repeat("a", 200)})
+		}),
+		Get("/image", func(w ResponseWriter, r *Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.(http.ResponseWriter).Write(bytes.Repeat([]byte{0}, 200))
+		}),
+		Get("/encoded", func(w ResponseWriter, r *Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+			w.(http.ResponseWriter).Write(bytes.Repeat([]byte{0}, 200))
+		}),
+		Get("/stream", func(w ResponseWriter, r *Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			for i := 0; i < 3; i++ {
+				w.(http.ResponseWriter).Write([]byte("chunk\n"))
+				w.(http.Flusher).Flush()
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/small", nil))
+	recorded.HeaderIs("Content-Encoding", "")
+	recorded.HeaderIs("Vary", "Accept-Encoding")
+	recorded.BodyIs(`{"Id":"123"}`)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/large", nil))
+	recorded.ContentEncodingIsGzip()
+	recorded.ContentTypeIsJson()
+	payload := map[string]string{}
+	if err := recorded.DecodeJsonPayload(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload["Id"]) != 200 {
+		t.Errorf("Unexpected payload: %v", payload)
+	}
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/image", nil))
+	recorded.HeaderIs("Content-Encoding", "")
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/encoded", nil))
+	recorded.HeaderIs("Content-Encoding", "br")
+	if recorded.Recorder.Body.Len() != 200 {
+		t.Errorf("Unchanged body expected, got %d bytes", recorded.Recorder.Body.Len())
+	}
+
+	// the flush starts the compression, even under MinSize
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/stream", nil))
+	recorded.ContentEncodingIsGzip()
+	body, err := recorded.DecodedBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "chunk\nchunk\nchunk\n" {
+		t.Errorf("Unexpected body: %s", body)
+	}
+}
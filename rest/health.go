@@ -0,0 +1,290 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The status values of the health reports and checks.
+const (
+	HealthPass = "pass"
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+// HealthCheck is a named check of a dependency of the service, eg: a database connection,
+// registered with HealthChecker.AddCheck.
+type HealthCheck struct {
+
+	// Name of the check, key of the check in the reports. Required.
+	Name string
+
+	// Callback function that returns an error when the dependency is not healthy. The context is
+	// canceled when the Timeout is reached. Required.
+	Check func(ctx context.Context) error
+
+	// Maximum duration of the check, after which it is considered failing.
+	// Optional, defaults to 1 second.
+	Timeout time.Duration
+
+	// If true, the failure of this check makes the service not ready. Otherwise the failure is
+	// reported as a warning. Optional, defaults to false.
+	Critical bool
+
+	// If true, this check is also run for the liveness report. Only the checks that would be
+	// fixed by a restart of the process should be liveness checks. Optional, defaults to false.
+	Liveness bool
+}
+
+// HealthCheckResult is the outcome of a HealthCheck, as included in the HealthReport.
+type HealthCheckResult struct {
+	Status     string
+	Critical   bool
+	Error      string `json:",omitempty"`
+	Latency    string
+	LatencySec float64
+	CheckedAt  time.Time
+}
+
+// HealthReport is the JSON payload returned by the liveness and readiness endpoints.
+// Status is HealthFail when a critical check fails, or when the service is shutting down
+// (readiness only), HealthWarn when a non critical check fails, and HealthPass otherwise.
+type HealthReport struct {
+	Status       string
+	ShuttingDown bool `json:",omitempty"`
+	Checks       map[string]*HealthCheckResult
+}
+
+// HealthChecker runs the registered HealthChecks concurrently, and exposes the liveness and
+// readiness reports, with LivenessHandler and ReadinessHandler, eg:
+//
+//	health := &rest.HealthChecker{}
+//	health.AddCheck(rest.HealthCheck{
+//		Name:     "database",
+//		Check:    db.PingContext,
+//		Critical: true,
+//	})
+//	router, err := rest.MakeRouter(
+//		rest.Get("/healthz", health.LivenessHandler),
+//		rest.Get("/readyz", health.ReadinessHandler),
+//	)
+//
+// The results are cached for CacheDuration, and the concurrent requests share the same run of a
+// check, so that the probes cannot overload the dependencies. Once Shutdown is called, the
+// readiness report fails, so that the load balancers stop sending new requests.
+type HealthChecker struct {
+
+	// Duration during which the result of a check is reused. Optional, defaults to 1 second.
+	// Set a negative value to run the checks for each report.
+	CacheDuration time.Duration
+
+	lock         sync.RWMutex
+	checks       []*healthCheckState
+	shuttingDown bool
+}
+
+type healthCheckState struct {
+	check   HealthCheck
+	lock    sync.Mutex
+	last    *HealthCheckResult
+	running chan struct{}
+}
+
+// AddCheck registers a HealthCheck. The check names must be unique.
+func (hc *HealthChecker) AddCheck(check HealthCheck) {
+
+	if check.Name == "" {
+		log.Fatal("HealthCheck Name is required")
+	}
+	if check.Check == nil {
+		log.Fatal("HealthCheck Check is required")
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = time.Second
+	}
+
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	for _, state := range hc.checks {
+		if state.check.Name == check.Name {
+			log.Fatalf("HealthCheck %s is already registered", check.Name)
+		}
+	}
+	hc.checks = append(hc.checks, &healthCheckState{check: check})
+}
+
+// Shutdown makes the readiness report fail from now on. It is meant to be called at the beginning
+// of a graceful shutdown, as done by the Server.
+func (hc *HealthChecker) Shutdown() {
+	hc.lock.Lock()
+	hc.shuttingDown = true
+	hc.lock.Unlock()
+}
+
+// IsShuttingDown returns true once Shutdown has been called.
+func (hc *HealthChecker) IsShuttingDown() bool {
+	hc.lock.RLock()
+	defer hc.lock.RUnlock()
+	return hc.shuttingDown
+}
+
+// Liveness runs the liveness checks and returns the report.
+func (hc *HealthChecker) Liveness() *HealthReport {
+	return hc.report(true)
+}
+
+// Readiness runs all the checks and returns the report.
+func (hc *HealthChecker) Readiness() *HealthReport {
+	return hc.report(false)
+}
+
+// LivenessHandler is a HandlerFunc that writes the liveness report, with a
+// StatusServiceUnavailable (503) status code when it fails.
+// eg: rest.Get("/healthz", health.LivenessHandler)
+func (hc *HealthChecker) LivenessHandler(w ResponseWriter, r *Request) {
+	writeHealthReport(w, hc.Liveness())
+}
+
+// ReadinessHandler is a HandlerFunc that writes the readiness report, with a
+// StatusServiceUnavailable (503) status code when it fails.
+// eg: rest.Get("/readyz", health.ReadinessHandler)
+func (hc *HealthChecker) ReadinessHandler(w ResponseWriter, r *Request) {
+	writeHealthReport(w, hc.Readiness())
+}
+
+func writeHealthReport(w ResponseWriter, report *HealthReport) {
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == HealthFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.WriteJson(report)
+}
+
+func (hc *HealthChecker) report(liveness bool) *HealthReport {
+
+	hc.lock.RLock()
+	states := []*healthCheckState{}
+	for _, state := range hc.checks {
+		if !liveness || state.check.Liveness {
+			states = append(states, state)
+		}
+	}
+	shuttingDown := hc.shuttingDown && !liveness
+	cacheDuration := hc.CacheDuration
+	hc.lock.RUnlock()
+
+	if cacheDuration == 0 {
+		cacheDuration = time.Second
+	}
+
+	results := make([]*HealthCheckResult, len(states))
+	wg := sync.WaitGroup{}
+	for i, state := range states {
+		wg.Add(1)
+		go func(i int, state *healthCheckState) {
+			defer wg.Done()
+			results[i] = state.result(cacheDuration)
+		}(i, state)
+	}
+	wg.Wait()
+
+	report := &HealthReport{
+		Status:       HealthPass,
+		ShuttingDown: shuttingDown,
+		Checks:       map[string]*HealthCheckResult{},
+	}
+	for i, state := range states {
+		result := results[i]
+		report.Checks[state.check.Name] = result
+		if result.Status == HealthPass {
+			continue
+		}
+		if result.Critical {
+			report.Status = HealthFail
+		} else if report.Status == HealthPass {
+			report.Status = HealthWarn
+		}
+	}
+	if shuttingDown {
+		report.Status = HealthFail
+	}
+	return report
+}
+
+// result returns the cached result if fresh enough, or waits for a new run of the check. A single
+// run is in progress at any time.
+func (s *healthCheckState) result(cacheDuration time.Duration) *HealthCheckResult {
+
+	s.lock.Lock()
+	if s.last != nil && cacheDuration > 0 && time.Since(s.last.CheckedAt) < cacheDuration {
+		result := s.last
+		s.lock.Unlock()
+		return result
+	}
+	if s.running == nil {
+		s.running = make(chan struct{})
+		go s.run(s.running)
+	}
+	running := s.running
+	s.lock.Unlock()
+
+	<-running
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.last
+}
+
+func (s *healthCheckState) run(running chan struct{}) {
+
+	start := time.Now()
+	err := runHealthCheck(s.check)
+	latency := time.Since(start)
+
+	result := &HealthCheckResult{
+		Status:     HealthPass,
+		Critical:   s.check.Critical,
+		Latency:    latency.String(),
+		LatencySec: latency.Seconds(),
+		CheckedAt:  start,
+	}
+	if err != nil {
+		result.Status = HealthFail
+		result.Error = err.Error()
+	}
+
+	s.lock.Lock()
+	s.last = result
+	s.running = nil
+	s.lock.Unlock()
+	close(running)
+}
+
+// runHealthCheck calls the check, and gives up after the Timeout, even if the check ignores the
+// context.
+func runHealthCheck(check HealthCheck) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if reco := recover(); reco != nil {
+				done <- fmt.Errorf("panic: %v", reco)
+			}
+		}()
+		done <- check.Check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timeout after %s", check.Timeout)
+	}
+}
@@ -0,0 +1,109 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+
+	calls := int32(0)
+	cacheFailing := errors.New("connection refused")
+
+	health := &HealthChecker{CacheDuration: time.Hour}
+	health.AddCheck(HealthCheck{
+		Name: "database",
+		Check: func(ctx context.Context) error {
+			atomic.AddInt32(&calls, 1)
+			return nil
+		},
+		Critical: true,
+		Liveness: true,
+	})
+	health.AddCheck(HealthCheck{
+		Name: "cache",
+		Check: func(ctx context.Context) error {
+			return cacheFailing
+		},
+	})
+
+	api := NewApi()
+	router, err := MakeRouter(
+		Get("/healthz", health.LivenessHandler),
+		Get("/readyz", health.ReadinessHandler),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	// non critical failure
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/readyz", nil))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Cache-Control", "no-store")
+	report := &HealthReport{}
+	if err := recorded.DecodeJsonPayload(report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != HealthWarn {
+		t.Errorf("warn expected, got %s", report.Status)
+	}
+	if report.Checks["cache"].Error != "connection refused" || report.Checks["database"].Status != HealthPass {
+		t.Errorf("Unexpected checks: %+v %+v", report.Checks["cache"], report.Checks["database"])
+	}
+
+	// liveness only runs the liveness checks, from the cache
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/healthz", nil))
+	recorded.CodeIs(200)
+	report = &HealthReport{}
+	if err := recorded.DecodeJsonPayload(report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != HealthPass || len(report.Checks) != 1 {
+		t.Errorf("Unexpected liveness report: %+v", report)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("1 call expected, got %d", calls)
+	}
+
+	// shutting down
+	health.Shutdown()
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/readyz", nil)).CodeIs(503)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/healthz", nil)).CodeIs(200)
+}
+
+func TestHealthCheckerCriticalAndTimeout(t *testing.T) {
+
+	health := &HealthChecker{}
+	health.AddCheck(HealthCheck{
+		Name: "slow",
+		Check: func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		},
+		Timeout:  10 * time.Millisecond,
+		Critical: true,
+	})
+	health.AddCheck(HealthCheck{
+		Name: "panicking",
+		Check: func(ctx context.Context) error {
+			panic("boom")
+		},
+	})
+
+	report := health.Readiness()
+	if report.Status != HealthFail {
+		t.Errorf("fail expected, got %s", report.Status)
+	}
+	if report.Checks["slow"].Error != "timeout after 10ms" {
+		t.Errorf("Unexpected error: %s", report.Checks["slow"].Error)
+	}
+	if report.Checks["panicking"].Error != "panic: boom" {
+		t.Errorf("Unexpected error: %s", report.Checks["panicking"].Error)
+	}
+}
@@ -0,0 +1,220 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NonceStore defines the interface that objects must implement in order to detect the replayed
+// requests in the HmacSignatureMiddleware. A shared implementation is required when the
+// requests are load balanced between multiple processes.
+type NonceStore interface {
+
+	// CheckAndStore returns false if the nonce has already been seen. Otherwise it returns true,
+	// and remembers the nonce until expiresAt.
+	CheckAndStore(nonce string, expiresAt time.Time) (bool, error)
+}
+
+// InMemoryNonceStore is a NonceStore implementation that keeps the nonces in memory, the expired
+// ones are removed as new nonces are stored. It is safe for concurrent use.
+type InMemoryNonceStore struct {
+	lock      sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewInMemoryNonceStore returns an empty InMemoryNonceStore.
+func NewInMemoryNonceStore() *InMemoryNonceStore {
+	return &InMemoryNonceStore{
+		nonces: map[string]time.Time{},
+	}
+}
+
+// CheckAndStore makes InMemoryNonceStore implement the NonceStore interface.
+func (s *InMemoryNonceStore) CheckAndStore(nonce string, expiresAt time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for seen, expires := range s.nonces {
+			if !now.Before(expires) {
+				delete(s.nonces, seen)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if expires, ok := s.nonces[nonce]; ok && now.Before(expires) {
+		return false, nil
+	}
+	s.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+// HmacSignatureMiddleware verifies the HMAC-SHA256 signature of the requests. The signed string
+// is made of the following lines, separated by "\n":
+//
+//	the HTTP method
+//	the request URI, path and query string, as in url.URL.RequestURI()
+//	the timestamp, in seconds since the epoch, from the TimestampHeader
+//	the nonce, from the NonceHeader
+//	the hex encoded SHA-256 of the body
+//
+// The signature is hex encoded, with an optional "sha256=" prefix. The requests with a timestamp
+// older than MaxSkew, or with a nonce already seen, are rejected. On failure, a 401 HTTP response
+// is returned. On success, the wrapped middleware is called, with the body buffered so it can
+// still be read, and the key id is made available as request.RemoteUser().
+// See test.SignRequest and test.SignRequestWithOptions to build signed requests.
+type HmacSignatureMiddleware struct {
+
+	// Callback function that returns the secret for the key id read from KeyIdHeader (empty if
+	// the header is missing). Required.
+	SecretFunc func(keyId string) ([]byte, error)
+
+	// Name of the header containing the signature. Optional, defaults to "X-Signature".
+	SignatureHeader string
+
+	// Name of the header containing the timestamp. Optional, defaults to "X-Signature-Timestamp".
+	TimestampHeader string
+
+	// Name of the header containing the nonce. Optional, defaults to "X-Signature-Nonce".
+	NonceHeader string
+
+	// Name of the header containing the key id. Optional, defaults to "X-Signature-Key-Id".
+	KeyIdHeader string
+
+	// Maximum difference between the timestamp and the current time. Optional, defaults to
+	// 5 minutes.
+	MaxSkew time.Duration
+
+	// Store used to detect the replayed nonces. Optional, defaults to a new InMemoryNonceStore.
+	NonceStore NonceStore
+
+	// Maximum size in bytes of the buffered body. Optional, defaults to 10MB.
+	MaxBodySize int64
+}
+
+// MiddlewareFunc makes HmacSignatureMiddleware implement the Middleware interface.
+func (mw *HmacSignatureMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.SecretFunc == nil {
+		log.Fatal("SecretFunc is required")
+	}
+	if mw.SignatureHeader == "" {
+		mw.SignatureHeader = "X-Signature"
+	}
+	if mw.TimestampHeader == "" {
+		mw.TimestampHeader = "X-Signature-Timestamp"
+	}
+	if mw.NonceHeader == "" {
+		mw.NonceHeader = "X-Signature-Nonce"
+	}
+	if mw.KeyIdHeader == "" {
+		mw.KeyIdHeader = "X-Signature-Key-Id"
+	}
+	if mw.MaxSkew <= 0 {
+		mw.MaxSkew = 5 * time.Minute
+	}
+	if mw.NonceStore == nil {
+		mw.NonceStore = NewInMemoryNonceStore()
+	}
+	if mw.MaxBodySize <= 0 {
+		mw.MaxBodySize = 10 << 20
+	}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		signature, err := hex.DecodeString(
+			strings.TrimPrefix(request.Header.Get(mw.SignatureHeader), "sha256="),
+		)
+		if err != nil || len(signature) == 0 {
+			Error(writer, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		timestampHeader := request.Header.Get(mw.TimestampHeader)
+		timestamp, err := strconv.ParseInt(timestampHeader, 10, 64)
+		if err != nil {
+			Error(writer, "Invalid signature timestamp", http.StatusUnauthorized)
+			return
+		}
+		skew := time.Since(time.Unix(timestamp, 0))
+		if skew > mw.MaxSkew || skew < -mw.MaxSkew {
+			Error(writer, "Stale signature timestamp", http.StatusUnauthorized)
+			return
+		}
+
+		nonce := request.Header.Get(mw.NonceHeader)
+		if nonce == "" {
+			Error(writer, "Missing signature nonce", http.StatusUnauthorized)
+			return
+		}
+
+		keyId := request.Header.Get(mw.KeyIdHeader)
+		secret, err := mw.SecretFunc(keyId)
+		if err != nil || secret == nil {
+			Error(writer, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		body := []byte{}
+		if request.Body != nil {
+			body, err = ioutil.ReadAll(io.LimitReader(request.Body, mw.MaxBodySize+1))
+			request.Body.Close()
+			if err != nil {
+				Error(writer, "Invalid body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(body)) > mw.MaxBodySize {
+				Error(writer, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		// restore the body for the wrapped handlers
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		bodySum := sha256.Sum256(body)
+		canonical := strings.Join([]string{
+			request.Method,
+			request.URL.RequestURI(),
+			timestampHeader,
+			nonce,
+			hex.EncodeToString(bodySum[:]),
+		}, "\n")
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(canonical))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			Error(writer, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		// checked after the signature, only the authentic nonces are stored.
+		fresh, err := mw.NonceStore.CheckAndStore(keyId+":"+nonce, time.Now().Add(2*mw.MaxSkew))
+		if err != nil {
+			Error(writer, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !fresh {
+			Error(writer, "Replayed request", http.StatusUnauthorized)
+			return
+		}
+
+		if keyId != "" {
+			request.SetRemoteUser(keyId)
+		}
+
+		handler(writer, request)
+	}
+}
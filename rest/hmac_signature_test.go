@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHmacSignatureMiddleware(t *testing.T) {
+
+	secrets := map[string][]byte{
+		"partner": []byte("secret"),
+	}
+
+	api := NewApi()
+	api.Use(&HmacSignatureMiddleware{
+		SecretFunc: func(keyId string) ([]byte, error) {
+			return secrets[keyId], nil
+		},
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		payload := map[string]string{}
+		err := r.DecodeJsonPayload(&payload)
+		if err != nil {
+			Error(w, err.Error(), 400)
+			return
+		}
+		payload["User"] = r.Env["REMOTE_USER"].(string)
+		w.WriteJson(payload)
+	}))
+	handler := api.MakeHandler()
+
+	// not signed
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("POST", "http://localhost/hook?a=b", map[string]string{"Id": "123"}))
+	recorded.CodeIs(401)
+
+	// signed, the body is still available
+	req := test.MakeSimpleRequest("POST", "http://localhost/hook?a=b", map[string]string{"Id": "123"})
+	test.SignRequest(req, "partner", []byte("secret"))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"123","User":"partner"}`)
+
+	// replayed
+	replayed := test.MakeSimpleRequest("POST", "http://localhost/hook?a=b", map[string]string{"Id": "123"})
+	replayed.Header = req.Header
+	recorded = test.RunRequest(t, handler, replayed)
+	recorded.CodeIs(401)
+	recorded.BodyIs(`{"Error":"Replayed request"}`)
+
+	// wrong secret
+	req = test.MakeSimpleRequest("POST", "http://localhost/hook", map[string]string{"Id": "123"})
+	test.SignRequest(req, "partner", []byte("wrong"))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+
+	// tampered body
+	req = test.MakeSimpleRequest("POST", "http://localhost/hook", map[string]string{"Id": "123"})
+	test.SignRequest(req, "partner", []byte("secret"))
+	tampered := test.MakeSimpleRequest("POST", "http://localhost/hook", map[string]string{"Id": "456"})
+	tampered.Header = req.Header
+	recorded = test.RunRequest(t, handler, tampered)
+	recorded.CodeIs(401)
+	recorded.BodyIs(`{"Error":"Invalid signature"}`)
+
+	// stale timestamp
+	req = test.MakeSimpleRequest("POST", "http://localhost/hook", map[string]string{"Id": "123"})
+	test.SignRequest(req, "partner", []byte("secret"))
+	req.Header.Set("X-Signature-Timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(401)
+	recorded.BodyIs(`{"Error":"Stale signature timestamp"}`)
+}
+
+func TestHmacSignatureMiddlewareHeaderNames(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&HmacSignatureMiddleware{
+		SecretFunc: func(keyId string) ([]byte, error) {
+			return []byte("secret"), nil
+		},
+		SignatureHeader: "X-Hub-Signature",
+		TimestampHeader: "X-Hub-Timestamp",
+		NonceHeader:     "X-Hub-Delivery",
+		KeyIdHeader:     "X-Hub-Key",
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]interface{}{"User": r.Env["REMOTE_USER"]})
+	}))
+	handler := api.MakeHandler()
+
+	options := test.SignOptions{
+		SignatureHeader: "X-Hub-Signature",
+		TimestampHeader: "X-Hub-Timestamp",
+		NonceHeader:     "X-Hub-Delivery",
+		KeyIdHeader:     "X-Hub-Key",
+	}
+	req := test.MakeSimpleRequest("POST", "http://localhost/hook", map[string]string{"Id": "123"})
+	test.SignRequestWithOptions(req, "partner", []byte("secret"), options)
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"User":"partner"}`)
+
+	// signed with the default header names
+	req = test.MakeSimpleRequest("POST", "http://localhost/hook", map[string]string{"Id": "123"})
+	test.SignRequest(req, "partner", []byte("secret"))
+	test.RunRequest(t, handler, req).CodeIs(401)
+}
+
+func TestInMemoryNonceStore(t *testing.T) {
+
+	store := NewInMemoryNonceStore()
+
+	fresh, _ := store.CheckAndStore("a", time.Now().Add(time.Minute))
+	if !fresh {
+		t.Error("New nonce expected to be fresh")
+	}
+	fresh, _ = store.CheckAndStore("a", time.Now().Add(time.Minute))
+	if fresh {
+		t.Error("Seen nonce expected to be rejected")
+	}
+
+	// expired nonces are forgotten
+	store.CheckAndStore("b", time.Now().Add(-time.Second))
+	fresh, _ = store.CheckAndStore("b", time.Now().Add(time.Minute))
+	if !fresh {
+		t.Error("Expired nonce expected to be fresh")
+	}
+}
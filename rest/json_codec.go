@@ -0,0 +1,87 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// JsonCodec defines the interface that objects must implement in order to replace the
+// encoding/json package as the JSON encoder and decoder. It is set on the Api with
+// Api.SetJsonCodec, and used by ResponseWriter.EncodeJson, ResponseWriter.WriteJson,
+// JsonIndentMiddleware and Request.DecodeJsonPayload.
+type JsonCodec interface {
+
+	// Marshal returns the JSON encoding of v, as in json.Marshal.
+	Marshal(v interface{}) ([]byte, error)
+
+	// MarshalIndent is like Marshal but applies the indentation, as in json.MarshalIndent.
+	MarshalIndent(v interface{}, prefix, indent string) ([]byte, error)
+
+	// Unmarshal parses the JSON-encoded data and stores the result in the value pointed to
+	// by v, as in json.Unmarshal.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// StdJsonCodec is the JsonCodec implementation based on the encoding/json package.
+// The zero value behaves exactly like json.Marshal and json.Unmarshal, it is the default codec.
+type StdJsonCodec struct {
+
+	// If true, the characters &, < and > are not escaped in the JSON strings.
+	DisableHTMLEscape bool
+
+	// If true, the numbers are decoded into an interface{} as json.Number instead of float64.
+	UseNumber bool
+}
+
+// Marshal makes StdJsonCodec implement the JsonCodec interface.
+func (c *StdJsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if !c.DisableHTMLEscape {
+		return json.Marshal(v)
+	}
+	return c.encode(v, "", "")
+}
+
+// MarshalIndent makes StdJsonCodec implement the JsonCodec interface.
+func (c *StdJsonCodec) MarshalIndent(v interface{}, prefix, indent string) ([]byte, error) {
+	if !c.DisableHTMLEscape {
+		return json.MarshalIndent(v, prefix, indent)
+	}
+	return c.encode(v, prefix, indent)
+}
+
+// Unmarshal makes StdJsonCodec implement the JsonCodec interface.
+func (c *StdJsonCodec) Unmarshal(data []byte, v interface{}) error {
+	if !c.UseNumber {
+		return json.Unmarshal(data, v)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	// same behavior as json.Unmarshal, no data allowed after the top-level value
+	var extra json.RawMessage
+	if decoder.Decode(&extra) != io.EOF {
+		return errors.New("invalid data after top-level JSON value")
+	}
+	return nil
+}
+
+// Encode with a json.Encoder in order to control the HTML escaping.
+func (c *StdJsonCodec) encode(v interface{}, prefix, indent string) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(!c.DisableHTMLEscape)
+	encoder.SetIndent(prefix, indent)
+	err := encoder.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	// json.Encoder terminates each value with a newline, json.Marshal does not.
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+var defaultJsonCodec JsonCodec = &StdJsonCodec{}
@@ -0,0 +1,91 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"testing"
+)
+
+func TestJsonCodecDisableHTMLEscape(t *testing.T) {
+
+	api := NewApi()
+	api.SetJsonCodec(&StdJsonCodec{DisableHTMLEscape: true})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Html": "<b>&</b>"})
+	}))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs(`{"Html":"<b>&</b>"}`)
+
+	// also used by JsonIndentMiddleware
+	api = NewApi()
+	api.SetJsonCodec(&StdJsonCodec{DisableHTMLEscape: true})
+	api.Use(&JsonIndentMiddleware{})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Html": "<b>&</b>"})
+	}))
+	handler = api.MakeHandler()
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.ContentTypeIsJson()
+	recorded.BodyIs("{\n  \"Html\": \"<b>&</b>\"\n}")
+}
+
+func TestJsonCodecUseNumber(t *testing.T) {
+
+	api := NewApi()
+	api.SetJsonCodec(&StdJsonCodec{UseNumber: true})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		payload := map[string]interface{}{}
+		err := r.DecodeJsonPayload(&payload)
+		if err != nil {
+			Error(w, err.Error(), 400)
+			return
+		}
+		number, ok := payload["Id"].(json.Number)
+		if !ok {
+			t.Errorf("json.Number expected, got: %T", payload["Id"])
+		}
+		w.WriteJson(map[string]string{"Id": number.String()})
+	}))
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("POST", "http://localhost/", map[string]interface{}{"Id": 12345678901234567})
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"12345678901234567"}`)
+}
+
+type testJsonCodec struct {
+	StdJsonCodec
+	marshalCount int
+}
+
+func (c *testJsonCodec) Marshal(v interface{}) ([]byte, error) {
+	c.marshalCount++
+	return []byte(`{"Codec":"test"}`), nil
+}
+
+func TestJsonCodecCustom(t *testing.T) {
+
+	codec := &testJsonCodec{}
+
+	api := NewApi()
+	api.SetJsonCodec(codec)
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Codec":"test"}`)
+
+	if codec.marshalCount != 1 {
+		t.Errorf("Marshal expected to be called once, got: %d", codec.marshalCount)
+	}
+}
@@ -2,7 +2,6 @@ package rest
 
 import (
 	"bufio"
-	"encoding/json"
 	"net"
 	"net/http"
 )
@@ -30,7 +29,7 @@ func (mw *JsonIndentMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc
 
 	return func(w ResponseWriter, r *Request) {
 
-		writer := &jsonIndentResponseWriter{w, false, mw.Prefix, mw.Indent}
+		writer := &jsonIndentResponseWriter{w, false, mw.Prefix, mw.Indent, r.jsonCodec()}
 		// call the wrapped handler
 		handler(writer, r)
 	}
@@ -48,11 +47,12 @@ type jsonIndentResponseWriter struct {
 	wroteHeader bool
 	prefix      string
 	indent      string
+	codec       JsonCodec
 }
 
-// Replace the parent EncodeJson to provide indentation.
+// Replace the parent EncodeJson to provide indentation, using the JsonCodec of the Api.
 func (w *jsonIndentResponseWriter) EncodeJson(v interface{}) ([]byte, error) {
-	b, err := json.MarshalIndent(v, w.prefix, w.indent)
+	b, err := w.codec.MarshalIndent(v, w.prefix, w.indent)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,223 @@
+package rest
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMetricsBuckets are the default upper bounds, in seconds, of the latency histogram
+// buckets. Same as the Prometheus client libraries.
+var DefaultMetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricsMiddleware keeps metrics about the processed requests, and exposes them in the
+// Prometheus text format with MetricsHandler. The following metrics are maintained, the names
+// being prefixed with Namespace:
+//
+//	_requests_total counter, by method, route and status class
+//	_request_duration_seconds histogram, by method, route and status class
+//	_response_size_bytes summary, by method, route and status class
+//	_requests_in_flight gauge, by method
+//
+// The route label is the PathExp of the matched Route, "unmatched" if no Route matched, so the
+// number of series is bounded. The methods not defined by HTTP are reported as "OTHER". The status
+// class, eg: "2xx", and the response size depend on RecorderMiddleware that should be in the
+// wrapped middlewares.
+type MetricsMiddleware struct {
+
+	// Prefix of the metric names. Optional, defaults to "http".
+	Namespace string
+
+	// Upper bounds of the latency histogram buckets, in seconds, in increasing order.
+	// Optional, defaults to DefaultMetricsBuckets.
+	Buckets []float64
+
+	lock     sync.Mutex
+	series   map[metricsLabels]*metricsSeries
+	inFlight map[string]int64
+}
+
+type metricsLabels struct {
+	method      string
+	route       string
+	statusClass string
+}
+
+type metricsSeries struct {
+	count        uint64
+	bucketCounts []uint64
+	durationSum  float64
+	sizeSum      float64
+}
+
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+// MiddlewareFunc makes MetricsMiddleware implement the Middleware interface.
+func (mw *MetricsMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.Namespace == "" {
+		mw.Namespace = "http"
+	}
+	if len(mw.Buckets) == 0 {
+		mw.Buckets = DefaultMetricsBuckets
+	}
+	mw.series = map[metricsLabels]*metricsSeries{}
+	mw.inFlight = map[string]int64{}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		method := request.Method
+		if !metricsMethods[method] {
+			method = "OTHER"
+		}
+
+		mw.lock.Lock()
+		mw.inFlight[method]++
+		mw.lock.Unlock()
+
+		start := time.Now()
+
+		defer func() {
+			duration := time.Since(start).Seconds()
+
+			labels := metricsLabels{method: method, route: "unmatched"}
+			if route, ok := request.Route(); ok {
+				labels.route = route.PathExp
+			}
+			statusCode, _ := request.StatusCode()
+			if statusCode == 0 {
+				// the wrapped handler did not return normally
+				statusCode = http.StatusInternalServerError
+			}
+			labels.statusClass = fmt.Sprintf("%dxx", statusCode/100)
+			bytesWritten, _ := request.BytesWritten()
+
+			mw.lock.Lock()
+			defer mw.lock.Unlock()
+
+			mw.inFlight[method]--
+
+			series := mw.series[labels]
+			if series == nil {
+				series = &metricsSeries{bucketCounts: make([]uint64, len(mw.Buckets))}
+				mw.series[labels] = series
+			}
+			series.count++
+			series.durationSum += duration
+			series.sizeSum += float64(bytesWritten)
+			for i, bound := range mw.Buckets {
+				if duration <= bound {
+					series.bucketCounts[i]++
+				}
+			}
+		}()
+
+		handler(writer, request)
+	}
+}
+
+// MetricsHandler is a HandlerFunc that writes the metrics in the Prometheus text format.
+// eg: rest.Get("/metrics", metrics.MetricsHandler)
+func (mw *MetricsMiddleware) MetricsHandler(w ResponseWriter, r *Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.(http.ResponseWriter).Write(mw.exposition())
+}
+
+func (mw *MetricsMiddleware) exposition() []byte {
+
+	mw.lock.Lock()
+	defer mw.lock.Unlock()
+
+	labelsList := []metricsLabels{}
+	for labels := range mw.series {
+		labelsList = append(labelsList, labels)
+	}
+	sort.Slice(labelsList, func(i, j int) bool {
+		a, b := labelsList[i], labelsList[j]
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.statusClass < b.statusClass
+	})
+
+	buffer := &bytes.Buffer{}
+	name := mw.Namespace + "_requests_total"
+	fmt.Fprintf(buffer, "# HELP %s Number of HTTP requests processed.\n", name)
+	fmt.Fprintf(buffer, "# TYPE %s counter\n", name)
+	for _, labels := range labelsList {
+		fmt.Fprintf(buffer, "%s{%s} %d\n", name, labels.format(), mw.series[labels].count)
+	}
+
+	name = mw.Namespace + "_request_duration_seconds"
+	fmt.Fprintf(buffer, "# HELP %s Latency of the HTTP requests.\n", name)
+	fmt.Fprintf(buffer, "# TYPE %s histogram\n", name)
+	for _, labels := range labelsList {
+		series := mw.series[labels]
+		for i, bound := range mw.Buckets {
+			fmt.Fprintf(buffer, "%s_bucket{%s,le=\"%s\"} %d\n",
+				name, labels.format(), formatMetricsFloat(bound), series.bucketCounts[i])
+		}
+		fmt.Fprintf(buffer, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels.format(), series.count)
+		fmt.Fprintf(buffer, "%s_sum{%s} %s\n", name, labels.format(), formatMetricsFloat(series.durationSum))
+		fmt.Fprintf(buffer, "%s_count{%s} %d\n", name, labels.format(), series.count)
+	}
+
+	name = mw.Namespace + "_response_size_bytes"
+	fmt.Fprintf(buffer, "# HELP %s Size of the HTTP response bodies.\n", name)
+	fmt.Fprintf(buffer, "# TYPE %s summary\n", name)
+	for _, labels := range labelsList {
+		series := mw.series[labels]
+		fmt.Fprintf(buffer, "%s_sum{%s} %s\n", name, labels.format(), formatMetricsFloat(series.sizeSum))
+		fmt.Fprintf(buffer, "%s_count{%s} %d\n", name, labels.format(), series.count)
+	}
+
+	methods := []string{}
+	for method := range mw.inFlight {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	name = mw.Namespace + "_requests_in_flight"
+	fmt.Fprintf(buffer, "# HELP %s Number of HTTP requests being processed.\n", name)
+	fmt.Fprintf(buffer, "# TYPE %s gauge\n", name)
+	for _, method := range methods {
+		fmt.Fprintf(buffer, "%s{method=\"%s\"} %d\n", name, escapeMetricsLabel(method), mw.inFlight[method])
+	}
+
+	return buffer.Bytes()
+}
+
+func (labels metricsLabels) format() string {
+	return fmt.Sprintf(`method="%s",route="%s",status="%s"`,
+		escapeMetricsLabel(labels.method),
+		escapeMetricsLabel(labels.route),
+		escapeMetricsLabel(labels.statusClass),
+	)
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricsLabel(value string) string {
+	return metricsLabelEscaper.Replace(value)
+}
+
+func formatMetricsFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
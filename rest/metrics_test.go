@@ -0,0 +1,59 @@
+package rest
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"strings"
+	"testing"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+
+	metrics := &MetricsMiddleware{
+		Buckets: []float64{0.1, 1},
+	}
+
+	api := NewApi()
+	api.Use(metrics)
+	api.Use(&RecorderMiddleware{})
+	router, err := MakeRouter(
+		Get("/users/:id", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": r.PathParam("id")})
+		}),
+		Get("/metrics", metrics.MetricsHandler),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/users/1", nil)).CodeIs(200)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/users/2", nil)).CodeIs(200)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/unknown", nil)).CodeIs(404)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("BREW", "http://localhost/users/1", nil)).CodeIs(405)
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/metrics", nil))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	body := recorded.Recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE http_requests_total counter\n",
+		`http_requests_total{method="GET",route="/users/:id",status="2xx"} 2` + "\n",
+		`http_requests_total{method="GET",route="unmatched",status="4xx"} 1` + "\n",
+		`http_requests_total{method="OTHER",route="unmatched",status="4xx"} 1` + "\n",
+		"# TYPE http_request_duration_seconds histogram\n",
+		`http_request_duration_seconds_bucket{method="GET",route="/users/:id",status="2xx",le="0.1"} 2` + "\n",
+		`http_request_duration_seconds_bucket{method="GET",route="/users/:id",status="2xx",le="1"} 2` + "\n",
+		`http_request_duration_seconds_bucket{method="GET",route="/users/:id",status="2xx",le="+Inf"} 2` + "\n",
+		`http_request_duration_seconds_count{method="GET",route="/users/:id",status="2xx"} 2` + "\n",
+		"# TYPE http_response_size_bytes summary\n",
+		`http_response_size_bytes_sum{method="GET",route="/users/:id",status="2xx"} 20` + "\n",
+		"# TYPE http_requests_in_flight gauge\n",
+		`http_requests_in_flight{method="GET"} 1` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in:\n%s", expected, body)
+		}
+	}
+}
@@ -50,20 +50,23 @@ func WrapMiddlewares(middlewares []Middleware, handler HandlerFunc) HandlerFunc
 
 // Handle the transition between net/http and go-json-rest objects.
 // It intanciates the rest.Request and rest.ResponseWriter, ...
-func adapterFunc(handler HandlerFunc) http.HandlerFunc {
+func adapterFunc(handler HandlerFunc, codec JsonCodec) http.HandlerFunc {
 
 	return func(origWriter http.ResponseWriter, origRequest *http.Request) {
 
 		// instantiate the rest objects
 		request := &Request{
-			origRequest,
+			withRequestValues(origRequest),
 			nil,
 			map[string]interface{}{},
+			codec,
+			nil,
 		}
 
 		writer := &responseWriter{
 			origWriter,
 			false,
+			codec,
 		}
 
 		// call the wrapped handler
@@ -38,9 +38,9 @@ func TestWrapMiddlewares(t *testing.T) {
 
 	// fake request
 	r := &Request{
-		nil,
-		nil,
-		map[string]interface{}{},
+		Request:    nil,
+		PathParams: nil,
+		Env:        map[string]interface{}{},
 	}
 
 	handlerFunc(nil, r)
@@ -0,0 +1,238 @@
+package rest
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// MsgpackEntityEncoder produces "application/msgpack", following the MessagePack specification.
+// (See https://github.com/msgpack/msgpack/blob/master/spec.md)
+// The struct fields are encoded as map entries, named after the "msgpack" tag, then the "json"
+// tag, then the field name. The values implementing encoding.TextMarshaler (eg: time.Time)
+// are encoded as strings. The map entries are sorted by key when the keys are strings.
+type MsgpackEntityEncoder struct{}
+
+// ContentType makes MsgpackEntityEncoder implement the EntityEncoder interface.
+func (e *MsgpackEntityEncoder) ContentType() string {
+	return "application/msgpack"
+}
+
+// Encode makes MsgpackEntityEncoder implement the EntityEncoder interface.
+func (e *MsgpackEntityEncoder) Encode(v interface{}) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	err := encodeMsgpack(buffer, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+func encodeMsgpack(buffer *bytes.Buffer, value reflect.Value) error {
+
+	if !value.IsValid() {
+		buffer.WriteByte(0xc0)
+		return nil
+	}
+
+	if value.Type().Implements(textMarshalerType) {
+		if value.Kind() == reflect.Ptr && value.IsNil() {
+			buffer.WriteByte(0xc0)
+			return nil
+		}
+		text, err := value.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		writeMsgpackString(buffer, string(text))
+		return nil
+	}
+
+	switch value.Kind() {
+
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			buffer.WriteByte(0xc0)
+			return nil
+		}
+		return encodeMsgpack(buffer, value.Elem())
+
+	case reflect.Bool:
+		if value.Bool() {
+			buffer.WriteByte(0xc3)
+		} else {
+			buffer.WriteByte(0xc2)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgpackInt(buffer, value.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeMsgpackUint(buffer, value.Uint())
+
+	case reflect.Float32:
+		buffer.WriteByte(0xca)
+		binary.Write(buffer, binary.BigEndian, math.Float32bits(float32(value.Float())))
+
+	case reflect.Float64:
+		buffer.WriteByte(0xcb)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(value.Float()))
+
+	case reflect.String:
+		writeMsgpackString(buffer, value.String())
+
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			buffer.WriteByte(0xc0)
+			return nil
+		}
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, value.Len())
+			reflect.Copy(reflect.ValueOf(data), value)
+			writeMsgpackBinary(buffer, data)
+			return nil
+		}
+		writeMsgpackHeader(buffer, value.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < value.Len(); i++ {
+			if err := encodeMsgpack(buffer, value.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if value.IsNil() {
+			buffer.WriteByte(0xc0)
+			return nil
+		}
+		keys := value.MapKeys()
+		if value.Type().Key().Kind() == reflect.String {
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		}
+		writeMsgpackHeader(buffer, len(keys), 0x80, 0xde, 0xdf)
+		for _, key := range keys {
+			if err := encodeMsgpack(buffer, key); err != nil {
+				return err
+			}
+			if err := encodeMsgpack(buffer, value.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Struct:
+		fields := []entityField{}
+		for _, field := range entityFields(value.Type(), "msgpack") {
+			if field.omitEmpty && value.FieldByIndex(field.index).IsZero() {
+				continue
+			}
+			fields = append(fields, field)
+		}
+		writeMsgpackHeader(buffer, len(fields), 0x80, 0xde, 0xdf)
+		for _, field := range fields {
+			writeMsgpackString(buffer, field.name)
+			if err := encodeMsgpack(buffer, value.FieldByIndex(field.index)); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("MessagePack encoding of %s is not supported", value.Type())
+	}
+
+	return nil
+}
+
+// Write the header of an array or a map, using the fix, 16 or 32 format.
+func writeMsgpackHeader(buffer *bytes.Buffer, length int, fix byte, code16 byte, code32 byte) {
+	switch {
+	case length < 16:
+		buffer.WriteByte(fix | byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(code16)
+		binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(code32)
+		binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+}
+
+func writeMsgpackInt(buffer *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		writeMsgpackUint(buffer, uint64(i))
+	case i >= -32:
+		// negative fixint
+		buffer.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buffer.WriteByte(0xd0)
+		buffer.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		buffer.WriteByte(0xd1)
+		binary.Write(buffer, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buffer.WriteByte(0xd2)
+		binary.Write(buffer, binary.BigEndian, int32(i))
+	default:
+		buffer.WriteByte(0xd3)
+		binary.Write(buffer, binary.BigEndian, i)
+	}
+}
+
+func writeMsgpackUint(buffer *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 0x7f:
+		// positive fixint
+		buffer.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buffer.WriteByte(0xcc)
+		buffer.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		buffer.WriteByte(0xcd)
+		binary.Write(buffer, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buffer.WriteByte(0xce)
+		binary.Write(buffer, binary.BigEndian, uint32(u))
+	default:
+		buffer.WriteByte(0xcf)
+		binary.Write(buffer, binary.BigEndian, u)
+	}
+}
+
+func writeMsgpackString(buffer *bytes.Buffer, s string) {
+	length := len(s)
+	switch {
+	case length < 32:
+		buffer.WriteByte(0xa0 | byte(length))
+	case length <= math.MaxUint8:
+		buffer.WriteByte(0xd9)
+		buffer.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(0xda)
+		binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(0xdb)
+		binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+	buffer.WriteString(s)
+}
+
+func writeMsgpackBinary(buffer *bytes.Buffer, data []byte) {
+	length := len(data)
+	switch {
+	case length <= math.MaxUint8:
+		buffer.WriteByte(0xc4)
+		buffer.WriteByte(byte(length))
+	case length <= math.MaxUint16:
+		buffer.WriteByte(0xc5)
+		binary.Write(buffer, binary.BigEndian, uint16(length))
+	default:
+		buffer.WriteByte(0xc6)
+		binary.Write(buffer, binary.BigEndian, uint32(length))
+	}
+	buffer.Write(data)
+}
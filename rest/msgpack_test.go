@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMsgpackEntityEncoder(t *testing.T) {
+
+	type embedded struct {
+		Tag string
+	}
+
+	type record struct {
+		embedded
+		Id       int    `msgpack:"id"`
+		Skipped  string `json:"-"`
+		Optional string `json:"opt,omitempty"`
+		private  string
+	}
+
+	cases := []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{false, []byte{0xc2}},
+		{1, []byte{0x01}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{200, []byte{0xcc, 0xc8}},
+		{-200, []byte{0xd1, 0xff, 0x38}},
+		{70000, []byte{0xce, 0x00, 0x01, 0x11, 0x70}},
+		{uint64(1 << 40), []byte{0xcf, 0, 0, 0x01, 0, 0, 0, 0, 0}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{float32(1.5), []byte{0xca, 0x3f, 0xc0, 0, 0}},
+		{"abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{[]byte{1, 2}, []byte{0xc4, 0x02, 0x01, 0x02}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]int{"b": 2, "a": 1}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}},
+		{
+			&record{embedded{"t"}, 7, "skipped", "", "private"},
+			[]byte{0x82, 0xa3, 'T', 'a', 'g', 0xa1, 't', 0xa2, 'i', 'd', 0x07},
+		},
+		{
+			time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+			append([]byte{0xb4}, "2015-01-02T03:04:05Z"...),
+		},
+	}
+
+	encoder := &MsgpackEntityEncoder{}
+
+	for _, c := range cases {
+		b, err := encoder.Encode(c.value)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", c.value, err)
+			continue
+		}
+		if !bytes.Equal(b, c.expected) {
+			t.Errorf("%v: % x expected, got: % x", c.value, c.expected, b)
+		}
+	}
+
+	// long string and array headers
+	b, _ := encoder.Encode(string(make([]byte, 40)))
+	if !bytes.Equal(b[:2], []byte{0xd9, 40}) {
+		t.Errorf("str8 header expected, got: % x", b[:2])
+	}
+	b, _ = encoder.Encode(make([]bool, 20))
+	if !bytes.Equal(b[:3], []byte{0xdc, 0, 20}) {
+		t.Errorf("array16 header expected, got: % x", b[:3])
+	}
+
+	if _, err := encoder.Encode(make(chan int)); err == nil {
+		t.Error("Expected an error for unsupported types")
+	}
+}
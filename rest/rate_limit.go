@@ -0,0 +1,274 @@
+package rest
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit defines a token bucket: Requests tokens are added per Period, up to Burst tokens.
+type RateLimit struct {
+
+	// Number of requests allowed per Period. Required.
+	Requests int
+
+	// Period of time over which Requests are allowed. Required.
+	Period time.Duration
+
+	// Maximum number of requests allowed at once. Optional, defaults to Requests.
+	Burst int
+}
+
+func (l RateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// tokens per nanosecond
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / float64(l.Period)
+}
+
+// RateLimitResult is returned by the RateLimitStore for each request.
+type RateLimitResult struct {
+
+	// True if a token was available, and the request can proceed.
+	Allowed bool
+
+	// Number of tokens left in the bucket.
+	Remaining int
+
+	// Time until the bucket is full again.
+	Reset time.Duration
+
+	// Time until the next token is available, only set when the request is not allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimitStore defines the interface that objects must implement in order to keep the token
+// buckets of the RateLimitMiddleware. A shared implementation is required when the requests are
+// load balanced between multiple processes.
+type RateLimitStore interface {
+
+	// Take removes one token from the bucket of the key, created full if it does not exist.
+	Take(key string, limit RateLimit) (*RateLimitResult, error)
+}
+
+const rateLimitShards = 32
+
+// InMemoryRateLimitStore is a RateLimitStore implementation that keeps the buckets in memory,
+// spread over several shards to reduce the lock contention. As a shard grows, the buckets that
+// are full again are removed, since they are equivalent to new ones. It is safe for concurrent
+// use.
+type InMemoryRateLimitStore struct {
+	shards [rateLimitShards]rateLimitShard
+}
+
+type rateLimitShard struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	sweepAt int
+}
+
+// The capacity and rate of the last limit applied to the bucket are kept for the sweep, since the
+// store can be shared by different limits.
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	capacity float64
+	rate     float64
+}
+
+// NewInMemoryRateLimitStore returns an empty InMemoryRateLimitStore.
+func NewInMemoryRateLimitStore() *InMemoryRateLimitStore {
+	store := &InMemoryRateLimitStore{}
+	for i := range store.shards {
+		store.shards[i].buckets = map[string]*tokenBucket{}
+		store.shards[i].sweepAt = 1024
+	}
+	return store
+}
+
+// Len returns the number of buckets in the store.
+func (s *InMemoryRateLimitStore) Len() int {
+	count := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		count += len(shard.buckets)
+		shard.lock.Unlock()
+	}
+	return count
+}
+
+// Take makes InMemoryRateLimitStore implement the RateLimitStore interface.
+func (s *InMemoryRateLimitStore) Take(key string, limit RateLimit) (*RateLimitResult, error) {
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	shard := &s.shards[hash.Sum32()%rateLimitShards]
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	now := time.Now()
+	capacity := limit.capacity()
+	rate := limit.rate()
+
+	bucket := shard.buckets[key]
+	if bucket == nil {
+		if len(shard.buckets) >= shard.sweepAt {
+			shard.sweep(now)
+		}
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		shard.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(capacity, bucket.tokens+float64(now.Sub(bucket.last))*rate)
+	bucket.last = now
+	bucket.capacity = capacity
+	bucket.rate = rate
+
+	result := &RateLimitResult{}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) / rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((capacity - bucket.tokens) / rate)
+
+	return result, nil
+}
+
+// Remove the buckets that are full again, according to their own limit, and adjust the next sweep
+// to the remaining size.
+func (shard *rateLimitShard) sweep(now time.Time) {
+	for key, bucket := range shard.buckets {
+		if bucket.tokens+float64(now.Sub(bucket.last))*bucket.rate >= bucket.capacity {
+			delete(shard.buckets, key)
+		}
+	}
+	shard.sweepAt = 2 * len(shard.buckets)
+	if shard.sweepAt < 1024 {
+		shard.sweepAt = 1024
+	}
+}
+
+// RateLimitByRemoteAddr is a RateLimitMiddleware KeyFunc that returns the IP of the client.
+func RateLimitByRemoteAddr(request *Request) string {
+	if ip, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return ip
+	}
+	return request.RemoteAddr
+}
+
+// RateLimitByUser is a RateLimitMiddleware KeyFunc that returns request.RemoteUser(), as set
+// by the authentication middlewares, or the IP of the client for the anonymous requests.
+func RateLimitByUser(request *Request) string {
+	if user, ok := request.RemoteUser(); ok && user != "" {
+		return "user:" + user
+	}
+	return RateLimitByRemoteAddr(request)
+}
+
+// RateLimitByHeader returns a RateLimitMiddleware KeyFunc that returns the value of the request
+// header, eg: an API key, or the IP of the client for the requests without the header.
+func RateLimitByHeader(name string) func(request *Request) string {
+	return func(request *Request) string {
+		if value := request.Header.Get(name); value != "" {
+			return "header:" + value
+		}
+		return RateLimitByRemoteAddr(request)
+	}
+}
+
+// RateLimitByRoute returns a RateLimitMiddleware KeyFunc that prefixes the key returned by keyFunc
+// with the PathExp of the Route, so a Store can be shared between the Routes. It depends on
+// request.Route() set by the router, the middleware must be used on a per Route basis.
+func RateLimitByRoute(keyFunc func(request *Request) string) func(request *Request) string {
+	return func(request *Request) string {
+		key := keyFunc(request)
+		if route, ok := request.Route(); ok && key != "" {
+			return route.HttpMethod + " " + route.PathExp + " " + key
+		}
+		return key
+	}
+}
+
+// RateLimitMiddleware limits the rate of the requests per client with a token bucket. The
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers are set on the responses. When
+// the limit is reached, a StatusTooManyRequests (429) HTTP error response is returned, with a
+// Retry-After header.
+//
+// Per Route limits can be set by wrapping the Route handlers, post routing, see WrapMiddlewares
+// and RateLimitByRoute.
+type RateLimitMiddleware struct {
+
+	// The limit applied to each key. Required.
+	Limit RateLimit
+
+	// Callback function that returns the key identifying the client. The requests with an empty
+	// key are not limited. Optional, defaults to RateLimitByRemoteAddr.
+	KeyFunc func(request *Request) string
+
+	// Store of the token buckets. Optional, defaults to a new InMemoryRateLimitStore.
+	Store RateLimitStore
+}
+
+// MiddlewareFunc makes RateLimitMiddleware implement the Middleware interface.
+func (mw *RateLimitMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.Limit.Requests <= 0 || mw.Limit.Period <= 0 {
+		log.Fatal("Limit is required")
+	}
+	if mw.KeyFunc == nil {
+		mw.KeyFunc = RateLimitByRemoteAddr
+	}
+	if mw.Store == nil {
+		mw.Store = NewInMemoryRateLimitStore()
+	}
+
+	limit := strconv.Itoa(int(mw.Limit.capacity()))
+
+	return func(writer ResponseWriter, request *Request) {
+
+		key := mw.KeyFunc(request)
+		if key == "" {
+			handler(writer, request)
+			return
+		}
+
+		result, err := mw.Store.Take(key, mw.Limit)
+		if err != nil {
+			Error(writer, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		header := writer.Header()
+		header.Set("RateLimit-Limit", limit)
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+		if !result.Allowed {
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			Error(writer, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+
+		handler(writer, request)
+	}
+}
+
+// ceilSeconds rounds the duration up to the second, as expected by the Retry-After header.
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
@@ -0,0 +1,182 @@
+package rest
+
+import (
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&RateLimitMiddleware{
+		Limit: RateLimit{Requests: 2, Period: time.Minute},
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("RateLimit-Limit", "2")
+	recorded.HeaderIs("RateLimit-Remaining", "1")
+
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+	recorded.HeaderIs("RateLimit-Remaining", "0")
+	recorded.HeaderIs("RateLimit-Reset", "60")
+
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(429)
+	recorded.ContentTypeIsJson()
+	recorded.HeaderIs("Retry-After", "30")
+
+	// another client, another bucket
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "127.0.0.2:1234"
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+}
+
+func TestRateLimitMiddlewarePerRoute(t *testing.T) {
+
+	store := NewInMemoryRateLimitStore()
+	limited := func(handler HandlerFunc) HandlerFunc {
+		return WrapMiddlewares([]Middleware{&RateLimitMiddleware{
+			Limit:   RateLimit{Requests: 1, Period: time.Minute},
+			KeyFunc: RateLimitByRoute(RateLimitByUser),
+			Store:   store,
+		}}, handler)
+	}
+
+	api := NewApi()
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			r.Env["REMOTE_USER"] = r.Header.Get("X-User")
+			handler(w, r)
+		}
+	}))
+	router, err := MakeRouter(
+		Get("/a", limited(func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": "a"})
+		})),
+		Get("/b", limited(func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": "b"})
+		})),
+		Get("/c", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": "c"})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	for _, path := range []string{"/a", "/b"} {
+		req := test.MakeSimpleRequest("GET", "http://localhost"+path, nil)
+		req.Header.Set("X-User", "alice")
+		test.RunRequest(t, handler, req).CodeIs(200)
+		test.RunRequest(t, handler, req).CodeIs(429)
+
+		// another user
+		req.Header.Set("X-User", "bob")
+		test.RunRequest(t, handler, req).CodeIs(200)
+	}
+
+	// not limited
+	for i := 0; i < 3; i++ {
+		test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/c", nil)).CodeIs(200)
+	}
+
+	if store.Len() != 4 {
+		t.Errorf("4 buckets expected, got %d", store.Len())
+	}
+}
+
+func TestRateLimitByHeader(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&RateLimitMiddleware{
+		Limit:   RateLimit{Requests: 1, Period: time.Minute},
+		KeyFunc: RateLimitByHeader("X-Api-Key"),
+	})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+	handler := api.MakeHandler()
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Api-Key", "k1")
+	test.RunRequest(t, handler, req).CodeIs(200)
+	test.RunRequest(t, handler, req).CodeIs(429)
+
+	// the requests without the header are limited by IP
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	test.RunRequest(t, handler, req).CodeIs(200)
+	test.RunRequest(t, handler, req).CodeIs(429)
+
+	// and the header value cannot take the bucket of an IP
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.RemoteAddr = "127.0.0.2:1234"
+	req.Header.Set("X-Api-Key", "127.0.0.2")
+	test.RunRequest(t, handler, req).CodeIs(200)
+	req.Header.Del("X-Api-Key")
+	test.RunRequest(t, handler, req).CodeIs(200)
+}
+
+func TestInMemoryRateLimitStoreSweep(t *testing.T) {
+
+	store := NewInMemoryRateLimitStore()
+	limit := RateLimit{Requests: 1000, Period: time.Millisecond}
+
+	for i := 0; i < 100000; i++ {
+		result, _ := store.Take(strconv.Itoa(i), limit)
+		if !result.Allowed {
+			t.Fatal("New bucket expected to allow the request")
+		}
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	// the new buckets trigger the removal of the full ones
+	for i := 0; i < 100000; i++ {
+		store.Take("new"+strconv.Itoa(i), limit)
+	}
+	if store.Len() >= 200000 {
+		t.Errorf("Full buckets expected to be removed, got %d buckets", store.Len())
+	}
+}
+
+func TestInMemoryRateLimitStoreSharedLimits(t *testing.T) {
+
+	store := NewInMemoryRateLimitStore()
+	strict := RateLimit{Requests: 2, Period: time.Hour}
+	lenient := RateLimit{Requests: 1000, Period: time.Millisecond}
+
+	result, _ := store.Take("strict", strict)
+	if !result.Allowed || result.Remaining != 1 {
+		t.Fatalf("Allowed request with 1 remaining expected, got %+v", result)
+	}
+
+	// the sweeps triggered by the lenient limit must keep the partially used strict bucket
+	for i := 0; i < 100000; i++ {
+		store.Take(strconv.Itoa(i), lenient)
+	}
+
+	result, _ = store.Take("strict", strict)
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Allowed request with 0 remaining expected, got %+v", result)
+	}
+	result, _ = store.Take("strict", strict)
+	if result.Allowed {
+		t.Error("Rejected request expected")
+	}
+}
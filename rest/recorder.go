@@ -8,8 +8,9 @@ import (
 
 // RecorderMiddleware keeps a record of the HTTP status code of the response,
 // and the number of bytes written.
-// The result is available to the wrapping handlers as request.Env["STATUS_CODE"].(int),
-// and as request.Env["BYTES_WRITTEN"].(int64)
+// The result is available to the wrapping handlers as request.StatusCode(),
+// and as request.BytesWritten(). (also as request.Env["STATUS_CODE"].(int) and
+// request.Env["BYTES_WRITTEN"].(int64) for compatibility)
 type RecorderMiddleware struct{}
 
 // MiddlewareFunc makes RecorderMiddleware implement the Middleware interface.
@@ -21,8 +22,8 @@ func (mw *RecorderMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 		// call the handler
 		h(writer, r)
 
-		r.Env["STATUS_CODE"] = writer.statusCode
-		r.Env["BYTES_WRITTEN"] = writer.bytesWritten
+		r.SetStatusCode(writer.statusCode)
+		r.SetBytesWritten(writer.bytesWritten)
 	}
 }
 
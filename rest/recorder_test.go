@@ -57,6 +57,8 @@ func TestRecorderAndGzipMiddleware(t *testing.T) {
 
 	api := NewApi()
 
+	bytesWritten := int64(0)
+
 	// a middleware carrying the Env tests
 	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
 		return func(w ResponseWriter, r *Request) {
@@ -66,11 +68,7 @@ func TestRecorderAndGzipMiddleware(t *testing.T) {
 			if r.Env["BYTES_WRITTEN"] == nil {
 				t.Error("BYTES_WRITTEN is nil")
 			}
-			bytesWritten := r.Env["BYTES_WRITTEN"].(int64)
-			// Yes, the gzipped version actually takes more space.
-			if bytesWritten != 41 {
-				t.Errorf("BYTES_WRITTEN 41 expected, got %d", bytesWritten)
-			}
+			bytesWritten = r.Env["BYTES_WRITTEN"].(int64)
 		}
 	}))
 
@@ -91,6 +89,12 @@ func TestRecorderAndGzipMiddleware(t *testing.T) {
 	recorded := test.RunRequest(t, handler, req)
 	recorded.CodeIs(200)
 	recorded.ContentTypeIsJson()
+
+	// the compressed size, that depends on the compress/gzip implementation.
+	// Yes, the gzipped version actually takes more space.
+	if bytesWritten != int64(recorded.Recorder.Body.Len()) || bytesWritten <= 12 {
+		t.Errorf("BYTES_WRITTEN %d expected, got %d", recorded.Recorder.Body.Len(), bytesWritten)
+	}
 }
 
 //Underlying net/http only allows you to set the status code once
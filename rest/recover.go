@@ -4,13 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"runtime/debug"
 )
 
 // RecoverMiddleware catches the panic errors that occur in the wrapped HandleFunc,
-// and convert them to 500 responses.
+// and convert them to 500 responses. The log records include request.RequestId(), when set by
+// the RequestIdMiddleware. When Handler is set, the panics are logged as log/slog records instead,
+// with the panic and stack attributes, and the attributes of request.Logger().
 type RecoverMiddleware struct {
 
 	// Custom logger used for logging the panic errors,
@@ -20,6 +23,10 @@ type RecoverMiddleware struct {
 	// If true, the log records will be printed as JSON. Convenient for log parsing.
 	EnableLogAsJson bool
 
+	// Handler receiving the log/slog records of the panic errors. Optional, when set, Logger
+	// and EnableLogAsJson are ignored.
+	Handler slog.Handler
+
 	// If true, when a "panic" happens, the error string and the stack trace will be
 	// printed in the 500 response body.
 	EnableResponseStackTrace bool
@@ -39,10 +46,29 @@ func (mw *RecoverMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 		defer func() {
 			if reco := recover(); reco != nil {
 				trace := debug.Stack()
+				// raised again by the TimeoutMiddleware, from the goroutine of the handler
+				if panicked, ok := reco.(*handlerPanic); ok {
+					reco, trace = panicked.value, panicked.stack
+				}
 
 				// log the trace
 				message := fmt.Sprintf("%s\n%s", reco, trace)
-				mw.logError(message)
+				if mw.Handler != nil {
+					logger := slog.New(mw.Handler).With(
+						slog.String("method", r.Method),
+						slog.String("path", r.URL.Path),
+					)
+					requestLogger(r.Context(), logger).LogAttrs(
+						r.Context(),
+						slog.LevelError,
+						"panic",
+						slog.String("panic", fmt.Sprint(reco)),
+						slog.String("stack", string(trace)),
+					)
+				} else {
+					requestId, _ := r.RequestId()
+					mw.logError(message, requestId)
+				}
 
 				// write error response
 				if mw.EnableResponseStackTrace {
@@ -58,16 +84,21 @@ func (mw *RecoverMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 	}
 }
 
-func (mw *RecoverMiddleware) logError(message string) {
+func (mw *RecoverMiddleware) logError(message string, requestId string) {
 	if mw.EnableLogAsJson {
 		record := map[string]string{
 			"error": message,
 		}
+		if requestId != "" {
+			record["request_id"] = requestId
+		}
 		b, err := json.Marshal(&record)
 		if err != nil {
 			panic(err)
 		}
 		mw.Logger.Printf("%s", b)
+	} else if requestId != "" {
+		mw.Logger.Printf("[%s] %s", requestId, message)
 	} else {
 		mw.Logger.Print(message)
 	}
@@ -1,9 +1,13 @@
 package rest
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/ant0ine/go-json-rest/rest/test"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"strings"
 	"testing"
 )
 
@@ -41,3 +45,32 @@ func TestRecoverMiddleware(t *testing.T) {
 		t.Errorf("Expected an error message, got: %v", payload)
 	}
 }
+
+func TestRecoverMiddlewareSlog(t *testing.T) {
+
+	buffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&RecoverMiddleware{
+		Handler: slog.NewJSONHandler(buffer, nil),
+	})
+	api.Use(&RequestIdMiddleware{})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		panic("test")
+	}))
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	test.RunRequest(t, api.MakeHandler(), req).CodeIs(500)
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "ERROR" || record["panic"] != "test" || record["request_id"] != "abc" {
+		t.Errorf("Unexpected record: %v", record)
+	}
+	if !strings.Contains(record["stack"].(string), "runtime/debug.Stack") {
+		t.Errorf("Stack trace expected, got: %v", record["stack"])
+	}
+}
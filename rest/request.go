@@ -1,7 +1,6 @@
 package rest
 
 import (
-	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
@@ -23,6 +22,11 @@ type Request struct {
 
 	// Environment used by middlewares to communicate.
 	Env map[string]interface{}
+
+	codec JsonCodec
+
+	// set by the ContentNegotiationMiddleware
+	decoder EntityDecoder
 }
 
 // PathParam provides a convenient access to the PathParams map.
@@ -30,7 +34,9 @@ func (r *Request) PathParam(name string) string {
 	return r.PathParams[name]
 }
 
-// DecodeJsonPayload reads the request body and decodes the JSON using json.Unmarshal.
+// DecodeJsonPayload reads the request body and decodes the JSON using the JsonCodec of the Api,
+// json.Unmarshal by default. When the ContentNegotiationMiddleware has matched the request
+// Content-Type to an EntityDecoder, eg: XmlEntityEncoder, the payload is decoded with it instead.
 func (r *Request) DecodeJsonPayload(v interface{}) error {
 	content, err := ioutil.ReadAll(r.Body)
 	r.Body.Close()
@@ -40,13 +46,25 @@ func (r *Request) DecodeJsonPayload(v interface{}) error {
 	if len(content) == 0 {
 		return ErrJsonPayloadEmpty
 	}
-	err = json.Unmarshal(content, v)
+	if r.decoder != nil {
+		return r.decoder.Decode(content, v)
+	}
+	err = r.jsonCodec().Unmarshal(content, v)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Return the JsonCodec set by the Api, or the default one if the Request was not
+// instantiated by the Api.
+func (r *Request) jsonCodec() JsonCodec {
+	if r.codec == nil {
+		return defaultJsonCodec
+	}
+	return r.codec
+}
+
 // BaseUrl returns a new URL object with the Host and Scheme taken from the request.
 // (without the trailing slash in the host)
 func (r *Request) BaseUrl() *url.URL {
@@ -0,0 +1,370 @@
+package rest
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type requestValuesKey struct{}
+
+// The values shared by the middlewares, kept in the http.Request context. They are set once per
+// request, but may be read and written from different goroutines, see TimeoutMiddleware.
+// The setters also write the request.Env keys, and the Request getters read these keys first, so
+// the code that writes the Env directly is still seen by the middlewares. Such direct writes are
+// not visible to the XxxFromContext functions.
+type requestValues struct {
+	lock sync.Mutex
+
+	startTime    *time.Time
+	elapsedTime  *time.Duration
+	statusCode   *int
+	bytesWritten *int64
+	remoteUser   *string
+	requestId    *string
+	traceId      *string
+	apiKeyScopes []string
+	route        *Route
+	logger       *slog.Logger
+}
+
+// withRequestValues returns the http.Request with an empty set of values in its context, unless it
+// already has one.
+func withRequestValues(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(requestValuesKey{}).(*requestValues); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestValuesKey{}, &requestValues{}))
+}
+
+func valuesFromContext(ctx context.Context) *requestValues {
+	values, _ := ctx.Value(requestValuesKey{}).(*requestValues)
+	return values
+}
+
+// values returns the values of the request, created if necessary.
+func (r *Request) values() *requestValues {
+	values := valuesFromContext(r.Context())
+	if values == nil {
+		r.Request = withRequestValues(r.Request)
+		values = valuesFromContext(r.Context())
+	}
+	return values
+}
+
+// StartTimeFromContext returns the time the request entered the TimerMiddleware.
+func StartTimeFromContext(ctx context.Context) (time.Time, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.startTime != nil {
+			return *values.startTime, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// ElapsedTimeFromContext returns the time spent in the handlers wrapped by the TimerMiddleware.
+func ElapsedTimeFromContext(ctx context.Context) (time.Duration, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.elapsedTime != nil {
+			return *values.elapsedTime, true
+		}
+	}
+	return 0, false
+}
+
+// StatusCodeFromContext returns the status code of the response, as recorded by the
+// RecorderMiddleware.
+func StatusCodeFromContext(ctx context.Context) (int, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.statusCode != nil {
+			return *values.statusCode, true
+		}
+	}
+	return 0, false
+}
+
+// BytesWrittenFromContext returns the size of the response body, as recorded by the
+// RecorderMiddleware.
+func BytesWrittenFromContext(ctx context.Context) (int64, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.bytesWritten != nil {
+			return *values.bytesWritten, true
+		}
+	}
+	return 0, false
+}
+
+// RemoteUserFromContext returns the id of the user, as set by the authentication middlewares.
+func RemoteUserFromContext(ctx context.Context) (string, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.remoteUser != nil {
+			return *values.remoteUser, true
+		}
+	}
+	return "", false
+}
+
+// RequestIdFromContext returns the id of the request, as set by the RequestIdMiddleware.
+func RequestIdFromContext(ctx context.Context) (string, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.requestId != nil {
+			return *values.requestId, true
+		}
+	}
+	return "", false
+}
+
+// TraceIdFromContext returns the id of the trace, as set by the TracingMiddleware.
+func TraceIdFromContext(ctx context.Context) (string, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.traceId != nil {
+			return *values.traceId, true
+		}
+	}
+	return "", false
+}
+
+// ApiKeyScopesFromContext returns the scopes of the API key, as set by the ApiKeyMiddleware.
+func ApiKeyScopesFromContext(ctx context.Context) ([]string, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.apiKeyScopes != nil {
+			return values.apiKeyScopes, true
+		}
+	}
+	return nil, false
+}
+
+// RouteFromContext returns the Route matched by the router.
+func RouteFromContext(ctx context.Context) (*Route, bool) {
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		defer values.lock.Unlock()
+		if values.route != nil {
+			return values.route, true
+		}
+	}
+	return nil, false
+}
+
+// LoggerFromContext returns the logger of the request, as set by the AccessLogSlogMiddleware,
+// defaults to slog.Default(). The returned logger includes the request id, trace id, user and route
+// pattern attributes known at the time of the call.
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if values := valuesFromContext(ctx); values != nil {
+		values.lock.Lock()
+		if values.logger != nil {
+			logger = values.logger
+		}
+		values.lock.Unlock()
+	}
+	return requestLogger(ctx, logger)
+}
+
+// requestLogger returns the logger with the attributes of the request values.
+func requestLogger(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	args := []interface{}{}
+	if requestId, ok := RequestIdFromContext(ctx); ok && requestId != "" {
+		args = append(args, slog.String("request_id", requestId))
+	}
+	if traceId, ok := TraceIdFromContext(ctx); ok && traceId != "" {
+		args = append(args, slog.String("trace_id", traceId))
+	}
+	if remoteUser, ok := RemoteUserFromContext(ctx); ok && remoteUser != "" {
+		args = append(args, slog.String("user", remoteUser))
+	}
+	if route, ok := RouteFromContext(ctx); ok {
+		args = append(args, slog.String("route", route.PathExp))
+	}
+	if len(args) == 0 {
+		return logger
+	}
+	return logger.With(args...)
+}
+
+// StartTime returns the time the request entered the TimerMiddleware.
+func (r *Request) StartTime() (time.Time, bool) {
+	if startTime, ok := r.Env["START_TIME"].(*time.Time); ok && startTime != nil {
+		return *startTime, true
+	}
+	return StartTimeFromContext(r.Context())
+}
+
+// SetStartTime sets the value returned by StartTime, and request.Env["START_TIME"].
+func (r *Request) SetStartTime(startTime time.Time) {
+	values := r.values()
+	values.lock.Lock()
+	values.startTime = &startTime
+	values.lock.Unlock()
+	r.Env["START_TIME"] = &startTime
+}
+
+// ElapsedTime returns the time spent in the handlers wrapped by the TimerMiddleware.
+func (r *Request) ElapsedTime() (time.Duration, bool) {
+	if elapsedTime, ok := r.Env["ELAPSED_TIME"].(*time.Duration); ok && elapsedTime != nil {
+		return *elapsedTime, true
+	}
+	return ElapsedTimeFromContext(r.Context())
+}
+
+// SetElapsedTime sets the value returned by ElapsedTime, and request.Env["ELAPSED_TIME"].
+func (r *Request) SetElapsedTime(elapsedTime time.Duration) {
+	values := r.values()
+	values.lock.Lock()
+	values.elapsedTime = &elapsedTime
+	values.lock.Unlock()
+	r.Env["ELAPSED_TIME"] = &elapsedTime
+}
+
+// StatusCode returns the status code of the response, as recorded by the RecorderMiddleware.
+func (r *Request) StatusCode() (int, bool) {
+	if statusCode, ok := r.Env["STATUS_CODE"].(int); ok {
+		return statusCode, true
+	}
+	return StatusCodeFromContext(r.Context())
+}
+
+// SetStatusCode sets the value returned by StatusCode, and request.Env["STATUS_CODE"].
+func (r *Request) SetStatusCode(statusCode int) {
+	values := r.values()
+	values.lock.Lock()
+	values.statusCode = &statusCode
+	values.lock.Unlock()
+	r.Env["STATUS_CODE"] = statusCode
+}
+
+// BytesWritten returns the size of the response body, as recorded by the RecorderMiddleware.
+func (r *Request) BytesWritten() (int64, bool) {
+	if bytesWritten, ok := r.Env["BYTES_WRITTEN"].(int64); ok {
+		return bytesWritten, true
+	}
+	return BytesWrittenFromContext(r.Context())
+}
+
+// SetBytesWritten sets the value returned by BytesWritten, and request.Env["BYTES_WRITTEN"].
+func (r *Request) SetBytesWritten(bytesWritten int64) {
+	values := r.values()
+	values.lock.Lock()
+	values.bytesWritten = &bytesWritten
+	values.lock.Unlock()
+	r.Env["BYTES_WRITTEN"] = bytesWritten
+}
+
+// RemoteUser returns the id of the user, as set by the authentication middlewares.
+func (r *Request) RemoteUser() (string, bool) {
+	if remoteUser, ok := r.Env["REMOTE_USER"].(string); ok {
+		return remoteUser, true
+	}
+	return RemoteUserFromContext(r.Context())
+}
+
+// SetRemoteUser sets the value returned by RemoteUser, and request.Env["REMOTE_USER"].
+func (r *Request) SetRemoteUser(remoteUser string) {
+	values := r.values()
+	values.lock.Lock()
+	values.remoteUser = &remoteUser
+	values.lock.Unlock()
+	r.Env["REMOTE_USER"] = remoteUser
+}
+
+// RequestId returns the id of the request, as set by the RequestIdMiddleware.
+func (r *Request) RequestId() (string, bool) {
+	if requestId, ok := r.Env["REQUEST_ID"].(string); ok {
+		return requestId, true
+	}
+	return RequestIdFromContext(r.Context())
+}
+
+// SetRequestId sets the value returned by RequestId, and request.Env["REQUEST_ID"].
+func (r *Request) SetRequestId(requestId string) {
+	values := r.values()
+	values.lock.Lock()
+	values.requestId = &requestId
+	values.lock.Unlock()
+	r.Env["REQUEST_ID"] = requestId
+}
+
+// TraceId returns the id of the trace, as set by the TracingMiddleware.
+func (r *Request) TraceId() (string, bool) {
+	if traceId, ok := r.Env["TRACE_ID"].(string); ok {
+		return traceId, true
+	}
+	return TraceIdFromContext(r.Context())
+}
+
+// SetTraceId sets the value returned by TraceId, and request.Env["TRACE_ID"].
+func (r *Request) SetTraceId(traceId string) {
+	values := r.values()
+	values.lock.Lock()
+	values.traceId = &traceId
+	values.lock.Unlock()
+	r.Env["TRACE_ID"] = traceId
+}
+
+// ApiKeyScopes returns the scopes of the API key, as set by the ApiKeyMiddleware.
+func (r *Request) ApiKeyScopes() ([]string, bool) {
+	if apiKeyScopes, ok := r.Env["API_KEY_SCOPES"].([]string); ok {
+		return apiKeyScopes, true
+	}
+	return ApiKeyScopesFromContext(r.Context())
+}
+
+// SetApiKeyScopes sets the value returned by ApiKeyScopes, and request.Env["API_KEY_SCOPES"].
+func (r *Request) SetApiKeyScopes(apiKeyScopes []string) {
+	if apiKeyScopes == nil {
+		apiKeyScopes = []string{}
+	}
+	values := r.values()
+	values.lock.Lock()
+	values.apiKeyScopes = apiKeyScopes
+	values.lock.Unlock()
+	r.Env["API_KEY_SCOPES"] = apiKeyScopes
+}
+
+// Route returns the Route matched by the router. It is available to the per Route middlewares,
+// and to the wrapping middlewares once the handler has returned.
+func (r *Request) Route() (*Route, bool) {
+	if route, ok := r.Env["ROUTE"].(*Route); ok && route != nil {
+		return route, true
+	}
+	return RouteFromContext(r.Context())
+}
+
+func (r *Request) setRoute(route *Route) {
+	values := r.values()
+	values.lock.Lock()
+	values.route = route
+	values.lock.Unlock()
+	r.Env["ROUTE"] = route
+}
+
+// Logger returns the logger of the request, see LoggerFromContext.
+func (r *Request) Logger() *slog.Logger {
+	return LoggerFromContext(r.Context())
+}
+
+// SetLogger sets the base logger returned, with the request attributes, by Logger.
+func (r *Request) SetLogger(logger *slog.Logger) {
+	values := r.values()
+	values.lock.Lock()
+	values.logger = logger
+	values.lock.Unlock()
+}
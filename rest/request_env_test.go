@@ -0,0 +1,181 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"log"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestRequestEnvAccessors(t *testing.T) {
+
+	r := &Request{
+		Request: test.MakeSimpleRequest("GET", "http://localhost/", nil),
+		Env:     map[string]interface{}{},
+	}
+
+	if _, ok := r.StatusCode(); ok {
+		t.Error("StatusCode not expected to be set")
+	}
+
+	// compatibility with the values set in the Env
+	r.Env["REMOTE_USER"] = "env-user"
+	if user, ok := r.RemoteUser(); !ok || user != "env-user" {
+		t.Errorf("env-user expected, got %s", user)
+	}
+
+	start := time.Now()
+	r.SetStartTime(start)
+	r.SetElapsedTime(time.Second)
+	r.SetStatusCode(201)
+	r.SetBytesWritten(42)
+	r.SetRemoteUser("admin")
+
+	if value, _ := r.StartTime(); !value.Equal(start) {
+		t.Errorf("StartTime %s expected, got %s", start, value)
+	}
+	if value, _ := r.ElapsedTime(); value != time.Second {
+		t.Errorf("ElapsedTime 1s expected, got %s", value)
+	}
+	if value, _ := r.StatusCode(); value != 201 {
+		t.Errorf("StatusCode 201 expected, got %d", value)
+	}
+	if value, _ := r.BytesWritten(); value != 42 {
+		t.Errorf("BytesWritten 42 expected, got %d", value)
+	}
+	if value, _ := r.RemoteUser(); value != "admin" {
+		t.Errorf("RemoteUser admin expected, got %s", value)
+	}
+
+	// the Env is kept up to date
+	if r.Env["STATUS_CODE"].(int) != 201 {
+		t.Errorf("Env STATUS_CODE 201 expected, got %d", r.Env["STATUS_CODE"])
+	}
+	if *r.Env["ELAPSED_TIME"].(*time.Duration) != time.Second {
+		t.Errorf("Env ELAPSED_TIME 1s expected, got %s", r.Env["ELAPSED_TIME"])
+	}
+
+	// and so is the context
+	if value, _ := RemoteUserFromContext(r.Context()); value != "admin" {
+		t.Errorf("RemoteUser admin expected in the context, got %s", value)
+	}
+
+	// the Env written directly after the setters takes precedence
+	r.Env["REMOTE_USER"] = "legacy"
+	r.Env["STATUS_CODE"] = 418
+	if value, _ := r.RemoteUser(); value != "legacy" {
+		t.Errorf("RemoteUser legacy expected, got %s", value)
+	}
+	if value, _ := r.StatusCode(); value != 418 {
+		t.Errorf("StatusCode 418 expected, got %d", value)
+	}
+	if value, _ := RemoteUserFromContext(r.Context()); value != "admin" {
+		t.Errorf("RemoteUser admin still expected in the context, got %s", value)
+	}
+}
+
+func TestRequestEnvDirectWrites(t *testing.T) {
+
+	buffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&AccessLogJsonMiddleware{Logger: log.New(buffer, "", 0)})
+	api.Use(&TimerMiddleware{})
+	api.Use(&RecorderMiddleware{})
+	// legacy middleware overriding the recorded values
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			handler(w, r)
+			r.Env["REMOTE_USER"] = "legacy"
+		}
+	}))
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			r.SetRemoteUser("admin")
+			handler(w, r)
+		}
+	}))
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		w.WriteJson(map[string]string{"Id": "123"})
+	}))
+
+	test.RunRequest(t, api.MakeHandler(), test.MakeSimpleRequest("GET", "http://localhost/", nil)).CodeIs(200)
+
+	record := AccessLogJsonRecord{}
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.RemoteUser != "legacy" {
+		t.Errorf("RemoteUser legacy expected, got %s", record.RemoteUser)
+	}
+}
+
+func TestRequestEnvContext(t *testing.T) {
+
+	// a downstream library only knows about the context
+	downstream := func(ctx context.Context) string {
+		user, _ := RemoteUserFromContext(ctx)
+		start, _ := StartTimeFromContext(ctx)
+		if start.IsZero() {
+			t.Error("StartTime expected in the context")
+		}
+		return user
+	}
+
+	api := NewApi()
+	api.Use(&TimerMiddleware{})
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			handler(w, r)
+			route, ok := r.Route()
+			if !ok || route.PathExp != "/users/:id" {
+				t.Error("Route expected once the handler has returned")
+			}
+			if code, _ := StatusCodeFromContext(r.Context()); code != 200 {
+				t.Errorf("StatusCode 200 expected in the context, got %d", code)
+			}
+		}
+	}))
+	api.Use(&RecorderMiddleware{})
+	api.Use(&AuthBasicMiddleware{
+		Realm: "test zone",
+		Authenticator: func(userId string, password string) bool {
+			return true
+		},
+	})
+	router, err := MakeRouter(
+		Get("/users/:id", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"User": downstream(r.Context())})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/users/1", nil)
+	req.SetBasicAuth("admin", "admin")
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"User":"admin"}`)
+}
+
+func TestRequestLoggerDefault(t *testing.T) {
+
+	r := &Request{
+		Request: test.MakeSimpleRequest("GET", "http://localhost/", nil),
+		Env:     map[string]interface{}{},
+	}
+	if r.Logger() != slog.Default() {
+		t.Error("slog.Default() expected without logger and request values")
+	}
+
+	r.SetRemoteUser("admin")
+	if r.Logger() == slog.Default() {
+		t.Error("The user attribute expected")
+	}
+}
@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// RequestIdMiddleware assigns an id to each request, used to correlate the log records across
+// services. The id is read from the request header, if valid, or generated. It is set in the
+// response header, and made available as request.RequestId(). (also as
+// request.Env["REQUEST_ID"].(string) for compatibility) The access log and recover middlewares
+// include it in their records, they must wrap this middleware.
+type RequestIdMiddleware struct {
+
+	// Name of the request and response header. Optional, defaults to "X-Request-Id".
+	HeaderName string
+
+	// Callback function that returns a new id. Optional, defaults to a random UUID (version 4).
+	Generator func() string
+
+	// Callback function that should validate the id received in the request header. Must return
+	// true if the id can be used, false if a new one must be generated. Optional, defaults to
+	// accepting up to 128 characters among letters, digits, and "-_.:+/=".
+	Validator func(id string) bool
+}
+
+// MiddlewareFunc makes RequestIdMiddleware implement the Middleware interface.
+func (mw *RequestIdMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.HeaderName == "" {
+		mw.HeaderName = "X-Request-Id"
+	}
+	if mw.Generator == nil {
+		mw.Generator = NewRequestId
+	}
+	if mw.Validator == nil {
+		mw.Validator = isValidRequestId
+	}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		id := request.Header.Get(mw.HeaderName)
+		if id == "" || !mw.Validator(id) {
+			id = mw.Generator()
+		}
+
+		request.SetRequestId(id)
+		writer.Header().Set(mw.HeaderName, id)
+
+		handler(writer, request)
+	}
+}
+
+// NewRequestId returns a random UUID (version 4), the default RequestIdMiddleware Generator.
+func NewRequestId() string {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		panic(err)
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+func isValidRequestId(id string) bool {
+	if len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
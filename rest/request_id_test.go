@@ -0,0 +1,96 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"log"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestIdMiddleware(t *testing.T) {
+
+	buffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&AccessLogApacheMiddleware{
+		Logger: log.New(buffer, "", 0),
+		Format: "%L %s",
+	})
+	api.Use(&RequestIdMiddleware{})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		id, _ := r.RequestId()
+		w.WriteJson(map[string]string{"RequestId": id})
+	}))
+	handler := api.MakeHandler()
+
+	// generated
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/", nil))
+	recorded.CodeIs(200)
+	generated := recorded.Recorder.Header().Get("X-Request-Id")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(generated) {
+		t.Errorf("UUID expected, got %s", generated)
+	}
+	recorded.BodyIs(`{"RequestId":"` + generated + `"}`)
+	if buffer.String() != generated+" 0\n" {
+		t.Errorf("Unexpected access log: %s", buffer.String())
+	}
+
+	// valid incoming id
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Request-Id", "upstream-123")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.HeaderIs("X-Request-Id", "upstream-123")
+
+	// invalid incoming id
+	req = test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Request-Id", "bad id\x00"+strings.Repeat("a", 200))
+	recorded = test.RunRequest(t, handler, req)
+	if recorded.Recorder.Header().Get("X-Request-Id") == req.Header.Get("X-Request-Id") {
+		t.Error("Invalid request id expected to be replaced")
+	}
+}
+
+func TestRequestIdInLogs(t *testing.T) {
+
+	accessBuffer := bytes.NewBufferString("")
+	recoverBuffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&AccessLogJsonMiddleware{
+		Logger: log.New(accessBuffer, "", 0),
+	})
+	api.Use(&TimerMiddleware{})
+	api.Use(&RecorderMiddleware{})
+	api.Use(&RecoverMiddleware{
+		Logger:          log.New(recoverBuffer, "", 0),
+		EnableLogAsJson: true,
+	})
+	api.Use(&RequestIdMiddleware{})
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		panic("test")
+	}))
+
+	req := test.MakeSimpleRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Request-Id", "abc")
+	recorded := test.RunRequest(t, api.MakeHandler(), req)
+	recorded.CodeIs(500)
+
+	accessRecord := &AccessLogJsonRecord{}
+	if err := json.Unmarshal(accessBuffer.Bytes(), accessRecord); err != nil {
+		t.Fatal(err)
+	}
+	if accessRecord.RequestId != "abc" {
+		t.Errorf("RequestId abc expected in the access log, got %s", accessRecord.RequestId)
+	}
+
+	recoverRecord := map[string]string{}
+	if err := json.Unmarshal(recoverBuffer.Bytes(), &recoverRecord); err != nil {
+		t.Fatal(err)
+	}
+	if recoverRecord["request_id"] != "abc" {
+		t.Errorf("request_id abc expected in the recover log, got %s", recoverRecord["request_id"])
+	}
+}
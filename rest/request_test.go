@@ -14,9 +14,9 @@ func defaultRequest(method string, urlStr string, body io.Reader, t *testing.T)
 		t.Fatal(err)
 	}
 	return &Request{
-		origReq,
-		nil,
-		map[string]interface{}{},
+		Request:    origReq,
+		PathParams: nil,
+		Env:        map[string]interface{}{},
 	}
 }
 
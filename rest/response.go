@@ -2,7 +2,6 @@ package rest
 
 import (
 	"bufio"
-	"encoding/json"
 	"net"
 	"net/http"
 )
@@ -62,13 +61,14 @@ func NotFound(w ResponseWriter, r *Request) {
 type responseWriter struct {
 	http.ResponseWriter
 	wroteHeader bool
+	codec       JsonCodec
 }
 
 func (w *responseWriter) WriteHeader(code int) {
 	if w.Header().Get("Content-Type") == "" {
 		// Per spec, UTF-8 is the default, and the charset parameter should not
 		// be necessary. But some clients (eg: Chrome) think otherwise.
-		// Since json.Marshal produces UTF-8, setting the charset parameter is a
+		// Since JSON encoders produce UTF-8, setting the charset parameter is a
 		// safe option.
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	}
@@ -76,8 +76,13 @@ func (w *responseWriter) WriteHeader(code int) {
 	w.wroteHeader = true
 }
 
+// Encode the object with the JsonCodec of the Api, json.Marshal by default.
 func (w *responseWriter) EncodeJson(v interface{}) ([]byte, error) {
-	b, err := json.Marshal(v)
+	codec := w.codec
+	if codec == nil {
+		codec = defaultJsonCodec
+	}
+	b, err := codec.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
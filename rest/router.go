@@ -51,6 +51,10 @@ func (rt *router) AppFunc() HandlerFunc {
 		// a route was found, set the PathParams
 		request.PathParams = params
 
+		// make the route available to the per Route middlewares, and to the wrapping
+		// middlewares once the handler has returned.
+		request.setRoute(route)
+
 		// run the user code
 		handler := route.Func
 		handler(writer, request)
@@ -0,0 +1,228 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server runs an Api with sane timeouts, and shuts it down gracefully when a SIGTERM or SIGINT
+// signal is received, or when Shutdown is called, eg:
+//
+//	server := &rest.Server{Api: api, Addr: ":8080"}
+//	server.OnShutdown(func(ctx context.Context) error {
+//		return db.Close()
+//	})
+//	log.Fatal(server.ListenAndServe())
+//
+// The graceful shutdown is done in this order:
+//
+//  1. The HealthChecker, if any, starts failing the readiness report, and the Stopping channel
+//     is closed, so that the long-lived responses, eg: SSE or streaming, can be ended.
+//  2. After DrainDelay, the listener is closed, and the in-flight requests are allowed to finish
+//     until ShutdownTimeout. The remaining connections are then closed.
+//  3. The shutdown hooks are run, in the order of registration.
+type Server struct {
+
+	// The Api to serve. Required.
+	Api *Api
+
+	// TCP address to listen on. Optional, defaults to ":8080".
+	// Ignored when Listener is set.
+	Addr string
+
+	// Listener to serve on, eg: for tests. Optional, defaults to a TCP listener on Addr.
+	Listener net.Listener
+
+	// Maximum duration for reading the request headers. Optional, defaults to 10 seconds.
+	ReadHeaderTimeout time.Duration
+
+	// Maximum duration for reading the entire request. Optional, defaults to 30 seconds.
+	ReadTimeout time.Duration
+
+	// Maximum duration before timing out the writes of the response. Optional, defaults to no
+	// timeout, so that the streaming responses are not interrupted. Use the TimeoutMiddleware to
+	// bound the duration of the regular requests.
+	WriteTimeout time.Duration
+
+	// Maximum duration to wait for the next request on a keep-alive connection.
+	// Optional, defaults to 2 minutes.
+	IdleTimeout time.Duration
+
+	// Duration between the start of the shutdown and the closing of the listener, giving the load
+	// balancers the time to notice the failing readiness. Optional, defaults to 0.
+	DrainDelay time.Duration
+
+	// Maximum duration of the graceful shutdown, including the draining of the in-flight
+	// requests and the shutdown hooks. Optional, defaults to 30 seconds.
+	ShutdownTimeout time.Duration
+
+	// Signals that trigger the graceful shutdown.
+	// Optional, defaults to syscall.SIGTERM and os.Interrupt (SIGINT).
+	Signals []os.Signal
+
+	// HealthChecker notified of the shutdown. Optional.
+	HealthChecker *HealthChecker
+
+	// Logger used to report the shutdown. Optional, defaults to log.New(os.Stderr, "", 0).
+	Logger *log.Logger
+
+	initOnce     sync.Once
+	lock         sync.Mutex
+	hooks        []func(ctx context.Context) error
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+}
+
+func (s *Server) init() {
+	s.initOnce.Do(func() {
+		s.stopping = make(chan struct{})
+	})
+}
+
+// OnShutdown registers a hook run at the end of the graceful shutdown, after the in-flight
+// requests are drained. The hooks are run in the order of registration, with a context that
+// expires at the end of ShutdownTimeout.
+func (s *Server) OnShutdown(hook func(ctx context.Context) error) {
+	s.lock.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.lock.Unlock()
+}
+
+// Stopping returns a channel closed at the start of the graceful shutdown. The handlers of
+// long-lived responses should select on it, and end the response when it is closed.
+func (s *Server) Stopping() <-chan struct{} {
+	s.init()
+	return s.stopping
+}
+
+// Shutdown starts the graceful shutdown, as if a signal was received. ListenAndServe returns once
+// the shutdown is complete.
+func (s *Server) Shutdown() {
+	s.init()
+	s.stoppingOnce.Do(func() {
+		close(s.stopping)
+	})
+}
+
+// ListenAndServe serves the Api until the graceful shutdown is complete. It returns nil after a
+// clean shutdown, or the first error encountered.
+func (s *Server) ListenAndServe() error {
+
+	if s.Api == nil {
+		log.Fatal("Api is required")
+	}
+	if s.Addr == "" {
+		s.Addr = ":8080"
+	}
+	if s.ReadHeaderTimeout == 0 {
+		s.ReadHeaderTimeout = 10 * time.Second
+	}
+	if s.ReadTimeout == 0 {
+		s.ReadTimeout = 30 * time.Second
+	}
+	if s.IdleTimeout == 0 {
+		s.IdleTimeout = 2 * time.Minute
+	}
+	if s.ShutdownTimeout == 0 {
+		s.ShutdownTimeout = 30 * time.Second
+	}
+	if len(s.Signals) == 0 {
+		s.Signals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+	if s.Logger == nil {
+		s.Logger = log.New(os.Stderr, "", 0)
+	}
+	s.init()
+
+	listener := s.Listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", s.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	httpServer := &http.Server{
+		Handler:           s.Api.MakeHandler(),
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		ReadTimeout:       s.ReadTimeout,
+		WriteTimeout:      s.WriteTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		ErrorLog:          s.Logger,
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, s.Signals...)
+	defer signal.Stop(signals)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- httpServer.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		// the listener failed before any shutdown
+		s.Shutdown()
+		return err
+	case sig := <-signals:
+		s.Logger.Printf("Server: %s received, shutting down", sig)
+		s.Shutdown()
+	case <-s.stopping:
+		s.Logger.Print("Server: shutting down")
+	}
+
+	return s.shutdown(httpServer, served)
+}
+
+func (s *Server) shutdown(httpServer *http.Server, served chan error) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	if s.HealthChecker != nil {
+		s.HealthChecker.Shutdown()
+	}
+
+	if s.DrainDelay > 0 {
+		select {
+		case <-time.After(s.DrainDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	var firstErr error
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		s.Logger.Printf("Server: in-flight requests not drained, closing the connections: %s", err)
+		httpServer.Close()
+		firstErr = err
+	}
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) && firstErr == nil {
+		firstErr = err
+	}
+
+	s.lock.Lock()
+	hooks := append([]func(ctx context.Context) error(nil), s.hooks...)
+	s.lock.Unlock()
+
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			s.Logger.Printf("Server: shutdown hook failed: %s", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,154 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerGracefulShutdown(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health := &HealthChecker{}
+	server := &Server{
+		Listener:      listener,
+		HealthChecker: health,
+		Logger:        log.New(ioutil.Discard, "", 0),
+	}
+
+	started := make(chan struct{}, 2)
+	api := NewApi()
+	router, err := MakeRouter(
+		Get("/slow", func(w ResponseWriter, r *Request) {
+			started <- struct{}{}
+			time.Sleep(100 * time.Millisecond)
+			w.WriteJson(map[string]string{"Done": "true"})
+		}),
+		Get("/stream", func(w ResponseWriter, r *Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.ResponseWriter).Write([]byte("data: first\n\n"))
+			w.(http.Flusher).Flush()
+			started <- struct{}{}
+			<-server.Stopping()
+			w.(http.ResponseWriter).Write([]byte("data: bye\n\n"))
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	server.Api = api
+
+	hooks := []string{}
+	server.OnShutdown(func(ctx context.Context) error {
+		hooks = append(hooks, "first")
+		return nil
+	})
+	server.OnShutdown(func(ctx context.Context) error {
+		hooks = append(hooks, "second")
+		return errors.New("hook failed")
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+
+	url := "http://" + listener.Addr().String()
+	bodies := make(chan string, 2)
+	for _, path := range []string{"/slow", "/stream"} {
+		go func(path string) {
+			resp, err := http.Get(url + path)
+			if err != nil {
+				bodies <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+			bodies <- string(body)
+		}(path)
+	}
+	<-started
+	<-started
+
+	server.Shutdown()
+
+	received := []string{<-bodies, <-bodies}
+	if !strings.Contains(strings.Join(received, ""), `{"Done":"true"}`) {
+		t.Errorf("The slow request expected to complete, got: %v", received)
+	}
+	if !strings.Contains(strings.Join(received, ""), "data: first\n\ndata: bye\n\n") {
+		t.Errorf("The stream expected to end gracefully, got: %v", received)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "hook failed" {
+			t.Errorf("The hook error expected, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe expected to return")
+	}
+
+	if strings.Join(hooks, ",") != "first,second" {
+		t.Errorf("Hooks expected in order, got: %v", hooks)
+	}
+	if !health.IsShuttingDown() {
+		t.Error("HealthChecker expected to be shutting down")
+	}
+	if _, err := http.Get(url + "/slow"); err == nil {
+		t.Error("New connections expected to be refused")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	api := NewApi()
+	api.SetApp(AppSimple(func(w ResponseWriter, r *Request) {
+		close(started)
+		<-release
+	}))
+	server := &Server{
+		Api:             api,
+		Listener:        listener,
+		ShutdownTimeout: 50 * time.Millisecond,
+		Logger:          log.New(ioutil.Discard, "", 0),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ListenAndServe()
+	}()
+	go http.Get("http://" + listener.Addr().String() + "/")
+	<-started
+
+	server.Shutdown()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("DeadlineExceeded expected, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe expected to return after the ShutdownTimeout")
+	}
+}
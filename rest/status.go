@@ -3,20 +3,61 @@ package rest
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
+// The sliding windows are made of slots of statusSlotDuration, the last statusSlotCount slots
+// being kept.
+const (
+	statusSlotDuration = 15 * time.Second
+	statusSlotCount    = 60
+)
+
+// The reported sliding windows, in number of slots.
+var statusWindows = map[string]int{
+	"1m":  4,
+	"5m":  20,
+	"15m": 60,
+}
+
 // StatusMiddleware keeps track of various stats about the processed requests.
-// It depends on request.Env["STATUS_CODE"] and request.Env["ELAPSED_TIME"],
+// It depends on request.StatusCode() and request.ElapsedTime(),
 // recorderMiddleware and timerMiddleware must be in the wrapped middlewares.
 type StatusMiddleware struct {
 	lock              sync.RWMutex
 	start             time.Time
 	pid               int
 	responseCounts    map[string]int
-	totalResponseTime time.Time
+	totalResponseTime time.Duration
+	latency           *latencySketch
+	slots             [statusSlotCount]*statusStats
+	routes            map[string]*statusStats
+	methods           map[string]*statusStats
+}
+
+// Counts and latencies of a subset of the requests: a slot of the sliding windows, a route, or
+// a method.
+type statusStats struct {
+	start          time.Time
+	responseCounts map[string]int
+	latency        *latencySketch
+}
+
+func newStatusStats(start time.Time) *statusStats {
+	return &statusStats{
+		start:          start,
+		responseCounts: map[string]int{},
+		latency:        newLatencySketch(),
+	}
+}
+
+func (s *statusStats) add(code string, responseTime time.Duration) {
+	s.responseCounts[code]++
+	s.latency.add(responseTime)
 }
 
 // MiddlewareFunc makes StatusMiddleware implement the Middleware interface.
@@ -25,32 +66,70 @@ func (mw *StatusMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 	mw.start = time.Now()
 	mw.pid = os.Getpid()
 	mw.responseCounts = map[string]int{}
-	mw.totalResponseTime = time.Time{}
+	mw.totalResponseTime = 0
+	mw.latency = newLatencySketch()
+	mw.routes = map[string]*statusStats{}
+	mw.methods = map[string]*statusStats{}
 
 	return func(w ResponseWriter, r *Request) {
 
 		// call the handler
 		h(w, r)
 
-		if r.Env["STATUS_CODE"] == nil {
-			log.Fatal("StatusMiddleware: Env[\"STATUS_CODE\"] is nil, " +
+		statusCode, ok := r.StatusCode()
+		if !ok {
+			log.Fatal("StatusMiddleware: StatusCode is not set, " +
 				"RecorderMiddleware may not be in the wrapped Middlewares.")
 		}
-		statusCode := r.Env["STATUS_CODE"].(int)
 
-		if r.Env["ELAPSED_TIME"] == nil {
-			log.Fatal("StatusMiddleware: Env[\"ELAPSED_TIME\"] is nil, " +
+		responseTime, ok := r.ElapsedTime()
+		if !ok {
+			log.Fatal("StatusMiddleware: ElapsedTime is not set, " +
 				"TimerMiddleware may not be in the wrapped Middlewares.")
 		}
-		responseTime := r.Env["ELAPSED_TIME"].(*time.Duration)
+
+		code := fmt.Sprintf("%d", statusCode)
+
+		// same cardinality bounds as the MetricsMiddleware
+		route := "unmatched"
+		if matched, ok := r.Route(); ok {
+			route = matched.PathExp
+		}
+		method := r.Method
+		if !metricsMethods[method] {
+			method = "OTHER"
+		}
 
 		mw.lock.Lock()
-		mw.responseCounts[fmt.Sprintf("%d", statusCode)]++
-		mw.totalResponseTime = mw.totalResponseTime.Add(*responseTime)
+		mw.responseCounts[code]++
+		mw.totalResponseTime += responseTime
+		mw.latency.add(responseTime)
+		mw.slot(time.Now()).add(code, responseTime)
+		if mw.routes[route] == nil {
+			mw.routes[route] = newStatusStats(mw.start)
+		}
+		mw.routes[route].add(code, responseTime)
+		if mw.methods[method] == nil {
+			mw.methods[method] = newStatusStats(mw.start)
+		}
+		mw.methods[method].add(code, responseTime)
 		mw.lock.Unlock()
 	}
 }
 
+// slot returns the slot of the sliding windows that contains now, the expired slot previously at
+// this position is replaced.
+func (mw *StatusMiddleware) slot(now time.Time) *statusStats {
+	start := now.Truncate(statusSlotDuration)
+	index := int(start.UnixNano()/int64(statusSlotDuration)) % statusSlotCount
+	slot := mw.slots[index]
+	if slot == nil || !slot.start.Equal(start) {
+		slot = newStatusStats(start)
+		mw.slots[index] = slot
+	}
+	return slot
+}
+
 // Status contains stats and status information. It is returned by GetStatus.
 // These information can be made available as an API endpoint, see the "status"
 // example to install the following status route.
@@ -70,7 +149,36 @@ func (mw *StatusMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 //       "TotalResponseTime": "16.777ms",
 //       "TotalResponseTimeSec": 0.016777,
 //       "AverageResponseTime": "262.14us",
-//       "AverageResponseTimeSec": 0.00026214
+//       "AverageResponseTimeSec": 0.00026214,
+//       "Latency": {
+//         "P50": "201.3us",
+//         "P50Sec": 0.0002013,
+//         "P90": "412.6us",
+//         "P90Sec": 0.0004126,
+//         "P99": "1.104ms",
+//         "P99Sec": 0.001104,
+//         "Max": "1.212ms",
+//         "MaxSec": 0.001212
+//       },
+//       "Windows": {
+//         "1m": {
+//           "StatusCodeCount": {
+//             "200": 12
+//           },
+//           "TotalCount": 12,
+//           "RequestsPerSec": 0.2,
+//           "Latency": { ... }
+//         },
+//         "5m": { ... },
+//         "15m": { ... }
+//       },
+//       "Routes": {
+//         "/users/:id": { ... },
+//         "unmatched": { ... }
+//       },
+//       "Methods": {
+//         "GET": { ... }
+//       }
 //     }
 type Status struct {
 	Pid                    int
@@ -84,6 +192,40 @@ type Status struct {
 	TotalResponseTimeSec   float64
 	AverageResponseTime    string
 	AverageResponseTimeSec float64
+
+	// Latency percentiles of all the requests.
+	Latency *LatencyStatus
+
+	// Stats of the requests completed in the last minute, 5 minutes and 15 minutes,
+	// keyed by "1m", "5m" and "15m".
+	Windows map[string]*StatusBreakdown
+
+	// Stats of the requests by PathExp of the matched Route, "unmatched" if no Route matched.
+	Routes map[string]*StatusBreakdown
+
+	// Stats of the requests by HTTP method, "OTHER" for the methods not defined by HTTP.
+	Methods map[string]*StatusBreakdown
+}
+
+// LatencyStatus contains latency percentiles, estimated with a 1% relative accuracy, and the
+// exact maximum.
+type LatencyStatus struct {
+	P50    string
+	P50Sec float64
+	P90    string
+	P90Sec float64
+	P99    string
+	P99Sec float64
+	Max    string
+	MaxSec float64
+}
+
+// StatusBreakdown contains the stats of a subset of the requests.
+type StatusBreakdown struct {
+	StatusCodeCount map[string]int
+	TotalCount      int
+	RequestsPerSec  float64
+	Latency         *LatencyStatus
 }
 
 // GetStatus computes and returns a Status object based on the request informations accumulated
@@ -101,7 +243,7 @@ func (mw *StatusMiddleware) GetStatus() *Status {
 		totalCount += count
 	}
 
-	totalResponseTime := mw.totalResponseTime.Sub(time.Time{})
+	totalResponseTime := mw.totalResponseTime
 
 	averageResponseTime := time.Duration(0)
 	if totalCount > 0 {
@@ -115,15 +257,155 @@ func (mw *StatusMiddleware) GetStatus() *Status {
 		UpTimeSec:              uptime.Seconds(),
 		Time:                   now.String(),
 		TimeUnix:               now.Unix(),
-		StatusCodeCount:        mw.responseCounts,
+		StatusCodeCount:        copyStatusCodeCount(mw.responseCounts),
 		TotalCount:             totalCount,
 		TotalResponseTime:      totalResponseTime.String(),
 		TotalResponseTimeSec:   totalResponseTime.Seconds(),
 		AverageResponseTime:    averageResponseTime.String(),
 		AverageResponseTimeSec: averageResponseTime.Seconds(),
+		Latency:                mw.latency.status(),
+		Windows:                map[string]*StatusBreakdown{},
+		Routes:                 map[string]*StatusBreakdown{},
+		Methods:                map[string]*StatusBreakdown{},
+	}
+
+	current := now.Truncate(statusSlotDuration)
+	for name, size := range statusWindows {
+		windowStart := current.Add(-time.Duration(size-1) * statusSlotDuration)
+		window := newStatusStats(windowStart)
+		for _, slot := range mw.slots {
+			if slot == nil || slot.start.Before(windowStart) || slot.start.After(current) {
+				continue
+			}
+			for code, count := range slot.responseCounts {
+				window.responseCounts[code] += count
+			}
+			window.latency.merge(slot.latency)
+		}
+		status.Windows[name] = window.status(now, mw.start)
+	}
+
+	for route, stats := range mw.routes {
+		status.Routes[route] = stats.status(now, mw.start)
+	}
+	for method, stats := range mw.methods {
+		status.Methods[method] = stats.status(now, mw.start)
 	}
 
 	mw.lock.RUnlock()
 
 	return status
 }
+
+// status computes the StatusBreakdown, the rate is over the time since the start of the stats,
+// or since the start of the middleware if more recent.
+func (s *statusStats) status(now, start time.Time) *StatusBreakdown {
+	breakdown := &StatusBreakdown{
+		StatusCodeCount: copyStatusCodeCount(s.responseCounts),
+		TotalCount:      int(s.latency.count),
+		Latency:         s.latency.status(),
+	}
+	if s.start.After(start) {
+		start = s.start
+	}
+	if elapsed := now.Sub(start); elapsed > 0 {
+		breakdown.RequestsPerSec = float64(s.latency.count) / elapsed.Seconds()
+	}
+	return breakdown
+}
+
+func copyStatusCodeCount(responseCounts map[string]int) map[string]int {
+	copied := map[string]int{}
+	for code, count := range responseCounts {
+		copied[code] = count
+	}
+	return copied
+}
+
+// Relative accuracy of the latency percentiles.
+const latencySketchAccuracy = 0.01
+
+var (
+	latencySketchGamma    = (1 + latencySketchAccuracy) / (1 - latencySketchAccuracy)
+	latencySketchLogGamma = math.Log(latencySketchGamma)
+)
+
+// latencySketch is a streaming quantile sketch, as in DDSketch. The durations are counted in
+// buckets with exponentially growing bounds, the quantiles are estimated with a bounded relative
+// error, and the memory grows with the logarithm of the range of the durations. The sketches can
+// be merged, which is how the sliding windows are computed.
+type latencySketch struct {
+	buckets map[int]uint64
+	count   uint64
+	max     time.Duration
+}
+
+func newLatencySketch() *latencySketch {
+	return &latencySketch{buckets: map[int]uint64{}}
+}
+
+func (s *latencySketch) add(duration time.Duration) {
+	if duration < 1 {
+		duration = 1
+	}
+	index := int(math.Ceil(math.Log(float64(duration)) / latencySketchLogGamma))
+	s.buckets[index]++
+	s.count++
+	if duration > s.max {
+		s.max = duration
+	}
+}
+
+func (s *latencySketch) merge(other *latencySketch) {
+	for index, count := range other.buckets {
+		s.buckets[index] += count
+	}
+	s.count += other.count
+	if other.max > s.max {
+		s.max = other.max
+	}
+}
+
+// quantile returns the estimated duration at the quantile q, between 0 and 1.
+func (s *latencySketch) quantile(q float64) time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+
+	indexes := make([]int, 0, len(s.buckets))
+	for index := range s.buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	rank := uint64(q * float64(s.count-1))
+	seen := uint64(0)
+	for _, index := range indexes {
+		seen += s.buckets[index]
+		if seen > rank {
+			// middle of the bucket, in relative terms
+			estimated := time.Duration(2 * math.Pow(latencySketchGamma, float64(index)) / (latencySketchGamma + 1))
+			if estimated > s.max {
+				return s.max
+			}
+			return estimated
+		}
+	}
+	return s.max
+}
+
+func (s *latencySketch) status() *LatencyStatus {
+	p50 := s.quantile(0.50)
+	p90 := s.quantile(0.90)
+	p99 := s.quantile(0.99)
+	return &LatencyStatus{
+		P50:    p50.String(),
+		P50Sec: p50.Seconds(),
+		P90:    p90.String(),
+		P90Sec: p90.Seconds(),
+		P99:    p99.String(),
+		P99Sec: p99.Seconds(),
+		Max:    s.max.String(),
+		MaxSec: s.max.Seconds(),
+	}
+}
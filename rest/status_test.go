@@ -2,7 +2,9 @@ package rest
 
 import (
 	"github.com/ant0ine/go-json-rest/rest/test"
+	"math"
 	"testing"
+	"time"
 )
 
 func TestStatusMiddleware(t *testing.T) {
@@ -52,3 +54,79 @@ func TestStatusMiddleware(t *testing.T) {
 		t.Errorf("StatusCodeCount 200 1 Expected, got: %f", payload["StatusCodeCount"].(map[string]interface{})["200"].(float64))
 	}
 }
+
+func TestStatusMiddlewareBreakdowns(t *testing.T) {
+
+	api := NewApi()
+	status := &StatusMiddleware{}
+	api.Use(status)
+	api.Use(&TimerMiddleware{})
+	api.Use(&RecorderMiddleware{})
+	router, err := MakeRouter(
+		Get("/users/:id", func(w ResponseWriter, r *Request) {
+			w.WriteJson(map[string]string{"Id": r.PathParam("id")})
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/users/1", nil)).CodeIs(200)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/users/2", nil)).CodeIs(200)
+	test.RunRequest(t, handler, test.MakeSimpleRequest("DELETE", "http://localhost/unknown", nil)).CodeIs(404)
+
+	result := status.GetStatus()
+
+	if result.Routes["/users/:id"].StatusCodeCount["200"] != 2 {
+		t.Errorf("2 requests expected for /users/:id, got: %v", result.Routes["/users/:id"].StatusCodeCount)
+	}
+	if result.Routes["unmatched"].StatusCodeCount["404"] != 1 {
+		t.Errorf("1 unmatched request expected, got: %v", result.Routes["unmatched"].StatusCodeCount)
+	}
+	if result.Methods["GET"].TotalCount != 2 || result.Methods["DELETE"].TotalCount != 1 {
+		t.Errorf("Unexpected method counts: %d %d", result.Methods["GET"].TotalCount, result.Methods["DELETE"].TotalCount)
+	}
+	for _, name := range []string{"1m", "5m", "15m"} {
+		window := result.Windows[name]
+		if window == nil || window.TotalCount != 3 || window.RequestsPerSec <= 0 {
+			t.Errorf("3 requests expected in the %s window, got: %+v", name, window)
+		}
+	}
+	if result.Latency.MaxSec <= 0 || result.Latency.P50Sec > result.Latency.MaxSec {
+		t.Errorf("Unexpected latency: %+v", result.Latency)
+	}
+}
+
+func TestLatencySketch(t *testing.T) {
+
+	sketch := newLatencySketch()
+	for i := 1; i <= 1000; i++ {
+		sketch.add(time.Duration(i) * time.Millisecond)
+	}
+
+	for _, expected := range []struct {
+		quantile float64
+		value    time.Duration
+	}{
+		{0.50, 500 * time.Millisecond},
+		{0.90, 900 * time.Millisecond},
+		{0.99, 990 * time.Millisecond},
+	} {
+		value := sketch.quantile(expected.quantile)
+		if math.Abs(float64(value-expected.value))/float64(expected.value) > 0.02 {
+			t.Errorf("%v expected at %f, got %v", expected.value, expected.quantile, value)
+		}
+	}
+
+	// merged with a window of larger durations
+	other := newLatencySketch()
+	for i := 1; i <= 1000; i++ {
+		other.add(time.Duration(i) * time.Second)
+	}
+	sketch.merge(other)
+	if sketch.count != 2000 || sketch.max != 1000*time.Second {
+		t.Errorf("Unexpected merged sketch: %d %v", sketch.count, sketch.max)
+	}
+}
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignOptions mirrors the header names of the rest.HmacSignatureMiddleware. The empty fields
+// default to the ones of the middleware.
+type SignOptions struct {
+	SignatureHeader string
+	TimestampHeader string
+	NonceHeader     string
+	KeyIdHeader     string
+}
+
+// SignRequest signs the request for the rest.HmacSignatureMiddleware, with its default header
+// names. It sets the X-Signature-Timestamp (current time), X-Signature-Nonce (random),
+// X-Signature-Key-Id (if keyId is not empty) and X-Signature headers. The body is read and
+// restored.
+func SignRequest(r *http.Request, keyId string, secret []byte) {
+	SignRequestWithOptions(r, keyId, secret, SignOptions{})
+}
+
+// SignRequestWithOptions is like SignRequest, for a rest.HmacSignatureMiddleware configured with
+// other header names.
+func SignRequestWithOptions(r *http.Request, keyId string, secret []byte, options SignOptions) {
+
+	if options.SignatureHeader == "" {
+		options.SignatureHeader = "X-Signature"
+	}
+	if options.TimestampHeader == "" {
+		options.TimestampHeader = "X-Signature-Timestamp"
+	}
+	if options.NonceHeader == "" {
+		options.NonceHeader = "X-Signature-Nonce"
+	}
+	if options.KeyIdHeader == "" {
+		options.KeyIdHeader = "X-Signature-Key-Id"
+	}
+
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		panic(err)
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	bodySum := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodySum[:]),
+	}, "\n")
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical))
+
+	r.Header.Set(options.TimestampHeader, timestamp)
+	r.Header.Set(options.NonceHeader, nonce)
+	if keyId != "" {
+		r.Header.Set(options.KeyIdHeader, keyId)
+	}
+	r.Header.Set(options.SignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+}
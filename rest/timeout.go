@@ -0,0 +1,300 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrHandlerTimeout is returned by the ResponseWriter Write calls made after the timeout.
+var ErrHandlerTimeout = errors.New("Handler timeout")
+
+type timeoutStateKey struct{}
+
+// TimeoutMiddleware limits the execution time of the wrapped handler. The request gets a
+// context.Context with a deadline, see request.Context(), that handlers should pass to the
+// blocking calls. If the handler has not written the response headers when the deadline is
+// reached, an error response is returned with StatusCode, and the later writes of the handler are
+// discarded.
+//
+// The wrapped handler runs in its own goroutine, with a copy of the request Env. On success, the
+// Env is copied back, so the values set by the wrapped middlewares are visible to the wrapping
+// ones. On timeout, they are lost. A panic of the wrapped handler is raised again in the request
+// goroutine, the RecoverMiddleware still logs the stack of the original panic.
+//
+// The timeout of a Route can be overridden by wrapping the Route handler with another
+// TimeoutMiddleware, post routing, see WrapMiddlewares. The deadline is then computed from the
+// start of the request, and can be longer than the one of the api wide TimeoutMiddleware.
+type TimeoutMiddleware struct {
+
+	// Maximum duration of the request. Required.
+	Timeout time.Duration
+
+	// Status code of the timeout error response. Optional, defaults to
+	// http.StatusServiceUnavailable (503), http.StatusGatewayTimeout (504) is another option.
+	StatusCode int
+
+	// Message of the timeout error response. Optional, defaults to the status text.
+	Message string
+}
+
+// MiddlewareFunc makes TimeoutMiddleware implement the Middleware interface.
+func (mw *TimeoutMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.Timeout <= 0 {
+		log.Fatal("Timeout is required")
+	}
+	if mw.StatusCode == 0 {
+		mw.StatusCode = http.StatusServiceUnavailable
+	}
+	if mw.Message == "" {
+		mw.Message = http.StatusText(mw.StatusCode)
+	}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		// already under a TimeoutMiddleware, override its deadline.
+		if state, ok := request.Context().Value(timeoutStateKey{}).(*timeoutState); ok {
+			ctx, cancel := state.override(mw.Timeout)
+			defer cancel()
+			request.Request = request.Request.WithContext(ctx)
+			handler(writer, request)
+			return
+		}
+
+		state := &timeoutState{
+			start:   time.Now(),
+			expired: make(chan struct{}),
+		}
+		state.base = context.WithValue(request.Context(), timeoutStateKey{}, state)
+		ctx, cancel := state.override(mw.Timeout)
+		defer cancel()
+
+		inner := &Request{
+			Request:    request.Request.WithContext(ctx),
+			PathParams: request.PathParams,
+			Env:        map[string]interface{}{},
+			codec:      request.codec,
+			decoder:    request.decoder,
+		}
+		for key, value := range request.Env {
+			inner.Env[key] = value
+		}
+
+		timeoutWriter := &timeoutResponseWriter{
+			ResponseWriter: writer,
+			header:         http.Header{},
+		}
+		for key, values := range writer.Header() {
+			timeoutWriter.header[key] = append([]string(nil), values...)
+		}
+
+		done := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if reco := recover(); reco != nil {
+					panicked := &handlerPanic{value: reco, stack: debug.Stack()}
+					timeoutWriter.lock.Lock()
+					timedOut := timeoutWriter.timedOut
+					timeoutWriter.lock.Unlock()
+					if timedOut {
+						log.Printf("Panic after the timeout: %s\n%s", reco, panicked.stack)
+					}
+					done <- panicked
+					return
+				}
+				done <- nil
+			}()
+			handler(timeoutWriter, inner)
+		}()
+
+		select {
+		case reco := <-done:
+			// the handler gave up without writing the response, after the deadline.
+			if reco == nil && inner.Context().Err() == context.DeadlineExceeded &&
+				mw.writeTimeout(writer, timeoutWriter) {
+				return
+			}
+			mw.finish(request, inner, reco)
+
+		case <-state.expired:
+			if mw.writeTimeout(writer, timeoutWriter) {
+				return
+			}
+			// the response is already started, let the handler finish it.
+			mw.finish(request, inner, <-done)
+		}
+	}
+}
+
+// Write the timeout error response, unless the handler has already started the response.
+func (mw *TimeoutMiddleware) writeTimeout(writer ResponseWriter, timeoutWriter *timeoutResponseWriter) bool {
+	timeoutWriter.lock.Lock()
+	defer timeoutWriter.lock.Unlock()
+	if timeoutWriter.wroteHeader {
+		return false
+	}
+	timeoutWriter.timedOut = true
+	Error(writer, mw.Message, mw.StatusCode)
+	return true
+}
+
+// Copy back the Env and PathParams set by the wrapped handler, and propagate its panic.
+func (mw *TimeoutMiddleware) finish(request *Request, inner *Request, reco interface{}) {
+	for key, value := range inner.Env {
+		request.Env[key] = value
+	}
+	request.PathParams = inner.PathParams
+	if reco != nil {
+		panic(reco)
+	}
+}
+
+// The panic of a handler run in another goroutine, raised again with the stack of the original
+// panic, see RecoverMiddleware.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// String returns the original panic value, formatted.
+func (p *handlerPanic) String() string {
+	return fmt.Sprint(p.value)
+}
+
+// Shared between the api wide TimeoutMiddleware and the per Route ones, through the context.
+type timeoutState struct {
+	lock    sync.Mutex
+	base    context.Context
+	start   time.Time
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+// override sets a new deadline, from the start of the request, and returns the matching context.
+// It has no effect if the previous deadline has already been reached.
+func (s *timeoutState) override(timeout time.Duration) (context.Context, context.CancelFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	deadline := s.start.Add(timeout)
+	if s.timer != nil && !s.timer.Stop() {
+		return context.WithCancel(s.base)
+	}
+	s.timer = time.AfterFunc(time.Until(deadline), func() {
+		close(s.expired)
+	})
+	return context.WithDeadline(s.base, deadline)
+}
+
+// Private responseWriter intantiated by the timeout middleware.
+// It keeps its own copy of the headers, and discards the writes made after the timeout.
+// It implements the following interfaces:
+// ResponseWriter
+// http.ResponseWriter
+// http.Flusher
+// http.CloseNotifier
+// http.Hijacker
+type timeoutResponseWriter struct {
+	ResponseWriter
+	lock        sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	timedOut    bool
+}
+
+// Return the local copy of the headers, written to the parent in WriteHeader.
+func (w *timeoutResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// Copy the headers to the parent and call the parent WriteHeader, unless the timeout is reached.
+func (w *timeoutResponseWriter) WriteHeader(code int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writeHeaderLocked(code)
+}
+
+func (w *timeoutResponseWriter) writeHeaderLocked(code int) {
+	if w.timedOut || w.wroteHeader {
+		return
+	}
+	parentHeader := w.ResponseWriter.Header()
+	for key := range parentHeader {
+		if _, ok := w.header[key]; !ok {
+			parentHeader.Del(key)
+		}
+	}
+	for key, values := range w.header {
+		parentHeader[key] = values
+	}
+	w.ResponseWriter.WriteHeader(code)
+	w.wroteHeader = true
+}
+
+// Make sure the local Write is called.
+func (w *timeoutResponseWriter) WriteJson(v interface{}) error {
+	b, err := w.EncodeJson(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Make sure the local WriteHeader is called, and call the parent Write, unless the timeout is
+// reached. Provided in order to implement the http.ResponseWriter interface.
+func (w *timeoutResponseWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return 0, ErrHandlerTimeout
+	}
+	w.writeHeaderLocked(http.StatusOK)
+	writer := w.ResponseWriter.(http.ResponseWriter)
+	return writer.Write(b)
+}
+
+// Make sure the local WriteHeader is called, and call the parent Flush, unless the timeout is
+// reached. Provided in order to implement the http.Flusher interface.
+func (w *timeoutResponseWriter) Flush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return
+	}
+	w.writeHeaderLocked(http.StatusOK)
+	flusher := w.ResponseWriter.(http.Flusher)
+	flusher.Flush()
+}
+
+// Call the parent CloseNotify.
+// Provided in order to implement the http.CloseNotifier interface.
+func (w *timeoutResponseWriter) CloseNotify() <-chan bool {
+	notifier := w.ResponseWriter.(http.CloseNotifier)
+	return notifier.CloseNotify()
+}
+
+// Call the parent Hijack, unless the timeout is reached. Once hijacked, the connection is not
+// subject to the timeout anymore.
+// Provided in order to implement the http.Hijacker interface.
+func (w *timeoutResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timedOut {
+		return nil, nil, ErrHandlerTimeout
+	}
+	w.wroteHeader = true
+	hijacker := w.ResponseWriter.(http.Hijacker)
+	return hijacker.Hijack()
+}
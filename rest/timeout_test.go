@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"bytes"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+
+	lateWrite := make(chan error, 1)
+
+	api := NewApi()
+	api.Use(MiddlewareSimple(func(handler HandlerFunc) HandlerFunc {
+		return func(w ResponseWriter, r *Request) {
+			handler(w, r)
+			// set by the handler, copied back on success
+			if r.URL.Path == "/fast" && r.Env["ID"] != "123" {
+				t.Error("ID expected in the Env")
+			}
+		}
+	}))
+	api.Use(&TimeoutMiddleware{
+		Timeout:    20 * time.Millisecond,
+		StatusCode: 504,
+	})
+	router, err := MakeRouter(
+		Get("/fast", func(w ResponseWriter, r *Request) {
+			if _, ok := r.Context().Deadline(); !ok {
+				t.Error("Deadline expected on the context")
+			}
+			r.Env["ID"] = "123"
+			w.Header().Set("X-Id", "123")
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+		Get("/slow", func(w ResponseWriter, r *Request) {
+			<-r.Context().Done()
+			time.Sleep(5 * time.Millisecond)
+			w.Header().Set("X-Id", "123")
+			lateWrite <- w.WriteJson(map[string]string{"Id": "123"})
+		}),
+		Get("/streaming", func(w ResponseWriter, r *Request) {
+			w.WriteHeader(200)
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+			w.WriteJson(map[string]string{"Id": "123"})
+		}),
+		Get("/override", WrapMiddlewares([]Middleware{&TimeoutMiddleware{Timeout: time.Second}},
+			func(w ResponseWriter, r *Request) {
+				time.Sleep(40 * time.Millisecond)
+				w.WriteJson(map[string]string{"Id": "123"})
+			},
+		)),
+		Get("/panic", func(w ResponseWriter, r *Request) {
+			panic("boom")
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	recorded := test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/fast", nil))
+	recorded.CodeIs(200)
+	recorded.HeaderIs("X-Id", "123")
+	recorded.BodyIs(`{"Id":"123"}`)
+
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/slow", nil))
+	recorded.CodeIs(504)
+	recorded.ContentTypeIsJson()
+	recorded.HeaderIs("X-Id", "")
+	recorded.BodyIs(`{"Error":"Gateway Timeout"}`)
+	if err := <-lateWrite; err != ErrHandlerTimeout {
+		t.Errorf("ErrHandlerTimeout expected, got %v", err)
+	}
+
+	// already started, not interrupted
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/streaming", nil))
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"123"}`)
+
+	// longer per Route timeout
+	recorded = test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/override", nil))
+	recorded.CodeIs(200)
+	recorded.BodyIs(`{"Id":"123"}`)
+
+	// the panic is propagated to the wrapping middlewares, with the stack of the handler
+	buffer := bytes.NewBufferString("")
+	api = NewApi()
+	api.Use(&RecoverMiddleware{Logger: log.New(buffer, "", 0)})
+	api.Use(&TimeoutMiddleware{Timeout: time.Second})
+	api.SetApp(router)
+	recorded = test.RunRequest(t, api.MakeHandler(), test.MakeSimpleRequest("GET", "http://localhost/panic", nil))
+	recorded.CodeIs(500)
+	if !strings.HasPrefix(buffer.String(), "boom\n") {
+		t.Errorf("The panic value expected first in the log, got: %s", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "TestTimeoutMiddleware.func") {
+		t.Errorf("The stack of the handler expected in the log, got: %s", buffer.String())
+	}
+}
+
+func TestTimeoutMiddlewareShorterRoute(t *testing.T) {
+
+	api := NewApi()
+	api.Use(&TimeoutMiddleware{Timeout: time.Second})
+	router, err := MakeRouter(
+		Get("/short", WrapMiddlewares([]Middleware{&TimeoutMiddleware{Timeout: 10 * time.Millisecond}},
+			func(w ResponseWriter, r *Request) {
+				<-r.Context().Done()
+			},
+		)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+
+	start := time.Now()
+	recorded := test.RunRequest(t, api.MakeHandler(), test.MakeSimpleRequest("GET", "http://localhost/short", nil))
+	recorded.CodeIs(503)
+	recorded.BodyIs(`{"Error":"Service Unavailable"}`)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("The Route timeout is expected to be used")
+	}
+}
@@ -5,8 +5,9 @@ import (
 )
 
 // TimerMiddleware computes the elapsed time spent during the execution of the wrapped handler.
-// The result is available to the wrapping handlers as request.Env["ELAPSED_TIME"].(*time.Duration),
-// and as request.Env["START_TIME"].(*time.Time)
+// The result is available to the wrapping handlers as request.ElapsedTime(),
+// and as request.StartTime(). (also as request.Env["ELAPSED_TIME"].(*time.Duration) and
+// request.Env["START_TIME"].(*time.Time) for compatibility)
 type TimerMiddleware struct{}
 
 // MiddlewareFunc makes TimerMiddleware implement the Middleware interface.
@@ -14,13 +15,13 @@ func (mw *TimerMiddleware) MiddlewareFunc(h HandlerFunc) HandlerFunc {
 	return func(w ResponseWriter, r *Request) {
 
 		start := time.Now()
-		r.Env["START_TIME"] = &start
+		r.SetStartTime(start)
 
 		// call the handler
 		h(w, r)
 
 		end := time.Now()
 		elapsed := end.Sub(start)
-		r.Env["ELAPSED_TIME"] = &elapsed
+		r.SetElapsedTime(elapsed)
 	}
 }
@@ -0,0 +1,286 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span describes the processing of a request, as recorded by the TracingMiddleware.
+type Span struct {
+
+	// Id of the trace, 32 hex characters, received in the traceparent header or generated.
+	TraceId string
+
+	// Id of the span, 16 hex characters.
+	SpanId string
+
+	// Id of the span of the caller, from the traceparent header.
+	ParentSpanId string `json:",omitempty"`
+
+	// Vendor specific trace data, from the tracestate header.
+	TraceState string `json:",omitempty"`
+
+	// True if the trace is recorded, from the traceparent header flags.
+	Sampled bool
+
+	// The HTTP method and the PathExp of the matched Route, eg: "GET /users/:id".
+	// Only the HTTP method when no Route matched.
+	Name string
+
+	StartTime time.Time
+	Duration  time.Duration
+
+	// As recorded by the RecorderMiddleware.
+	StatusCode int
+
+	// Set for the panics and the 5xx responses.
+	Error string `json:",omitempty"`
+
+	// Additional data about the request.
+	Attributes map[string]string `json:",omitempty"`
+}
+
+// TraceParent returns the value of the traceparent header to send to the downstream services,
+// with this span as parent.
+func (s *Span) TraceParent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceId + "-" + s.SpanId + "-" + flags
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the Span of the request, as set by the TracingMiddleware.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SpanExporter defines the interface that objects must implement in order to receive the spans
+// recorded by the TracingMiddleware.
+type SpanExporter interface {
+
+	// ExportSpan is called once the response is written, with the completed span.
+	ExportSpan(span *Span) error
+}
+
+// InMemorySpanExporter is a SpanExporter that keeps the spans in memory, convenient for tests.
+// It is safe for concurrent use.
+type InMemorySpanExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+// NewInMemorySpanExporter returns an empty InMemorySpanExporter.
+func NewInMemorySpanExporter() *InMemorySpanExporter {
+	return &InMemorySpanExporter{}
+}
+
+// ExportSpan makes InMemorySpanExporter implement the SpanExporter interface.
+func (e *InMemorySpanExporter) ExportSpan(span *Span) error {
+	e.lock.Lock()
+	e.spans = append(e.spans, span)
+	e.lock.Unlock()
+	return nil
+}
+
+// Spans returns the exported spans, in the order of completion.
+func (e *InMemorySpanExporter) Spans() []*Span {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]*Span(nil), e.spans...)
+}
+
+// Reset removes all the exported spans.
+func (e *InMemorySpanExporter) Reset() {
+	e.lock.Lock()
+	e.spans = nil
+	e.lock.Unlock()
+}
+
+// JsonLinesSpanExporter is a SpanExporter that writes each span as a line of JSON.
+// It is safe for concurrent use.
+type JsonLinesSpanExporter struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// NewJsonLinesSpanExporter returns a JsonLinesSpanExporter writing to writer, eg: a file.
+func NewJsonLinesSpanExporter(writer io.Writer) *JsonLinesSpanExporter {
+	return &JsonLinesSpanExporter{writer: writer}
+}
+
+// ExportSpan makes JsonLinesSpanExporter implement the SpanExporter interface.
+func (e *JsonLinesSpanExporter) ExportSpan(span *Span) error {
+	b, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.writer.Write(append(b, '\n'))
+	return err
+}
+
+// TracingMiddleware implements the W3C Trace Context propagation. The traceparent and tracestate
+// request headers are parsed, and a Span is recorded for each request, as a child of the caller
+// span. The Span is available as SpanFromContext(request.Context()), and the trace id as
+// request.TraceId(). (also as request.Env["TRACE_ID"].(string) for compatibility) It depends on
+// RecorderMiddleware that should be in the wrapped middlewares. The access log middlewares that
+// wrap this middleware include the trace id in their records.
+type TracingMiddleware struct {
+
+	// Receives the sampled spans. Required.
+	Exporter SpanExporter
+
+	// Callback function that decides if a new trace, started without traceparent header, is
+	// sampled. Optional, defaults to sampling all the traces.
+	Sampler func(request *Request) bool
+
+	// Logger used to report the export errors. Optional, defaults to
+	// log.New(os.Stderr, "", 0).
+	Logger *log.Logger
+}
+
+// MiddlewareFunc makes TracingMiddleware implement the Middleware interface.
+func (mw *TracingMiddleware) MiddlewareFunc(handler HandlerFunc) HandlerFunc {
+
+	if mw.Exporter == nil {
+		log.Fatal("Exporter is required")
+	}
+	if mw.Sampler == nil {
+		mw.Sampler = func(request *Request) bool {
+			return true
+		}
+	}
+	if mw.Logger == nil {
+		mw.Logger = log.New(os.Stderr, "", 0)
+	}
+
+	return func(writer ResponseWriter, request *Request) {
+
+		span := &Span{
+			SpanId:    randomHex(8),
+			StartTime: time.Now(),
+			Attributes: map[string]string{
+				"http.method": request.Method,
+				"http.target": request.URL.RequestURI(),
+			},
+		}
+
+		traceId, parentSpanId, sampled, ok := parseTraceParent(request.Header.Get("traceparent"))
+		if ok {
+			span.TraceId = traceId
+			span.ParentSpanId = parentSpanId
+			span.Sampled = sampled
+			span.TraceState = request.Header.Get("tracestate")
+		} else {
+			span.TraceId = randomHex(16)
+			span.Sampled = mw.Sampler(request)
+		}
+
+		request.SetTraceId(span.TraceId)
+		request.Request = request.Request.WithContext(
+			context.WithValue(request.Context(), spanKey{}, span),
+		)
+
+		defer func() {
+			reco := recover()
+			mw.finish(span, request, reco)
+			if reco != nil {
+				panic(reco)
+			}
+		}()
+
+		handler(writer, request)
+	}
+}
+
+func (mw *TracingMiddleware) finish(span *Span, request *Request, reco interface{}) {
+
+	span.Duration = time.Since(span.StartTime)
+	span.Name = request.Method
+	if route, ok := request.Route(); ok {
+		span.Name += " " + route.PathExp
+		span.Attributes["http.route"] = route.PathExp
+	}
+	span.StatusCode, _ = request.StatusCode()
+	if remoteUser, ok := request.RemoteUser(); ok && remoteUser != "" {
+		span.Attributes["enduser.id"] = remoteUser
+	}
+
+	if reco != nil {
+		span.Error = fmt.Sprintf("panic: %v", reco)
+		if span.StatusCode == 0 {
+			span.StatusCode = http.StatusInternalServerError
+		}
+	} else if span.StatusCode >= 500 {
+		span.Error = http.StatusText(span.StatusCode)
+	}
+
+	if !span.Sampled {
+		return
+	}
+	if err := mw.Exporter.ExportSpan(span); err != nil {
+		mw.Logger.Printf("TracingMiddleware: cannot export the span: %s", err)
+	}
+}
+
+// parseTraceParent parses the traceparent header, as in "00-<trace id>-<parent id>-<flags>".
+func parseTraceParent(header string) (traceId, parentSpanId string, sampled bool, ok bool) {
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return "", "", false, false
+	}
+	version, traceId, parentSpanId, flags := parts[0], parts[1], parts[2], parts[3]
+
+	// version 00 has exactly 4 parts, the future versions may add more.
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+	if !isLowerHex(traceId, 32) || traceId == strings.Repeat("0", 32) {
+		return "", "", false, false
+	}
+	if !isLowerHex(parentSpanId, 16) || parentSpanId == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+	if !isLowerHex(flags, 2) {
+		return "", "", false, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return traceId, parentSpanId, flagBits[0]&0x01 == 0x01, true
+}
+
+func isLowerHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
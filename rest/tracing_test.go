@@ -0,0 +1,119 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ant0ine/go-json-rest/rest/test"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+
+	exporter := NewInMemorySpanExporter()
+	logBuffer := bytes.NewBufferString("")
+
+	api := NewApi()
+	api.Use(&AccessLogApacheMiddleware{
+		Logger: log.New(logBuffer, "", 0),
+		Format: "%{TRACE_ID}e %s",
+	})
+	api.Use(&TracingMiddleware{Exporter: exporter})
+	api.Use(&RecorderMiddleware{})
+	router, err := MakeRouter(
+		Get("/users/:id", func(w ResponseWriter, r *Request) {
+			span := SpanFromContext(r.Context())
+			w.WriteJson(map[string]string{"TraceParent": span.TraceParent()})
+		}),
+		Get("/fail", func(w ResponseWriter, r *Request) {
+			Error(w, "failed", 503)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	handler := api.MakeHandler()
+
+	// continue the trace of the caller
+	req := test.MakeSimpleRequest("GET", "http://localhost/users/123", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=value")
+	recorded := test.RunRequest(t, handler, req)
+	recorded.CodeIs(200)
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("1 span expected, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Unexpected TraceId: %s", span.TraceId)
+	}
+	if span.ParentSpanId != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected ParentSpanId: %s", span.ParentSpanId)
+	}
+	if span.TraceState != "vendor=value" {
+		t.Errorf("Unexpected TraceState: %s", span.TraceState)
+	}
+	if span.Name != "GET /users/:id" {
+		t.Errorf("Unexpected Name: %s", span.Name)
+	}
+	if span.StatusCode != 200 || span.Error != "" {
+		t.Errorf("Unexpected status: %d %s", span.StatusCode, span.Error)
+	}
+	recorded.BodyIs(`{"TraceParent":"00-4bf92f3577b34da6a3ce929d0e0e4736-` + span.SpanId + `-01"}`)
+	if logBuffer.String() != "4bf92f3577b34da6a3ce929d0e0e4736 200\n" {
+		t.Errorf("Unexpected access log: %s", logBuffer.String())
+	}
+
+	// new trace, with an invalid traceparent
+	exporter.Reset()
+	req = test.MakeSimpleRequest("GET", "http://localhost/fail", nil)
+	req.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	recorded = test.RunRequest(t, handler, req)
+	recorded.CodeIs(503)
+	span = exporter.Spans()[0]
+	if span.TraceId == strings.Repeat("0", 32) || len(span.TraceId) != 32 || span.ParentSpanId != "" {
+		t.Errorf("New trace expected, got %s %s", span.TraceId, span.ParentSpanId)
+	}
+	if span.Name != "GET /fail" || span.Error != "Service Unavailable" {
+		t.Errorf("Unexpected span: %s %s", span.Name, span.Error)
+	}
+
+	// not sampled by the caller
+	exporter.Reset()
+	req = test.MakeSimpleRequest("GET", "http://localhost/users/123", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	test.RunRequest(t, handler, req).CodeIs(200)
+	if len(exporter.Spans()) != 0 {
+		t.Error("No span expected to be exported")
+	}
+
+	// no route, named after the method
+	test.RunRequest(t, handler, test.MakeSimpleRequest("GET", "http://localhost/unknown", nil)).CodeIs(404)
+	if exporter.Spans()[0].Name != "GET" {
+		t.Errorf("Unexpected Name: %s", exporter.Spans()[0].Name)
+	}
+}
+
+func TestJsonLinesSpanExporter(t *testing.T) {
+
+	buffer := bytes.NewBufferString("")
+	exporter := NewJsonLinesSpanExporter(buffer)
+	exporter.ExportSpan(&Span{TraceId: "a", SpanId: "b", Name: "GET /"})
+	exporter.ExportSpan(&Span{TraceId: "a", SpanId: "c", Name: "GET /"})
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("2 lines expected, got %d", len(lines))
+	}
+	span := &Span{}
+	if err := json.Unmarshal([]byte(lines[1]), span); err != nil {
+		t.Fatal(err)
+	}
+	if span.SpanId != "c" {
+		t.Errorf("SpanId c expected, got %s", span.SpanId)
+	}
+}
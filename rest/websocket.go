@@ -0,0 +1,554 @@
+package rest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket message types, as defined by the opcodes of RFC 6455.
+const (
+	WebSocketTextMessage   = 1
+	WebSocketBinaryMessage = 2
+	WebSocketCloseMessage  = 8
+	WebSocketPingMessage   = 9
+	WebSocketPongMessage   = 10
+
+	webSocketContinuation = 0
+)
+
+// WebSocket close codes, as defined by RFC 6455 section 7.4.1.
+const (
+	WebSocketCloseNormalClosure     = 1000
+	WebSocketCloseGoingAway         = 1001
+	WebSocketCloseProtocolError     = 1002
+	WebSocketCloseUnsupportedData   = 1003
+	WebSocketCloseNoStatusReceived  = 1005
+	WebSocketCloseAbnormalClosure   = 1006
+	WebSocketCloseInvalidPayload    = 1007
+	WebSocketClosePolicyViolation   = 1008
+	WebSocketCloseMessageTooBig     = 1009
+	WebSocketCloseInternalServerErr = 1011
+)
+
+// The GUID concatenated to the Sec-WebSocket-Key to compute Sec-WebSocket-Accept.
+const webSocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	// ErrWebSocketClosed is returned when writing to a WebSocketConn after the close frame has
+	// been sent.
+	ErrWebSocketClosed = errors.New("WebSocket connection is closed")
+
+	errWebSocketProtocol    = errors.New("WebSocket protocol error")
+	errWebSocketTooBig      = errors.New("WebSocket message too big")
+	errWebSocketInvalidUtf8 = errors.New("WebSocket invalid UTF-8 text message")
+)
+
+// WebSocketCloseError is returned by WebSocketConn.ReadMessage when a close frame is received
+// from the peer, or when the connection is closed because of a protocol violation.
+type WebSocketCloseError struct {
+	Code int
+	Text string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("WebSocket closed with code %d: %s", e.Code, e.Text)
+}
+
+// WebSocketHandlerFunc defines the handler function called once the WebSocket handshake has
+// succeeded. The connection is closed when the function returns.
+type WebSocketHandlerFunc func(*WebSocketConn, *Request)
+
+// WebSocketUpgrader performs the RFC 6455 opening handshake on a hijacked connection.
+// The zero value is usable, with the defaults described below.
+type WebSocketUpgrader struct {
+
+	// Maximum size in bytes of a message read from the peer. A bigger message closes the
+	// connection with WebSocketCloseMessageTooBig. Defaults to 1MB.
+	MaxMessageSize int64
+
+	// Function executed to validate the Origin header of the handshake request.
+	// Must return true if valid, false if invalid.
+	// Optional, defaults to accept all origins.
+	OriginValidator func(origin string, request *Request) bool
+
+	// List of supported subprotocols, in order of preference. The first one also requested
+	// by the client is selected and returned in the Sec-WebSocket-Protocol header.
+	Subprotocols []string
+}
+
+const defaultWebSocketMaxMessageSize = 1 << 20
+
+// Upgrade validates the handshake request, hijacks the connection, writes the
+// 101 Switching Protocols response and returns the WebSocketConn.
+// On validation failure, an error response is written and an error is returned.
+func (u *WebSocketUpgrader) Upgrade(w ResponseWriter, r *Request) (*WebSocketConn, error) {
+
+	if r.Method != "GET" {
+		Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("WebSocket handshake requires GET")
+	}
+
+	if !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		Error(w, "Invalid WebSocket handshake", http.StatusBadRequest)
+		return nil, errors.New("WebSocket handshake requires the Upgrade headers")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("WebSocket version not supported")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decodedKey) != 16 {
+		Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("WebSocket handshake with an invalid key")
+	}
+
+	if u.OriginValidator != nil && !u.OriginValidator(r.Header.Get("Origin"), r) {
+		Error(w, "Invalid Origin", http.StatusForbidden)
+		return nil, errors.New("WebSocket handshake with an invalid Origin")
+	}
+
+	subprotocol := u.selectSubprotocol(r)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("ResponseWriter does not implement http.Hijacker")
+	}
+	netConn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n"
+	if subprotocol != "" {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	response += "\r\n"
+
+	if _, err := bufrw.WriteString(response); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := bufrw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	maxMessageSize := u.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultWebSocketMaxMessageSize
+	}
+
+	conn := newWebSocketConn(netConn, bufrw.Reader, true, maxMessageSize)
+	conn.Subprotocol = subprotocol
+	conn.codec = r.jsonCodec()
+	return conn, nil
+}
+
+func (u *WebSocketUpgrader) selectSubprotocol(r *Request) string {
+	requested := map[string]bool{}
+	for _, value := range r.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, protocol := range strings.Split(value, ",") {
+			requested[strings.TrimSpace(protocol)] = true
+		}
+	}
+	for _, protocol := range u.Subprotocols {
+		if requested[protocol] {
+			return protocol
+		}
+	}
+	return ""
+}
+
+// UpgradeWebSocket performs the handshake with the default WebSocketUpgrader settings.
+func UpgradeWebSocket(w ResponseWriter, r *Request) (*WebSocketConn, error) {
+	upgrader := &WebSocketUpgrader{}
+	return upgrader.Upgrade(w, r)
+}
+
+// Route instantiates a GET route that performs the WebSocket handshake before calling the
+// handler. The connection is closed with WebSocketCloseNormalClosure when the handler returns.
+func (u *WebSocketUpgrader) Route(pathExp string, handler WebSocketHandlerFunc) *Route {
+	return &Route{
+		HttpMethod: "GET",
+		PathExp:    pathExp,
+		Func: func(w ResponseWriter, r *Request) {
+			conn, err := u.Upgrade(w, r)
+			if err != nil {
+				// the error response has already been written, if possible.
+				return
+			}
+			defer conn.Close(WebSocketCloseNormalClosure, "")
+			handler(conn, r)
+		},
+	}
+}
+
+// WebSocket is a shortcut method that instantiates a WebSocket route with the default
+// WebSocketUpgrader settings. See WebSocketUpgrader.Route.
+func WebSocket(pathExp string, handler WebSocketHandlerFunc) *Route {
+	upgrader := &WebSocketUpgrader{}
+	return upgrader.Route(pathExp, handler)
+}
+
+// Compute the Sec-WebSocket-Accept value from the Sec-WebSocket-Key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGuid))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Return true if one of the comma separated values of the header matches the token,
+// case insensitive.
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocketConn is a message level WebSocket connection. ReadMessage (and ReadJson) must be
+// called from a single goroutine, the write methods can be called concurrently.
+// Ping frames received from the peer are answered automatically with a pong.
+type WebSocketConn struct {
+
+	// The subprotocol selected during the handshake, if any.
+	Subprotocol string
+
+	conn           net.Conn
+	reader         *bufio.Reader
+	isServer       bool
+	maxMessageSize int64
+
+	writeLock sync.Mutex
+	closeSent bool
+
+	pongHandler func(data []byte)
+
+	codec JsonCodec
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, isServer bool, maxMessageSize int64) *WebSocketConn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &WebSocketConn{
+		conn:           conn,
+		reader:         reader,
+		isServer:       isServer,
+		maxMessageSize: maxMessageSize,
+		codec:          defaultJsonCodec,
+	}
+}
+
+// SetPongHandler sets the function called when a pong frame is received.
+func (c *WebSocketConn) SetPongHandler(handler func(data []byte)) {
+	c.pongHandler = handler
+}
+
+// SetReadDeadline sets the deadline of the underlying connection for future reads.
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the underlying connection for future writes.
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// RemoteAddr returns the remote network address.
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ReadMessage reads the next data message, reassembling the fragmented messages and handling the
+// control frames. A close frame from the peer is answered, and returned as a *WebSocketCloseError.
+func (c *WebSocketConn) ReadMessage() (int, []byte, error) {
+
+	messageType := 0
+	var message []byte
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.failOnError(err)
+		}
+
+		switch opcode {
+
+		case WebSocketPingMessage:
+			err := c.writeFrame(WebSocketPongMessage, payload)
+			if err != nil && err != ErrWebSocketClosed {
+				return 0, nil, err
+			}
+			// the control frames can be interleaved with the fragments of a message
+			continue
+
+		case WebSocketPongMessage:
+			if c.pongHandler != nil {
+				c.pongHandler(payload)
+			}
+			continue
+
+		case WebSocketCloseMessage:
+			if len(payload) == 1 {
+				// a status code is two bytes
+				return 0, nil, c.failOnError(errWebSocketProtocol)
+			}
+			closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatusReceived}
+			replyPayload := []byte{}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Text = string(payload[2:])
+				replyPayload = payload[:2]
+			}
+			c.writeFrame(WebSocketCloseMessage, replyPayload)
+			return 0, nil, closeErr
+
+		case WebSocketTextMessage, WebSocketBinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.failOnError(errWebSocketProtocol)
+			}
+			messageType = opcode
+			message = payload
+
+		case webSocketContinuation:
+			if messageType == 0 {
+				return 0, nil, c.failOnError(errWebSocketProtocol)
+			}
+			if int64(len(message)+len(payload)) > c.maxMessageSize {
+				return 0, nil, c.failOnError(errWebSocketTooBig)
+			}
+			message = append(message, payload...)
+
+		default:
+			return 0, nil, c.failOnError(errWebSocketProtocol)
+		}
+
+		if messageType != 0 && fin {
+			if messageType == WebSocketTextMessage && !utf8.Valid(message) {
+				return 0, nil, c.failOnError(errWebSocketInvalidUtf8)
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// ReadJson reads the next data message and decodes it with the JsonCodec of the Api.
+func (c *WebSocketConn) ReadJson(v interface{}) error {
+	_, message, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(message, v)
+}
+
+// WriteMessage writes a data message in a single frame. messageType must be
+// WebSocketTextMessage or WebSocketBinaryMessage.
+func (c *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != WebSocketTextMessage && messageType != WebSocketBinaryMessage {
+		return errors.New("invalid WebSocket data message type")
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// WriteJson encodes the data structure with the JsonCodec of the Api and writes it as a text
+// message.
+func (c *WebSocketConn) WriteJson(v interface{}) error {
+	b, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(WebSocketTextMessage, b)
+}
+
+// Ping sends a ping frame, the peer is expected to answer with a pong. See SetPongHandler.
+func (c *WebSocketConn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("WebSocket control frame payload too big")
+	}
+	return c.writeFrame(WebSocketPingMessage, data)
+}
+
+// Close sends a close frame with the given code and reason if it has not already been sent,
+// and closes the underlying connection.
+func (c *WebSocketConn) Close(code int, text string) error {
+	payload := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, text...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	err := c.writeFrame(WebSocketCloseMessage, payload)
+	errC := c.conn.Close()
+	if err != nil && err != ErrWebSocketClosed {
+		return err
+	}
+	return errC
+}
+
+// Send the close frame corresponding to the protocol error, and return the error to report.
+func (c *WebSocketConn) failOnError(err error) error {
+	code := 0
+	switch err {
+	case errWebSocketProtocol:
+		code = WebSocketCloseProtocolError
+	case errWebSocketTooBig:
+		code = WebSocketCloseMessageTooBig
+	case errWebSocketInvalidUtf8:
+		code = WebSocketCloseInvalidPayload
+	default:
+		return err
+	}
+	c.Close(code, err.Error())
+	return &WebSocketCloseError{Code: code, Text: err.Error()}
+}
+
+// Read one frame, unmasking the payload if needed.
+func (c *WebSocketConn) readFrame() (bool, int, []byte, error) {
+
+	header := make([]byte, 2, 8)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		// no extension negotiated, the RSV bits must be 0
+		return false, 0, nil, errWebSocketProtocol
+	}
+	opcode := int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+
+	// client to server frames must be masked, server to client frames must not.
+	if masked != c.isServer {
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	isControl := opcode&0x08 != 0
+	if isControl && (!fin || length > 125) {
+		return false, 0, nil, errWebSocketProtocol
+	}
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(extended))
+		if length < 0 {
+			return false, 0, nil, errWebSocketProtocol
+		}
+	}
+
+	if length > c.maxMessageSize {
+		return false, 0, nil, errWebSocketTooBig
+	}
+
+	var maskKey []byte
+	if masked {
+		maskKey = make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, maskKey); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskWebSocketPayload(maskKey, payload)
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Write one final frame, masking the payload if needed.
+func (c *WebSocketConn) writeFrame(opcode int, payload []byte) error {
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return ErrWebSocketClosed
+	}
+	if opcode == WebSocketCloseMessage {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|byte(opcode))
+
+	maskBit := byte(0)
+	if !c.isServer {
+		maskBit = 0x80
+	}
+
+	length := len(payload)
+	switch {
+	case length <= 125:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+	}
+
+	if c.isServer {
+		frame = append(frame, payload...)
+	} else {
+		maskKey := make([]byte, 4)
+		if _, err := rand.Read(maskKey); err != nil {
+			return err
+		}
+		frame = append(frame, maskKey...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskWebSocketPayload(maskKey, frame[start:])
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Apply the masking algorithm of RFC 6455 section 5.3, in place.
+func maskWebSocketPayload(maskKey []byte, payload []byte) {
+	for i := range payload {
+		payload[i] ^= maskKey[i%4]
+	}
+}
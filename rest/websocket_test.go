@@ -0,0 +1,245 @@
+package rest
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Perform the client side of the handshake, and return a client WebSocketConn.
+func dialWebSocket(t *testing.T, serverUrl string, path string) (*WebSocketConn, net.Conn) {
+
+	host := strings.TrimPrefix(serverUrl, "http://")
+	conn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	request, err := http.NewRequest("GET", serverUrl+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	if err := request.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 101 {
+		t.Fatalf("Code 101 expected, got: %d", response.StatusCode)
+	}
+	// example value from RFC 6455 section 1.3
+	if response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected Sec-WebSocket-Accept: %s", response.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return newWebSocketConn(conn, reader, false, defaultWebSocketMaxMessageSize), conn
+}
+
+func makeWebSocketTestServer(t *testing.T, handler WebSocketHandlerFunc) *httptest.Server {
+	api := NewApi()
+	api.Use(DefaultCommonStack...)
+	router, err := MakeRouter(
+		WebSocket("/ws", handler),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.SetApp(router)
+	return httptest.NewServer(api.MakeHandler())
+}
+
+func TestWebSocketJsonEcho(t *testing.T) {
+
+	closed := make(chan *WebSocketCloseError, 1)
+
+	server := makeWebSocketTestServer(t, func(conn *WebSocketConn, r *Request) {
+		for {
+			payload := map[string]interface{}{}
+			err := conn.ReadJson(&payload)
+			if err != nil {
+				closeErr, _ := err.(*WebSocketCloseError)
+				closed <- closeErr
+				return
+			}
+			payload["Echo"] = true
+			conn.WriteJson(payload)
+		}
+	})
+	defer server.Close()
+
+	client, _ := dialWebSocket(t, server.URL, "/ws")
+
+	pong := make(chan string, 1)
+	client.SetPongHandler(func(data []byte) {
+		pong <- string(data)
+	})
+
+	// ping, answered automatically by the server
+	if err := client.Ping([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.WriteJson(map[string]string{"Id": "123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pong is processed while reading the echo
+	response := map[string]interface{}{}
+	if err := client.ReadJson(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response["Id"] != "123" || response["Echo"] != true {
+		t.Errorf("Unexpected echo: %v", response)
+	}
+	if data := <-pong; data != "hello" {
+		t.Errorf("Pong payload 'hello' expected, got: '%s'", data)
+	}
+
+	// a fragmented message
+	client.writeLock.Lock()
+	fragments := []struct {
+		fin     bool
+		opcode  int
+		payload string
+	}{
+		{false, WebSocketTextMessage, `{"Id":`},
+		{true, WebSocketPingMessage, "between"},
+		{false, webSocketContinuation, `"456"`},
+		{true, webSocketContinuation, `}`},
+	}
+	for _, fragment := range fragments {
+		header := byte(fragment.opcode)
+		if fragment.fin {
+			header |= 0x80
+		}
+		frame := []byte{header, 0x80 | byte(len(fragment.payload)), 1, 2, 3, 4}
+		payload := []byte(fragment.payload)
+		maskWebSocketPayload(frame[2:6], payload)
+		client.conn.Write(append(frame, payload...))
+	}
+	client.writeLock.Unlock()
+
+	response = map[string]interface{}{}
+	if err := client.ReadJson(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response["Id"] != "456" {
+		t.Errorf("Unexpected echo: %v", response)
+	}
+	if data := <-pong; data != "between" {
+		t.Errorf("Pong payload 'between' expected, got: '%s'", data)
+	}
+
+	// close handshake
+	if err := client.Close(WebSocketCloseGoingAway, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	closeErr := <-closed
+	if closeErr == nil {
+		t.Fatal("WebSocketCloseError expected")
+	}
+	if closeErr.Code != WebSocketCloseGoingAway || closeErr.Text != "bye" {
+		t.Errorf("Unexpected close error: %v", closeErr)
+	}
+}
+
+func TestWebSocketUnmaskedFrame(t *testing.T) {
+
+	server := makeWebSocketTestServer(t, func(conn *WebSocketConn, r *Request) {
+		conn.ReadMessage()
+	})
+	defer server.Close()
+
+	client, rawConn := dialWebSocket(t, server.URL, "/ws")
+
+	// client frames must be masked
+	rawConn.Write([]byte{0x81, 0x02, 'h', 'i'})
+
+	_, _, err := client.ReadMessage()
+	closeErr, ok := err.(*WebSocketCloseError)
+	if !ok {
+		t.Fatalf("WebSocketCloseError expected, got: %v", err)
+	}
+	if closeErr.Code != WebSocketCloseProtocolError {
+		t.Errorf("Close code %d expected, got: %d", WebSocketCloseProtocolError, closeErr.Code)
+	}
+}
+
+func TestWebSocketInvalidClosePayload(t *testing.T) {
+
+	closed := make(chan error, 1)
+
+	server := makeWebSocketTestServer(t, func(conn *WebSocketConn, r *Request) {
+		_, _, err := conn.ReadMessage()
+		closed <- err
+	})
+	defer server.Close()
+
+	client, rawConn := dialWebSocket(t, server.URL, "/ws")
+
+	// a close payload must have at least the two bytes of the status code
+	frame := []byte{0x88, 0x81, 1, 2, 3, 4}
+	payload := []byte{0x03}
+	maskWebSocketPayload(frame[2:6], payload)
+	rawConn.Write(append(frame, payload...))
+
+	closeErr, ok := (<-closed).(*WebSocketCloseError)
+	if !ok || closeErr.Code != WebSocketCloseProtocolError {
+		t.Errorf("Close code %d expected, got: %v", WebSocketCloseProtocolError, closeErr)
+	}
+
+	_, _, err := client.ReadMessage()
+	closeErr, ok = err.(*WebSocketCloseError)
+	if !ok || closeErr.Code != WebSocketCloseProtocolError {
+		t.Errorf("Close code %d expected, got: %v", WebSocketCloseProtocolError, err)
+	}
+}
+
+func TestWebSocketInvalidHandshake(t *testing.T) {
+
+	server := makeWebSocketTestServer(t, func(conn *WebSocketConn, r *Request) {
+		t.Error("Should never be executed")
+	})
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 400 {
+		t.Errorf("Code 400 expected, got: %d", response.StatusCode)
+	}
+
+	request, _ := http.NewRequest("GET", server.URL+"/ws", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Version", "8")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 426 {
+		t.Errorf("Code 426 expected, got: %d", response.StatusCode)
+	}
+	if response.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("Sec-WebSocket-Version 13 expected, got: %s", response.Header.Get("Sec-WebSocket-Version"))
+	}
+}